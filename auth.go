@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// codeUnauthorized is the JSON-RPC error code sent to clients which fail to
+// authenticate (see authenticator).
+const codeUnauthorized = -32001
+
+// authTokenOption is the field of the initializationOptions of the
+// 'initialize' request which can carry the token of the client. It is
+// removed before the request is passed on to the language server.
+const authTokenOption = "authToken"
+
+// authenticator checks the token clients present before their session
+// starts. A token is either one of the shared tokens in tokenFile, or an
+// HMAC token signed with one of the keys in hmacKeyFile (see
+// checkHMACToken). The files are read for each session, so that secrets can
+// be rotated without a restart.
+type authenticator struct {
+	tokenFile, hmacKeyFile string
+}
+
+// authError is the reason a client failed to authenticate.
+type authError struct {
+	reason string // "missing", "invalid", "expired" or "error", the label of metricAuthFailures
+}
+
+func (e *authError) Error() string {
+	switch e.reason {
+	case "missing":
+		return "authentication required: no token was presented"
+	case "expired":
+		return "authentication failed: the token has expired"
+	case "error":
+		return "authentication failed: the token couldn't be checked"
+	default:
+		return "authentication failed: invalid token"
+	}
+}
+
+// newAuthenticator returns the authenticator for -authTokenFile and
+// -authHMACKeyFile, or nil if authentication is disabled.
+func newAuthenticator(tokenFile, hmacKeyFile string) (*authenticator, error) {
+	if tokenFile == "" && hmacKeyFile == "" {
+		return nil, nil
+	}
+	a := &authenticator{tokenFile: tokenFile, hmacKeyFile: hmacKeyFile}
+	for _, file := range []string{tokenFile, hmacKeyFile} {
+		if file == "" {
+			continue
+		}
+		secrets, err := readSecrets(file)
+		if err != nil {
+			return nil, err
+		}
+		if len(secrets) == 0 {
+			return nil, errors.Errorf("%s doesn't contain any secrets", file)
+		}
+	}
+	return a, nil
+}
+
+// readSecrets returns the non-empty lines of file.
+func readSecrets(file string) ([]string, error) {
+	if file == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading secrets failed")
+	}
+	var secrets []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			secrets = append(secrets, line)
+		}
+	}
+	return secrets, nil
+}
+
+// authenticate checks the token of the client connected to conn, which is
+// taken from the first of:
+//
+//   - the "Authorization: Bearer <token>" header of the WebSocket handshake,
+//   - an "Authorization: Bearer <token>" line among the headers of the first
+//     message (e.x. before its Content-Length header),
+//   - the authToken field of the initializationOptions of the 'initialize'
+//     request.
+//
+// It returns a connection which reads what the client sent again, except for
+// the Authorization header line.
+func (a *authenticator) authenticate(conn net.Conn) (net.Conn, error) {
+	var token string
+	if c, ok := conn.(*websocketConn); ok {
+		token = bearerToken(c.header.Get("Authorization"))
+	}
+	if token == "" {
+		var err error
+		conn, token, err = readAuthHeader(conn, initializeTimeout)
+		if err != nil {
+			return conn, err
+		}
+	}
+	if token == "" {
+		var req *jsonrpc2.Request
+		var err error
+		conn, req, err = peekInitialize(conn, initializeTimeout)
+		if err != nil {
+			return conn, err
+		}
+		token = initializeAuthToken(req.Params)
+	}
+	return conn, a.check(token)
+}
+
+// check checks token against the shared tokens and HMAC keys.
+func (a *authenticator) check(token string) error {
+	if token == "" {
+		return &authError{reason: "missing"}
+	}
+	tokens, err := readSecrets(a.tokenFile)
+	if err != nil {
+		rootLogger.errorf("CloneProxy: checking the token of a client failed: %s", err)
+		return err
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	keys, err := readSecrets(a.hmacKeyFile)
+	if err != nil {
+		rootLogger.errorf("CloneProxy: checking the token of a client failed: %s", err)
+		return err
+	}
+	for _, key := range keys {
+		if subject, expiry, ok := checkHMACToken(token, key); ok {
+			if time.Now().After(expiry) {
+				return &authError{reason: "expired"}
+			}
+			rootLogger.with("subject", subject).debugf("CloneProxy: client authenticated with a signed token")
+			return nil
+		}
+	}
+	return &authError{reason: "invalid"}
+}
+
+// rejectUnauthenticated rejects the session of the client on conn, which
+// failed to authenticate because of err (see rejectSession). Errors other
+// than an authError, e.x. a client which didn't send its first message in
+// time or a secrets file which can't be read, are counted with the reason
+// "error", and their details aren't sent to the client.
+func rejectUnauthenticated(ctx context.Context, conn net.Conn, err error) {
+	rootLogger.with("remote_addr", conn.RemoteAddr()).warnf("Rejecting session: %s", err)
+	authErr, ok := err.(*authError)
+	if !ok {
+		authErr = &authError{reason: "error"}
+	}
+	metricAuthFailures.inc(authErr.reason)
+	rejectSession(ctx, conn, codeUnauthorized, authErr)
+}
+
+// checkHMACToken reports whether token is "<subject>.<expiry>.<signature>"
+// signed with key: subject identifies the client (or is a nonce) and must not
+// be empty, expiry is a Unix timestamp and signature the unpadded base64url
+// encoded HMAC-SHA256 of "<subject>.<expiry>". It returns the subject and the
+// expiry.
+func checkHMACToken(token, key string) (string, time.Time, bool) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return "", time.Time{}, false
+	}
+	payload := token[:i]
+	j := strings.LastIndexByte(payload, '.')
+	if j <= 0 {
+		return "", time.Time{}, false
+	}
+	expiry, err := strconv.ParseInt(payload[j+1:], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(payload))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", time.Time{}, false
+	}
+	return payload[:j], time.Unix(expiry, 0), true
+}
+
+func bearerToken(header string) string {
+	const prefix = "Bearer "
+	if len(header) > len(prefix) && strings.EqualFold(header[:len(prefix)], prefix) {
+		return strings.TrimSpace(header[len(prefix):])
+	}
+	return ""
+}
+
+// readAuthHeader reads the header lines of the first message the client
+// sent on conn, waiting at most timeout for them, and returns the token of
+// the Authorization line among them, if any. The returned connection reads
+// the header lines (except for the Authorization line) again.
+func readAuthHeader(conn net.Conn, timeout time.Duration) (net.Conn, string, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	var kept bytes.Buffer
+	var token string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			kept.WriteString(line)
+			return &replayConn{Conn: conn, r: io.MultiReader(&kept, r)}, "", errors.Wrap(err, "reading the first message failed")
+		}
+		if i := strings.IndexByte(line, ':'); i >= 0 && strings.EqualFold(line[:i], "Authorization") {
+			token = bearerToken(strings.TrimSpace(line[i+1:]))
+			continue
+		}
+		kept.WriteString(line)
+		if line == "\r\n" {
+			return &replayConn{Conn: conn, r: io.MultiReader(&kept, r)}, token, nil
+		}
+	}
+}
+
+// initializeAuthToken returns the authToken field of the
+// initializationOptions in params, the params of an 'initialize' request.
+func initializeAuthToken(params *json.RawMessage) string {
+	if params == nil {
+		return ""
+	}
+	var p struct {
+		InitializationOptions struct {
+			AuthToken string `json:"authToken"`
+		} `json:"initializationOptions"`
+	}
+	if err := json.Unmarshal(*params, &p); err != nil {
+		return ""
+	}
+	return p.InitializationOptions.AuthToken
+}
+
+// withoutAuthToken returns params, the params of an 'initialize' request,
+// without the authToken field of its initializationOptions.
+func withoutAuthToken(params *json.RawMessage) (*json.RawMessage, error) {
+	if params == nil {
+		return params, nil
+	}
+	var p map[string]json.RawMessage
+	if err := json.Unmarshal(*params, &p); err != nil {
+		return nil, errors.Wrap(err, "invalid initialize params")
+	}
+	var options map[string]json.RawMessage
+	if err := json.Unmarshal(p["initializationOptions"], &options); err != nil {
+		return params, nil
+	}
+	if _, ok := options[authTokenOption]; !ok {
+		return params, nil
+	}
+	delete(options, authTokenOption)
+	b, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	p["initializationOptions"] = b
+	if b, err = json.Marshal(p); err != nil {
+		return nil, err
+	}
+	stripped := json.RawMessage(b)
+	return &stripped, nil
+}
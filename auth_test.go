@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// newHMACToken returns an HMAC token (see checkHMACToken) for subject signed
+// with key which expires at expiry.
+func newHMACToken(key, subject string, expiry time.Time) string {
+	payload := subject + "." + strconv.FormatInt(expiry.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newTestAuthenticator returns an authenticator reading its secrets from
+// temporary files, and a function which removes them.
+func newTestAuthenticator(t *testing.T) (*authenticator, func()) {
+	tmp, err := ioutil.TempDir("", "auth-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { os.RemoveAll(tmp) }
+	tokenFile, keyFile := filepath.Join(tmp, "tokens"), filepath.Join(tmp, "keys")
+	if err := ioutil.WriteFile(tokenFile, []byte("first\n\nsecond\n"), 0600); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, []byte("old-key\nnew-key\n"), 0600); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	a, err := newAuthenticator(tokenFile, keyFile)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return a, cleanup
+}
+
+func TestAuthenticatorCheck(t *testing.T) {
+	a, cleanup := newTestAuthenticator(t)
+	defer cleanup()
+	expiry := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	mac := hmac.New(sha256.New, []byte("new-key"))
+	mac.Write([]byte(expiry))
+	oldToken := expiry + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	cases := []struct {
+		token  string
+		reason string // empty if the token is valid
+	}{
+		{"second", ""},
+		{newHMACToken("old-key", "alice", time.Now().Add(time.Hour)), ""},
+		{newHMACToken("new-key", "alice", time.Now().Add(time.Hour)), ""},
+		{newHMACToken("new-key", "frontend.example.com", time.Now().Add(time.Hour)), ""},
+		{"", "missing"},
+		{"third", "invalid"},
+		{newHMACToken("other-key", "alice", time.Now().Add(time.Hour)), "invalid"},
+		{newHMACToken("new-key", "", time.Now().Add(time.Hour)), "invalid"},
+		// The subject is signed, so it can't be changed.
+		{"mallory" + strings.TrimPrefix(newHMACToken("new-key", "alice", time.Now().Add(time.Hour)), "alice"), "invalid"},
+		// Tokens which only sign their expiry aren't accepted.
+		{oldToken, "invalid"},
+		{newHMACToken("new-key", "alice", time.Now().Add(-time.Minute)), "expired"},
+	}
+	for _, c := range cases {
+		err := a.check(c.token)
+		if c.reason == "" {
+			if err != nil {
+				t.Errorf("check(%q) = %s, want no error", c.token, err)
+			}
+			continue
+		}
+		if authErr, ok := err.(*authError); !ok || authErr.reason != c.reason {
+			t.Errorf("check(%q) = %v, want reason %s", c.token, err, c.reason)
+		}
+	}
+
+	if _, err := newAuthenticator(filepath.Join(os.TempDir(), "does-not-exist"), ""); err == nil {
+		t.Error("expected an error for a missing token file")
+	}
+	if a, err := newAuthenticator("", ""); a != nil || err != nil {
+		t.Error("expected authentication to be disabled without secrets")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	a, cleanup := newTestAuthenticator(t)
+	defer cleanup()
+	var clients []net.Conn
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+	send := func(headers, params string) net.Conn {
+		client, server := net.Pipe()
+		clients = append(clients, client)
+		body := `{"jsonrpc":"2.0","id":1,"method":"initialize","params":` + params + `}`
+		go fmt.Fprintf(client, "%sContent-Length: %d\r\n\r\n%s", headers, len(body), body)
+		return server
+	}
+	cases := []struct {
+		headers, params string
+		wantErr         bool
+	}{
+		{"Authorization: Bearer first\r\n", `{}`, false},
+		{"", `{"initializationOptions":{"authToken":"second"}}`, false},
+		{"Authorization: Bearer wrong\r\n", `{"initializationOptions":{"authToken":"second"}}`, true},
+		{"", `{"initializationOptions":{}}`, true},
+	}
+	for _, c := range cases {
+		conn, err := a.authenticate(send(c.headers, c.params))
+		if (err != nil) != c.wantErr {
+			t.Errorf("authenticate(%q, %s) = %v, want error %v", c.headers, c.params, err, c.wantErr)
+			continue
+		}
+
+		// The session reads the initialize request without the
+		// Authorization header.
+		_, req, err := peekInitialize(conn, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(*req.Params, []byte(c.params[1:len(c.params)-1])) {
+			t.Errorf("got params %s, want %s", *req.Params, c.params)
+		}
+	}
+
+	// WebSocket clients can present the token in the handshake.
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis := newWebsocketListener(tcp, nil, func(string) bool { return false })
+	defer lis.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws://"+lis.Addr().String(), http.Header{"Authorization": {"Bearer first"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := a.authenticate(conn); err != nil {
+		t.Errorf("expected the token of the WebSocket handshake to be accepted, got %s", err)
+	}
+
+	// Clients which don't send anything time out.
+	_, idle := net.Pipe()
+	if _, _, err := readAuthHeader(idle, 10*time.Millisecond); err == nil {
+		t.Error("expected an error for a client which doesn't send anything")
+	}
+}
+
+func TestRejectUnauthenticated(t *testing.T) {
+	logs, restore := captureLogs("logfmt")
+	defer restore()
+
+	// A token file which can't be read is logged as an error, and the
+	// client isn't told why its token couldn't be checked.
+	a, cleanup := newTestAuthenticator(t)
+	defer cleanup()
+	if err := os.Remove(a.tokenFile); err != nil {
+		t.Fatal(err)
+	}
+	err := a.check("first")
+	if _, ok := err.(*authError); err == nil || ok {
+		t.Fatalf("expected the error of reading the token file, got %v", err)
+	}
+	if !strings.Contains(logs.String(), "level=error") || !strings.Contains(logs.String(), "checking the token of a client failed") {
+		t.Errorf("expected the error to be logged, got %q", logs.String())
+	}
+
+	errorFailures := func() float64 {
+		metricAuthFailures.mu.Lock()
+		defer metricAuthFailures.mu.Unlock()
+		if s, ok := metricAuthFailures.series["error"]; ok {
+			return s.value
+		}
+		return 0
+	}
+	before := errorFailures()
+
+	ctx := context.Background()
+	client, server := net.Pipe()
+	go rejectUnauthenticated(ctx, server, err)
+	conn := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(client, jsonrpc2.VSCodeObjectCodec{}), nil)
+	defer conn.Close()
+	callErr := conn.Call(ctx, "initialize", struct{}{}, nil)
+	if e, ok := callErr.(*jsonrpc2.Error); !ok || e.Code != codeUnauthorized || e.Message != "authentication failed: the token couldn't be checked" {
+		t.Errorf("got %v, want the error of a token which couldn't be checked", callErr)
+	}
+	if got := errorFailures() - before; got != 1 {
+		t.Errorf("got %v more auth failures with the reason error, want 1", got)
+	}
+}
+
+func TestReadAuthHeader(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.WriteString(client, "Content-Type: application/vscode-jsonrpc\r\nauthorization: bearer abc\r\nContent-Length: 2\r\n\r\n{}")
+	conn, token, err := readAuthHeader(server, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "abc" {
+		t.Errorf("got token %q, want abc", token)
+	}
+	want := "Content-Type: application/vscode-jsonrpc\r\nContent-Length: 2\r\n\r\n{}"
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWithoutAuthToken(t *testing.T) {
+	params := json.RawMessage(`{"rootUri":"file:///","initializationOptions":{"authToken":"secret","a":1}}`)
+	stripped, err := withoutAuthToken(&params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(*stripped), `{"initializationOptions":{"a":1},"rootUri":"file:///"}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
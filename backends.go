@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// initializeTimeout is how long to wait for the 'initialize' request of a
+// session which is routed to a backend by its mode.
+const initializeTimeout = 30 * time.Second
+
+// backendSet is the set of language server backends sessions are routed
+// to. Without -backends there is a single one, configured by the flags and
+// the -config profile. With -backends there is one per listed profile, and
+// the first one is the default.
+type backendSet struct {
+	backends []*sessionConfig
+	process  map[string]string // the flags which apply to the whole process, see processFlags
+}
+
+// newBackendSet returns the set of backends, or an error if two of them
+// claim the same mode or listenAddress. process are the values of the flags
+// which apply to the whole process.
+func newBackendSet(process map[string]string, backends ...*sessionConfig) (*backendSet, error) {
+	modes := map[string]string{}
+	addrs := map[string]string{}
+	for _, b := range backends {
+		for _, mode := range b.modes {
+			if other, ok := modes[mode]; ok {
+				return nil, errors.Errorf("the backends %s and %s both handle the mode %q", other, b.name, mode)
+			}
+			modes[mode] = b.name
+		}
+		if b.listenAddress != "" {
+			if other, ok := addrs[b.listenAddress]; ok {
+				return nil, errors.Errorf("the backends %s and %s both listen on %s", other, b.name, b.listenAddress)
+			}
+			addrs[b.listenAddress] = b.name
+		}
+	}
+	return &backendSet{backends: backends, process: process}, nil
+}
+
+// byName returns the backend called name, or nil.
+func (s *backendSet) byName(name string) *sessionConfig {
+	for _, b := range s.backends {
+		if b.name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// forMode returns the backend handling mode, or nil.
+func (s *backendSet) forMode(mode string) *sessionConfig {
+	for _, b := range s.backends {
+		for _, m := range b.modes {
+			if m == mode {
+				return b
+			}
+		}
+	}
+	return nil
+}
+
+func (s *backendSet) startPools(ctx context.Context) {
+	for _, b := range s.backends {
+		b.startPool(ctx)
+	}
+}
+
+func (s *backendSet) close() {
+	for _, b := range s.backends {
+		b.close()
+	}
+}
+
+// route returns the backend for the session of the client connected to
+// conn: the backend called backend if it is non-empty (because the session
+// was accepted at its listenAddress), the only backend, or the one for the
+// mode of the client's 'initialize' request. In the last case the returned
+// connection replays the 'initialize' request, which has already been read
+// from conn.
+func (s *backendSet) route(conn net.Conn, backend string) (*sessionConfig, net.Conn, error) {
+	if backend != "" {
+		if b := s.byName(backend); b != nil {
+			return b, conn, nil
+		}
+		// The backend has been removed by a reload since the listener was
+		// set up, so fall back to routing by mode.
+	}
+	if len(s.backends) == 1 {
+		return s.backends[0], conn, nil
+	}
+
+	conn, req, err := peekInitialize(conn, initializeTimeout)
+	if err != nil {
+		return nil, conn, err
+	}
+	mode := initializeMode(req.Params)
+	if mode == "" {
+		return s.backends[0], conn, nil
+	}
+	if b := s.forMode(mode); b != nil {
+		return b, conn, nil
+	}
+	return nil, conn, &noBackendError{mode: mode}
+}
+
+// noBackendError is returned by route if no backend handles the mode of the
+// session.
+type noBackendError struct {
+	mode string
+}
+
+func (e *noBackendError) Error() string {
+	return fmt.Sprintf("no language server is configured for the mode %q", e.mode)
+}
+
+// initializeMode returns the mode (e.x. "css") Sourcegraph sends in the
+// params of the 'initialize' request.
+func initializeMode(params *json.RawMessage) string {
+	if params == nil {
+		return ""
+	}
+	var p struct {
+		Mode string `json:"mode"`
+	}
+	if err := json.Unmarshal(*params, &p); err != nil {
+		return ""
+	}
+	return p.Mode
+}
+
+// replayConn is a net.Conn whose reads return data that has already been
+// read from it first.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// peekInitialize reads the first message the client sent on conn, which
+// must be the 'initialize' request, waiting at most timeout for it. It
+// returns a connection which reads the message again.
+func peekInitialize(conn net.Conn, timeout time.Duration) (net.Conn, *jsonrpc2.Request, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// Everything read from conn is kept in buf, including what the
+	// bufio.Reader reads beyond the first message.
+	var buf bytes.Buffer
+	var req jsonrpc2.Request
+	err := jsonrpc2.VSCodeObjectCodec{}.ReadObject(bufio.NewReader(io.TeeReader(conn, &buf)), &req)
+	replay := &replayConn{Conn: conn, r: io.MultiReader(&buf, conn)}
+	if err != nil {
+		return replay, nil, errors.Wrap(err, "reading the initialize request failed")
+	}
+	if req.Method != "initialize" {
+		return replay, nil, errors.Errorf("expected the initialize request, got %s", req.Method)
+	}
+	return replay, &req, nil
+}
+
+// loadBackends reads the configuration from the command line arguments,
+// environment variables and -config file.
+func loadBackends() (*backendSet, error) {
+	fs, settings, err := parseSettings("")
+	if err != nil {
+		return nil, err
+	}
+	process := processFlags(fs)
+	names := strings.FieldsFunc(flagValue(fs, "backends").(string), func(r rune) bool { return r == ',' })
+	if len(names) == 0 {
+		config, err := newSessionConfig(fs, settings)
+		if err != nil {
+			return nil, err
+		}
+		return newBackendSet(process, config)
+	}
+
+	if flagValue(fs, "config").(string) == "" {
+		return nil, errors.New("-backends requires -config")
+	}
+	if len(fs.Args()) > 0 {
+		return nil, errors.New("LSP_COMMAND_ARGS can't be used together with -backends, set the command of each profile instead")
+	}
+	backends := make([]*sessionConfig, 0, len(names))
+	for _, name := range names {
+		fs, settings, err := parseSettings(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "backend %s", name)
+		}
+		if changed := changedFlags(process, processFlags(fs)); len(changed) > 0 {
+			return nil, errors.Errorf("backend %s: %s apply to all backends and can't be set by the profile of a backend", name, strings.Join(changed, ", "))
+		}
+		config, err := newSessionConfig(fs, settings)
+		if err != nil {
+			return nil, errors.Wrapf(err, "backend %s", name)
+		}
+		config.name = name
+		if len(config.modes) == 0 {
+			config.modes = []string{name}
+		}
+		backends = append(backends, config)
+	}
+	return newBackendSet(process, backends...)
+}
+
+// parseSettings parses the command line arguments into a copy of
+// flag.CommandLine and applies the environment variables and the profile of
+// the -config file to it (see loadSettings). If profile is empty, the one
+// selected by -profile is used.
+func parseSettings(profile string) (*flag.FlagSet, profileSettings, error) {
+	fs := copyFlagSet(flag.CommandLine)
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		return nil, profileSettings{}, err
+	}
+	if profile != "" {
+		fs.Set("profile", profile)
+	}
+	settings, err := loadSettings(fs)
+	return fs, settings, err
+}
+
+// backendListener accepts the sessions of the backend called backend, or
+// if it is empty sessions which are routed by their mode.
+type backendListener struct {
+	net.Listener
+	backend string
+}
+
+// checkBackends checks the language server of each backend which
+// lsp-adapter starts itself (see checkLanguageServer).
+func checkBackends(ctx context.Context, backends *backendSet) error {
+	checked := 0
+	for _, b := range backends.backends {
+		if b.connectNew == nil {
+			continue
+		}
+		if err := checkLanguageServer(ctx, b); err != nil {
+			if b.name != "" {
+				return errors.Wrapf(err, "backend %s", b.name)
+			}
+			return err
+		}
+		checked++
+	}
+	if checked == 0 {
+		return errors.New("the language server is not started by lsp-adapter (no LSP_COMMAND_ARGS)")
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// sendInitialize writes an 'initialize' request with params, followed by
+// an 'initialized' notification, to the client side of a pipe. It returns
+// the server side, the client side, which the caller has to close, and what
+// was written.
+func sendInitialize(params string) (server, client net.Conn, sent []byte) {
+	client, server = net.Pipe()
+	var msg bytes.Buffer
+	for _, body := range []string{
+		`{"jsonrpc":"2.0","id":1,"method":"initialize","params":` + params + `}`,
+		`{"jsonrpc":"2.0","method":"initialized"}`,
+	} {
+		fmt.Fprintf(&msg, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+	go client.Write(msg.Bytes())
+	return server, client, msg.Bytes()
+}
+
+func TestPeekInitialize(t *testing.T) {
+	conn, client, sent := sendInitialize(`{"mode":"css"}`)
+	defer client.Close()
+	replay, req, err := peekInitialize(conn, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := initializeMode(req.Params); mode != "css" {
+		t.Errorf("got mode %q, want css", mode)
+	}
+
+	// The connection reads everything the client sent again.
+	got := make([]byte, len(sent))
+	if _, err := io.ReadFull(replay, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(sent) {
+		t.Errorf("got %q, want %q", got, sent)
+	}
+
+	// Clients which don't send anything time out.
+	_, idle := net.Pipe()
+	if _, _, err := peekInitialize(idle, 10*time.Millisecond); err == nil {
+		t.Error("expected an error for a client which doesn't send the initialize request")
+	}
+}
+
+func TestRoute(t *testing.T) {
+	css := &sessionConfig{name: "css", modes: []string{"css", "scss"}}
+	html := &sessionConfig{name: "html", modes: []string{"html"}, listenAddress: "127.0.0.1:0"}
+	backends, err := newBackendSet(nil, css, html)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		backend string
+		params  string
+		want    *sessionConfig
+	}{
+		{"html", `{"mode":"css"}`, html},
+		{"", `{"mode":"scss"}`, css},
+		{"", `{"mode":"html"}`, html},
+		{"", `{}`, css},
+		{"removed", `{"mode":"html"}`, html},
+	}
+	for _, c := range cases {
+		conn, client, _ := sendInitialize(c.params)
+		got, _, err := backends.route(conn, c.backend)
+		client.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("route(%s, %q) = %s, want %s", c.params, c.backend, got.name, c.want.name)
+		}
+	}
+
+	conn, client, _ := sendInitialize(`{"mode":"go"}`)
+	defer client.Close()
+	if _, _, err := backends.route(conn, ""); err == nil {
+		t.Error("expected an error for a mode without a backend")
+	} else if _, ok := err.(*noBackendError); !ok {
+		t.Errorf("expected a noBackendError, got %s", err)
+	}
+
+	if _, err := newBackendSet(nil, css, &sessionConfig{name: "less", modes: []string{"scss"}}); err == nil {
+		t.Error("expected an error for two backends handling the same mode")
+	}
+}
+
+func TestLoadBackends(t *testing.T) {
+	filename := writeConfig(t, `{
+		"defaults": {"didOpenLanguage": "none"},
+		"profiles": {
+			"css": {"command": ["css-languageserver", "--stdio"], "glob": ["*.css"], "modes": ["css", "less"]},
+			"html": {"command": ["html-languageserver", "--stdio"], "glob": ["*.html"], "listenAddress": "127.0.0.1:0"}
+		}
+	}`)
+	defer os.Remove(filename)
+	// -multiplex applies to the whole process, so it can't differ between
+	// backends.
+	badFilename := writeConfig(t, `{
+		"profiles": {
+			"css": {"command": ["css-languageserver", "--stdio"], "multiplex": true},
+			"html": {"command": ["html-languageserver", "--stdio"]}
+		}
+	}`)
+	defer os.Remove(badFilename)
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+
+	os.Args = []string{"lsp-adapter", "-config=" + filename, "-backends=css,html", "-didOpenLanguage=html"}
+	backends, err := loadBackends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	css, html := backends.byName("css"), backends.byName("html")
+	if css == nil || html == nil {
+		t.Fatalf("expected the backends css and html, got %d backends", len(backends.backends))
+	}
+	if !reflect.DeepEqual(css.glob, []string{"*.css"}) || !reflect.DeepEqual(css.modes, []string{"css", "less"}) || css.command[0] != "css-languageserver" {
+		t.Errorf("unexpected css backend %+v", css)
+	}
+	if !reflect.DeepEqual(html.modes, []string{"html"}) || html.listenAddress != "127.0.0.1:0" {
+		t.Errorf("unexpected html backend %+v", html)
+	}
+	// The command line takes precedence over the profiles.
+	if css.didOpenLanguage != "html" || html.didOpenLanguage != "html" {
+		t.Errorf("expected -didOpenLanguage to apply to all backends, got %q and %q", css.didOpenLanguage, html.didOpenLanguage)
+	}
+
+	for _, args := range [][]string{
+		{"-backends=css"},
+		{"-config=" + filename, "-backends=css,go"},
+		{"-config=" + filename, "-backends=css", "gopls"},
+		{"-config=" + badFilename, "-backends=css,html"},
+	} {
+		os.Args = append([]string{"lsp-adapter"}, args...)
+		if _, err := loadBackends(); err == nil {
+			t.Errorf("expected an error for %q", args)
+		}
+	}
+}
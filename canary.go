@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/go-langserver/pkg/lsp"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// canaryRootURI is the originalRootUri of the canary's sessions. It is the
+// same for every probe, so that -keepAlive keeps at most one canary
+// workspace alive.
+const canaryRootURI = "canary://lsp-adapter/fixture"
+
+// canaryConfig is the contents of the file passed to -canaryConfig.
+type canaryConfig struct {
+	// FixtureDir is the directory containing the fixture repository,
+	// relative to the config file. Files are added to (or override) it.
+	FixtureDir string            `json:"fixtureDir"`
+	Files      map[string]string `json:"files"` // path (e.x. "/main.go") -> content
+
+	Mode                  string      `json:"mode"`
+	InitializationOptions interface{} `json:"initializationOptions"`
+
+	Checks []canaryCheck `json:"checks"`
+}
+
+// canaryCheck is a request the canary sends for a position in the fixture
+// repository, e.x. 'textDocument/hover' or 'textDocument/definition'.
+type canaryCheck struct {
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Line      int    `json:"line"`
+	Character int    `json:"character"`
+
+	// Expect must be contained in the JSON encoded result (e.x. the
+	// 'file:///other.go' URI of a definition). If empty, the result must
+	// not be null.
+	Expect string `json:"expect"`
+}
+
+func (c canaryCheck) String() string {
+	return fmt.Sprintf("%s %s:%d:%d", c.Method, c.Path, c.Line, c.Character)
+}
+
+// loadCanaryConfig reads the canary config file at filename and the
+// fixture repository it refers to.
+func loadCanaryConfig(filename string) (*canaryConfig, map[string]string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	var config canaryConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, nil, errors.Wrapf(err, "parsing %s failed", filename)
+	}
+
+	files := map[string]string{}
+	if config.FixtureDir != "" {
+		dir := config.FixtureDir
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(filename), dir)
+		}
+		err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			content, err := ioutil.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, name)
+			if err != nil {
+				return err
+			}
+			files["/"+filepath.ToSlash(rel)] = string(content)
+			return nil
+		})
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "reading the fixture repository failed")
+		}
+	}
+	for name, content := range config.Files {
+		files[path.Join("/", name)] = content
+	}
+
+	if len(files) == 0 {
+		return nil, nil, errors.Errorf("%s: the fixture repository is empty", filename)
+	}
+	if len(config.Checks) == 0 {
+		return nil, nil, errors.Errorf("%s: no checks are configured", filename)
+	}
+	for i, check := range config.Checks {
+		if check.Method == "" {
+			return nil, nil, errors.Errorf("%s: check %d has no method", filename, i)
+		}
+		if _, ok := files[path.Join("/", check.Path)]; !ok {
+			return nil, nil, errors.Errorf("%s: check %d refers to %q, which is not in the fixture repository", filename, i, check.Path)
+		}
+	}
+	return &config, files, nil
+}
+
+// canary periodically runs a session against a fixture repository, which
+// it serves to lsp-adapter itself, and checks that the language server
+// answers the configured requests as expected.
+type canary struct {
+	config  *canaryConfig
+	files   map[string]string
+	timeout time.Duration
+
+	// serve handles a session like any other, for the client connected
+	// to conn.
+	serve func(conn net.Conn)
+
+	mu          sync.Mutex
+	runs        int
+	failures    int
+	last        *canaryResult
+	lastFailure *canaryResult
+}
+
+type canaryResult struct {
+	start      time.Time
+	duration   time.Duration
+	initialize time.Duration // how long the 'initialize' request took (including the clone)
+	checks     []canaryCheckResult
+	err        error // the first failure
+}
+
+type canaryCheckResult struct {
+	check    canaryCheck
+	duration time.Duration
+	err      error
+}
+
+// run probes every interval until ctx is done or stop is closed.
+func (c *canary) run(ctx context.Context, interval time.Duration, stop <-chan struct{}) {
+	for {
+		res := c.probe(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		c.record(res)
+
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *canary) record(res *canaryResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.runs++
+	c.last = res
+	if res.err != nil {
+		c.failures++
+		c.lastFailure = res
+		rootLogger.warnf("Canary: probe failed after %s: %s", res.duration, res.err)
+	}
+}
+
+// probe runs one session against the fixture repository.
+func (c *canary) probe(ctx context.Context) *canaryResult {
+	res := &canaryResult{start: time.Now()}
+	defer func() { res.duration = time.Since(res.start) }()
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	clientConn, serverConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.serve(serverConn)
+	}()
+	conn := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(clientConn, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2.AsyncHandler(jsonrpc2HandlerFunc(c.handle)))
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+
+	params := map[string]interface{}{
+		"rootUri":         "file:///",
+		"originalRootUri": canaryRootURI,
+		"capabilities":    map[string]interface{}{},
+	}
+	if c.config.Mode != "" {
+		params["mode"] = c.config.Mode
+	}
+	if c.config.InitializationOptions != nil {
+		params["initializationOptions"] = c.config.InitializationOptions
+	}
+	start := time.Now()
+	if err := conn.Call(ctx, "initialize", params, nil); err != nil {
+		res.err = errors.Wrap(err, "initialize request failed")
+		return res
+	}
+	res.initialize = time.Since(start)
+	if err := conn.Notify(ctx, "initialized", struct{}{}); err != nil {
+		res.err = errors.Wrap(err, "sending initialized failed")
+		return res
+	}
+
+	for _, check := range c.config.Checks {
+		r := c.runCheck(ctx, conn, check)
+		res.checks = append(res.checks, r)
+		if r.err != nil && res.err == nil {
+			res.err = errors.Wrap(r.err, check.String())
+		}
+	}
+
+	if err := conn.Call(ctx, "shutdown", nil, nil); err != nil {
+		rootLogger.warnf("Canary: shutdown request failed: %s", err)
+		return res
+	}
+	if err := conn.Notify(ctx, "exit", nil); err != nil {
+		rootLogger.warnf("Canary: exit notification failed: %s", err)
+	}
+	return res
+}
+
+func (c *canary) runCheck(ctx context.Context, conn *jsonrpc2.Conn, check canaryCheck) canaryCheckResult {
+	params := lsp.TextDocumentPositionParams{
+		TextDocument: lsp.TextDocumentIdentifier{URI: lsp.DocumentURI("file://" + path.Join("/", check.Path))},
+		Position:     lsp.Position{Line: check.Line, Character: check.Character},
+	}
+	start := time.Now()
+	var result json.RawMessage
+	err := conn.Call(ctx, check.Method, params, &result)
+	r := canaryCheckResult{check: check, duration: time.Since(start)}
+	switch {
+	case err != nil:
+		r.err = err
+	case check.Expect == "" && (len(result) == 0 || string(result) == "null"):
+		r.err = errors.New("the result is null")
+	case !strings.Contains(string(result), check.Expect):
+		r.err = errors.Errorf("expected the result to contain %q, got %s", check.Expect, result)
+	}
+	return r
+}
+
+// handle answers the requests lsp-adapter sends the canary, in particular
+// 'workspace/xfiles' and 'textDocument/xcontent' for the clone.
+func (c *canary) handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	if req.Notif {
+		return
+	}
+	var result interface{}
+	var err error
+	switch req.Method {
+	case "workspace/xfiles":
+		var files []lsp.TextDocumentIdentifier
+		for name := range c.files {
+			files = append(files, lsp.TextDocumentIdentifier{URI: lsp.DocumentURI("file://" + name)})
+		}
+		result = files
+	case "textDocument/xcontent":
+		result, err = c.content(req.Params)
+	default:
+		err = &jsonrpc2.Error{Code: jsonrpc2.CodeMethodNotFound, Message: fmt.Sprintf("method not supported by the canary: %s", req.Method)}
+	}
+
+	if err != nil {
+		respErr, ok := err.(*jsonrpc2.Error)
+		if !ok {
+			respErr = &jsonrpc2.Error{Code: jsonrpc2.CodeInvalidParams, Message: err.Error()}
+		}
+		if err := conn.ReplyWithError(ctx, req.ID, respErr); err != nil {
+			rootLogger.warnf("Canary: sending error reply failed: %s", err)
+		}
+		return
+	}
+	if err := conn.Reply(ctx, req.ID, result); err != nil {
+		rootLogger.warnf("Canary: sending reply failed: %s", err)
+	}
+}
+
+func (c *canary) content(params *json.RawMessage) (*lsp.TextDocumentItem, error) {
+	if params == nil {
+		return nil, errors.New("missing params")
+	}
+	var p struct {
+		TextDocument lsp.TextDocumentIdentifier `json:"textDocument"`
+	}
+	if err := json.Unmarshal(*params, &p); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(string(p.TextDocument.URI))
+	if err != nil {
+		return nil, err
+	}
+	text, ok := c.files[u.Path]
+	if !ok {
+		return nil, errors.Errorf("URI %s does not exist", p.TextDocument.URI)
+	}
+	return &lsp.TextDocumentItem{URI: p.TextDocument.URI, Text: text}, nil
+}
+
+// writeStatus writes the results of the canary in a human readable form to
+// w. It is shown on the debug server.
+func (c *canary) writeStatus(w io.Writer) {
+	if c == nil {
+		fmt.Fprintln(w, "The canary is disabled (see -canaryConfig).")
+		return
+	}
+	c.mu.Lock()
+	runs, failures, last, lastFailure := c.runs, c.failures, c.last, c.lastFailure
+	c.mu.Unlock()
+
+	paths := make([]string, 0, len(c.files))
+	for name := range c.files {
+		paths = append(paths, name)
+	}
+	sort.Strings(paths)
+	fmt.Fprintf(w, "fixture files: %s\n", strings.Join(paths, " "))
+	fmt.Fprintf(w, "probes:        %d\n", runs)
+	fmt.Fprintf(w, "failures:      %d\n", failures)
+	if last == nil {
+		fmt.Fprintf(w, "\nThe first probe has not finished yet.\n")
+		return
+	}
+	fmt.Fprintf(w, "\nlast probe:\n")
+	last.write(w)
+	if lastFailure != nil && lastFailure != last {
+		fmt.Fprintf(w, "\nlast failed probe:\n")
+		lastFailure.write(w)
+	}
+}
+
+func (r *canaryResult) write(w io.Writer) {
+	status := "ok"
+	if r.err != nil {
+		status = "FAILED: " + r.err.Error()
+	}
+	fmt.Fprintf(w, "  started:    %s\n", r.start.Format(time.RFC3339))
+	fmt.Fprintf(w, "  status:     %s\n", status)
+	fmt.Fprintf(w, "  duration:   %s\n", r.duration)
+	fmt.Fprintf(w, "  initialize: %s\n", r.initialize)
+	for _, check := range r.checks {
+		status := "ok"
+		if check.err != nil {
+			status = "FAILED: " + check.err.Error()
+		}
+		fmt.Fprintf(w, "  %s: %s (%s)\n", check.check, status, check.duration)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/go-langserver/pkg/lsp"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+func TestLoadCanaryConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "canary-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	write := func(name, content string) {
+		t.Helper()
+		name = filepath.Join(tmp, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("fixture/a.go", "package a")
+	write("fixture/dir/b.go", "package dir")
+	write("canary.json", `{
+		"fixtureDir": "fixture",
+		"files": {"c.go": "package c"},
+		"checks": [{"method": "textDocument/hover", "path": "/dir/b.go", "expect": "dir"}]
+	}`)
+	write("missing.json", `{
+		"files": {"c.go": "package c"},
+		"checks": [{"method": "textDocument/hover", "path": "/d.go"}]
+	}`)
+
+	_, files, err := loadCanaryConfig(filepath.Join(tmp, "canary.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"/a.go": "package a", "/dir/b.go": "package dir", "/c.go": "package c"}
+	if len(files) != len(want) {
+		t.Errorf("got files %v, want %v", files, want)
+	}
+	for name, content := range want {
+		if files[name] != content {
+			t.Errorf("got %q for %s, want %q", files[name], name, content)
+		}
+	}
+
+	if _, _, err := loadCanaryConfig(filepath.Join(tmp, "missing.json")); err == nil {
+		t.Error("expected an error for a check of a file which is not in the fixture repository")
+	}
+}
+
+func TestCanaryProbe(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "canary-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// serve stands in for lsp-adapter and a language server whose hover
+	// is the content of the file.
+	serve := func(conn net.Conn) {
+		ctx := context.Background()
+		client := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(conn, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2.AsyncHandler(jsonrpc2HandlerFunc(func(ctx context.Context, c *jsonrpc2.Conn, req *jsonrpc2.Request) {
+			switch req.Method {
+			case "initialize":
+				fs := &remoteFS{conn: c}
+				if err := fs.Clone(ctx, tmp, nil); err != nil {
+					c.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{Message: err.Error()})
+					return
+				}
+				c.Reply(ctx, req.ID, map[string]interface{}{})
+			case "textDocument/hover":
+				var params lsp.TextDocumentPositionParams
+				json.Unmarshal(*req.Params, &params)
+				b, err := ioutil.ReadFile(filepath.Join(tmp, strings.TrimPrefix(string(params.TextDocument.URI), "file://")))
+				if err != nil {
+					c.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{Message: err.Error()})
+					return
+				}
+				c.Reply(ctx, req.ID, map[string]string{"contents": string(b)})
+			default:
+				if !req.Notif {
+					c.Reply(ctx, req.ID, nil)
+				}
+			}
+		})))
+		<-client.DisconnectNotify()
+	}
+
+	c := &canary{
+		config: &canaryConfig{Checks: []canaryCheck{
+			{Method: "textDocument/hover", Path: "/a.go", Expect: "package a"},
+			{Method: "textDocument/hover", Path: "/dir/b.go", Expect: "package a"},
+		}},
+		files:   map[string]string{"/a.go": "package a", "/dir/b.go": "package dir"},
+		timeout: 5 * time.Second,
+		serve:   serve,
+	}
+	res := c.probe(context.Background())
+	if len(res.checks) != 2 {
+		t.Fatalf("expected 2 check results, got %d (error: %v)", len(res.checks), res.err)
+	}
+	if err := res.checks[0].err; err != nil {
+		t.Errorf("expected the first check to pass, got %v", err)
+	}
+	if res.checks[1].err == nil {
+		t.Error("expected the second check to fail")
+	}
+	if res.err == nil || !strings.Contains(res.err.Error(), "/dir/b.go") {
+		t.Errorf("expected the probe to fail because of /dir/b.go, got %v", res.err)
+	}
+}
@@ -2,56 +2,597 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"net"
+	"net/url"
 	"os"
 	"os/exec"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
-func stdIoLSConn(ctx context.Context, name string, arg ...string) (io.ReadWriteCloser, error) {
-	cmd := exec.CommandContext(ctx, name, arg...)
+// lsTemplateData is the data available to the text/template syntax in
+// LSP_COMMAND_ARGS and -lspAddress (e.g. "--root={{.WorkspaceDir}}").
+type lsTemplateData struct {
+	// WorkspaceDir is the workspace cache directory of the session.
+	WorkspaceDir string
+
+	allocPort func() (int, error) // used by Port, defaults to freePort
+	port      int
+}
+
+// Port returns a free TCP port for the language server to listen on. Every
+// reference to {{.Port}} in a session refers to the same port.
+func (d *lsTemplateData) Port() (int, error) {
+	if d.port != 0 {
+		return d.port, nil
+	}
+	allocPort := d.allocPort
+	if allocPort == nil {
+		allocPort = freePort
+	}
+	port, err := allocPort()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to find a free port for the language server")
+	}
+	d.port = port
+	return port, nil
+}
+
+// freePort asks the kernel for a free TCP port on the loopback interface.
+func freePort() (int, error) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer lis.Close()
+	return lis.Addr().(*net.TCPAddr).Port, nil
+}
+
+// lsTemplate is a list of strings which may contain text/template actions.
+type lsTemplate []*template.Template
+
+func parseLSTemplate(args ...string) (lsTemplate, error) {
+	t := make(lsTemplate, 0, len(args))
+	for _, arg := range args {
+		tmpl, err := template.New("").Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse template %q", arg)
+		}
+		t = append(t, tmpl)
+	}
+	return t, nil
+}
+
+func (t lsTemplate) execute(data *lsTemplateData) ([]string, error) {
+	args := make([]string, 0, len(t))
+	for _, tmpl := range t {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			return nil, errors.Wrap(err, "failed to execute template")
+		}
+		args = append(args, b.String())
+	}
+	return args, nil
+}
+
+// usesWorkspaceDir reports whether t refers to {{.WorkspaceDir}}.
+func (t lsTemplate) usesWorkspaceDir() bool {
+	alloc := func() (int, error) { return 1, nil }
+	a, errA := t.execute(&lsTemplateData{WorkspaceDir: "a", allocPort: alloc})
+	b, errB := t.execute(&lsTemplateData{WorkspaceDir: "b", allocPort: alloc})
+	return errA != nil || errB != nil || !reflect.DeepEqual(a, b)
+}
+
+// serverSettings are the settings of the language server processes started
+// by lsp-adapter. They are part of the sessionConfig, so they can differ
+// between backends and change when the configuration is reloaded.
+type serverSettings struct {
+	dialTimeout   time.Duration // -lspDialTimeout
+	shutdownGrace time.Duration // -shutdownGracePeriod
+	stderrLines   int           // -stderrLines
+	limits        resourceLimits
+}
+
+// newLSConnector returns an lsConnector which starts the language server with
+// cmdArgs (and the environment variables env in addition to ours) and talks
+// to it over stdio, or connects to it at rawAddr if non-empty (see
+// socketLSConn). Both may contain lsTemplateData references.
+func newLSConnector(rawAddr string, cmdArgs, env []string, portPattern *regexp.Regexp, poolSize int, settings *serverSettings) (lsConnector, error) {
+	argsTmpl, err := parseLSTemplate(cmdArgs...)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid LSP_COMMAND_ARGS")
+	}
+	addrTmpl, err := parseLSTemplate(rawAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid -lspAddress")
+	}
+
+	// Catch mistakes such as unknown fields at startup rather than when the
+	// first session starts.
+	data := &lsTemplateData{allocPort: func() (int, error) { return 1, nil }}
+	if _, err := argsTmpl.execute(data); err != nil {
+		return nil, errors.Wrap(err, "invalid LSP_COMMAND_ARGS")
+	}
+	if addr, err := addrTmpl.execute(data); err != nil {
+		return nil, errors.Wrap(err, "invalid -lspAddress")
+	} else if rawAddr != "" {
+		network, address, err := parseLSAddress(addr[0])
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid -lspAddress")
+		}
+		if portZero(network, address) {
+			if len(cmdArgs) == 0 {
+				return nil, errors.New("-lspAddress may only use port 0 if LSP_COMMAND_ARGS are specified")
+			}
+			if portPattern == nil && !listeningPortsSupported {
+				return nil, errors.New("-lspAddress uses port 0, so -lspPortPattern must be specified to discover the port of the language server")
+			}
+		}
+	}
+
+	if poolSize > 0 {
+		if len(cmdArgs) == 0 {
+			return nil, errors.New("-serverPoolSize requires LSP_COMMAND_ARGS")
+		}
+		if argsTmpl.usesWorkspaceDir() || addrTmpl.usesWorkspaceDir() {
+			return nil, errors.New("-serverPoolSize can't be used if LSP_COMMAND_ARGS or -lspAddress refer to {{.WorkspaceDir}}")
+		}
+	}
+
+	return func(ctx context.Context, data lsTemplateData, dir string) (io.ReadWriteCloser, error) {
+		args, err := argsTmpl.execute(&data)
+		if err != nil {
+			return nil, err
+		}
+		if rawAddr == "" {
+			return stdIoLSConn(dir, env, settings, args[0], args[1:]...)
+		}
+
+		addr, err := addrTmpl.execute(&data)
+		if err != nil {
+			return nil, err
+		}
+		network, address, err := parseLSAddress(addr[0])
+		if err != nil {
+			return nil, err
+		}
+		return socketLSConn(ctx, network, address, portPattern, dir, env, settings, args...)
+	}, nil
+}
+
+// stdIoLSConn starts the language server and talks to it over stdio. If dir
+// is non-empty it is used as the cwd of the language server. env is added
+// to its environment.
+func stdIoLSConn(dir string, env []string, settings *serverSettings, name string, arg ...string) (io.ReadWriteCloser, error) {
+	cmd := lsCommand(dir, env, name, arg...)
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create stdin pipe for language server")
 	}
 
-	stdout, err := cmd.StdoutPipe()
+	// Unlike cmd.StdoutPipe, this pipe is not closed by cmd.Wait. That way we
+	// can wait for the process in the background while still reading
+	// everything it wrote before exiting.
+	stdout, stdoutW, err := os.Pipe()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create stdout pipe for language server")
 	}
+	cmd.Stdout = stdoutW
 
-	cmd.Stderr = os.Stderr
+	output, err := captureOutput(cmd, false, settings.stderrLines, nil)
+	if err != nil {
+		stdout.Close()
+		stdoutW.Close()
+		return nil, err
+	}
 
-	if err := cmd.Start(); err != nil {
-		return nil, errors.Wrap(err, "failed to start cmd for language server")
+	proc, err := startLSProcess(cmd, output, settings)
+	stdoutW.Close()
+	if err != nil {
+		stdout.Close()
+		return nil, err
 	}
 
 	return &cmdRWCloser{
-		Cmd:    cmd,
-		Reader: stdout,
-		Writer: stdin,
+		lsProcess: proc,
+		stdin:     stdin,
+		stdout:    stdout,
 	}, nil
 }
 
-type cmdRWCloser struct {
-	*exec.Cmd
+// socketLSConn connects to a language server listening on address. If
+// cmdArgs is non-empty, the language server is started with it first, in dir
+// (unless empty) and with env added to its environment. Connecting is then
+// retried until the language server accepts connections or -lspDialTimeout
+// expires.
+//
+// If address is a TCP address with port 0, the port the language server
+// actually listens on is discovered by matching portPattern against each line
+// of its stdout and stderr. The first submatch must be the port. Without
+// portPattern (only on Linux), the sockets of the language server's process
+// group are polled until one of them listens on a TCP port.
+func socketLSConn(ctx context.Context, network, address string, portPattern *regexp.Regexp, dir string, env []string, settings *serverSettings, cmdArgs ...string) (io.ReadWriteCloser, error) {
+	if len(cmdArgs) == 0 {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to connect to language server at %s://%s", network, address)
+		}
+		return conn, nil
+	}
+
+	cmd := lsCommand(dir, env, cmdArgs[0], cmdArgs[1:]...)
+
+	var (
+		watch func(line string)
+		ports <-chan int
+	)
+	if portZero(network, address) && portPattern != nil {
+		watch, ports = watchForPort(portPattern)
+	}
+	output, err := captureOutput(cmd, true, settings.stderrLines, watch)
+	if err != nil {
+		return nil, err
+	}
 
-	// Reader and Writer do not need to be Closers since they are StdoutPipe
-	// and StdinPipe respectively. Both of those will be closed by Cmd.Wait.
-	io.Reader
-	io.Writer
+	proc, err := startLSProcess(cmd, output, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	// The process exiting early is the only other reason to give up before
+	// -lspDialTimeout.
+	abort := func(err error) (io.ReadWriteCloser, error) {
+		proc.kill()
+		return nil, err
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, settings.dialTimeout)
+	defer cancel()
+
+	if portZero(network, address) {
+		// What the language server has to do for us to find its port.
+		do, doing := fmt.Sprintf("print a line matching -lspPortPattern=%q", portPattern), fmt.Sprintf("printing a line matching -lspPortPattern=%q", portPattern)
+		if ports == nil {
+			ports = pollForPort(dialCtx, proc.cmd.Process.Pid)
+			do, doing = "listen on a TCP port", "listening on a TCP port"
+		}
+		select {
+		case port := <-ports:
+			host, _, _ := net.SplitHostPort(address)
+			address = net.JoinHostPort(host, strconv.Itoa(port))
+		case <-dialCtx.Done():
+			return abort(errors.Errorf("language server did not %s within %s", do, settings.dialTimeout))
+		case <-proc.exited:
+			return abort(errors.Errorf("language server exited before %s: %v", doing, proc.waitErr))
+		}
+	}
+
+	conn, err := dialWithRetry(dialCtx, network, address, settings.dialTimeout, proc.exited)
+	if err != nil {
+		select {
+		case <-proc.exited:
+			err = errors.Errorf("language server exited before listening on %s://%s: %v", network, address, proc.waitErr)
+		default:
+		}
+		return abort(err)
+	}
+
+	return &socketRWCloser{
+		Conn:      conn,
+		lsProcess: proc,
+	}, nil
 }
 
-func (c *cmdRWCloser) Close() error {
-	if err := c.Cmd.Process.Kill(); err != nil {
-		return errors.Wrap(err, "unable to kill process during cmdRWCloser.Close()")
+// lsCommand returns the command starting the language server name with arg
+// in dir (unless empty), with env added to our environment.
+func lsCommand(dir string, env []string, name string, arg ...string) *exec.Cmd {
+	cmd := exec.Command(name, arg...)
+	cmd.Dir = dir
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
 	}
+	return cmd
+}
 
-	if err := c.Cmd.Wait(); err != nil {
-		return errors.Wrap(err, "unable to wait on cmd to finish during cmdRWCloser.Close()")
+// watchForPort returns a function to call with each line of the output of a
+// language server, which matches it against portPattern. The first port
+// found is sent on the returned channel.
+func watchForPort(portPattern *regexp.Regexp) (watch func(line string), ports <-chan int) {
+	found := make(chan int, 1)
+	var once sync.Once
+	watch = func(line string) {
+		m := portPattern.FindStringSubmatch(line)
+		if len(m) < 2 {
+			return
+		}
+		if port, err := strconv.Atoi(m[1]); err == nil {
+			once.Do(func() { found <- port })
+		}
 	}
+	return watch, found
+}
+
+// pollForPort polls for a TCP port which a process of the process group pgid
+// listens on (see listeningPort) until it finds one, which it sends on the
+// returned channel, or ctx is done.
+func pollForPort(ctx context.Context, pgid int) <-chan int {
+	found := make(chan int, 1)
+	go func() {
+		for {
+			if port := listeningPort(pgid); port != 0 {
+				found <- port
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}()
+	return found
+}
 
+// portZero reports whether address is a TCP address with port 0, which means
+// the language server picks its own port.
+func portZero(network, address string) bool {
+	if network != "tcp" {
+		return false
+	}
+	_, port, err := net.SplitHostPort(address)
+	return err == nil && port == "0"
+}
+
+// dialWithRetry dials address until it succeeds, ctx is done (which happens
+// after timeout) or exited is closed.
+func dialWithRetry(ctx context.Context, network, address string, timeout time.Duration, exited <-chan struct{}) (net.Conn, error) {
+	var d net.Dialer
+	for {
+		conn, err := d.DialContext(ctx, network, address)
+		if err == nil {
+			return conn, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(err, "language server did not start listening on %s://%s within %s", network, address, timeout)
+		case <-exited:
+			return nil, err
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// parseLSAddress parses a language server address of the form
+// tcp://host:port, unix:///path/to/socket or host:port (which implies tcp)
+// into its network and address.
+func parseLSAddress(rawAddr string) (network, address string, err error) {
+	if !strings.Contains(rawAddr, "://") {
+		return "tcp", rawAddr, nil
+	}
+
+	u, err := url.Parse(rawAddr)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "invalid language server address %q", rawAddr)
+	}
+
+	switch u.Scheme {
+	case "tcp":
+		if u.Host == "" {
+			return "", "", errors.Errorf("language server address %q is missing host:port", rawAddr)
+		}
+		return "tcp", u.Host, nil
+	case "unix":
+		if u.Path == "" {
+			return "", "", errors.Errorf("language server address %q is missing the socket path", rawAddr)
+		}
+		return "unix", u.Path, nil
+	default:
+		return "", "", errors.Errorf("unsupported scheme %q in language server address %q (expected tcp or unix)", u.Scheme, rawAddr)
+	}
+}
+
+// lsProcess is a language server process started by lsp-adapter.
+type lsProcess struct {
+	cmd      *exec.Cmd
+	settings *serverSettings
+	output   *lsOutput     // the captured stderr (and stdout if it is not used for the protocol)
+	cgroup   string        // the cgroup of the process, see applyResourceLimits
+	killing  int32         // set (atomically) once lsp-adapter sends the process a signal
+	exited   chan struct{} // closed once cmd.Wait has returned
+	waitErr  error         // result of cmd.Wait, only valid once exited is closed
+
+	// limitExceeded describes how the process was killed (e.x. "was killed
+	// by the kernel for ...") if it exceeded one of its resource limits,
+	// only valid once exited is closed.
+	limitExceeded string
+
+	logMu     sync.Mutex
+	logSource func() *logger // see setLogger
+
+	stopOnce                   sync.Once
+	exitDeadline, killDeadline time.Time // see stopDeadlines
+}
+
+// stopDeadlines returns the deadlines for stopping the process, which are
+// set by the first call: the 'shutdown' request, the 'exit' notification and
+// waiting for the process to exit by itself share the first half of
+// -shutdownGracePeriod, and the process gets the second half to exit after
+// SIGTERM before it is killed with SIGKILL.
+func (p *lsProcess) stopDeadlines() (exit, kill time.Time) {
+	p.stopOnce.Do(func() {
+		grace := p.settings.shutdownGrace
+		p.killDeadline = time.Now().Add(grace)
+		p.exitDeadline = p.killDeadline.Add(-grace / 2)
+	})
+	return p.exitDeadline, p.killDeadline
+}
+
+// setLogger makes the process log with the logger returned by l, e.x. that
+// of the workspace using it, rather than the root logger.
+func (p *lsProcess) setLogger(l func() *logger) {
+	p.logMu.Lock()
+	p.logSource = l
+	p.logMu.Unlock()
+}
+
+// logger returns the logger for messages about the process.
+func (p *lsProcess) logger() *logger {
+	p.logMu.Lock()
+	l := p.logSource
+	p.logMu.Unlock()
+	if l == nil {
+		return rootLogger
+	}
+	return l()
+}
+
+// startLSProcess starts cmd in its own process group, so that stop can also
+// reach any processes it spawns, and applies the resource limits of settings
+// to it. output must have been set up for cmd with captureOutput.
+func startLSProcess(cmd *exec.Cmd, output *lsOutput, settings *serverSettings) (*lsProcess, error) {
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		output.start(0)
+		return nil, errors.Wrap(err, "failed to start cmd for language server")
+	}
+	output.start(cmd.Process.Pid)
+
+	p := &lsProcess{
+		cmd:      cmd,
+		settings: settings,
+		output:   output,
+		exited:   make(chan struct{}),
+	}
+	limitsErr := applyResourceLimits(p)
+	go func() {
+		p.waitErr = cmd.Wait()
+		p.limitExceeded = p.checkResourceLimits()
+		metricServerExits.inc(exitStatusLabel(p.waitErr))
+		close(p.exited)
+		p.removeCgroup()
+	}()
+	if limitsErr != nil {
+		p.kill()
+		return nil, errors.Wrap(limitsErr, "applying resource limits to language server failed")
+	}
+	return p, nil
+}
+
+// stop gives the process until the exit deadline (see stopDeadlines) to
+// exit by itself (e.x. after it received the 'exit' notification). If it
+// doesn't, its process group is sent SIGTERM, and if that doesn't help by the
+// kill deadline, SIGKILL.
+func (p *lsProcess) stop() error {
+	pid := p.cmd.Process.Pid
+	exitDeadline, killDeadline := p.stopDeadlines()
+
+	// Once the language server itself has exited, anything left in its
+	// process group is an orphan (e.x. a JVM started by a wrapper script).
+	defer killProcessGroup(p.cmd)
+
+	select {
+	case <-p.exited:
+		p.logger().infof("CloneProxy: language server (pid %d) exited by itself: %v", pid, p.status())
+		return nil
+	case <-time.After(time.Until(exitDeadline)):
+	}
+
+	atomic.StoreInt32(&p.killing, 1)
+	if err := terminateProcessGroup(p.cmd); err != nil {
+		p.logger().warnf("CloneProxy: sending SIGTERM to language server (pid %d) failed: %s", pid, err)
+	}
+	select {
+	case <-p.exited:
+		p.logger().warnf("CloneProxy: language server (pid %d) exited after SIGTERM: %v", pid, p.status())
+		return nil
+	case <-time.After(time.Until(killDeadline)):
+	}
+
+	p.kill()
+	p.logger().warnf("CloneProxy: language server (pid %d) was killed with SIGKILL after not exiting within -shutdownGracePeriod=%s", pid, p.settings.shutdownGrace)
 	return nil
 }
+
+// kill immediately kills the process group and waits for the process to
+// exit.
+func (p *lsProcess) kill() {
+	atomic.StoreInt32(&p.killing, 1)
+	if err := killProcessGroup(p.cmd); err != nil {
+		select {
+		case <-p.exited:
+		default:
+			p.logger().errorf("CloneProxy: killing language server (pid %d) failed: %s", p.cmd.Process.Pid, err)
+		}
+	}
+	<-p.exited
+}
+
+// exitStatus describes the result of cmd.Wait for logging.
+func exitStatus(waitErr error) string {
+	if waitErr == nil {
+		return "exit status 0"
+	}
+	return waitErr.Error()
+}
+
+// cmdRWCloser is a language server that lsp-adapter talks to over stdio.
+type cmdRWCloser struct {
+	*lsProcess
+
+	stdin  io.WriteCloser
+	stdout *os.File
+}
+
+func (c *cmdRWCloser) Read(p []byte) (int, error) {
+	return c.stdout.Read(p)
+}
+
+func (c *cmdRWCloser) Write(p []byte) (int, error) {
+	return c.stdin.Write(p)
+}
+
+func (c *cmdRWCloser) Close() error {
+	// Most language servers also exit once stdin is closed.
+	c.stdin.Close()
+	err := c.stop()
+	c.stdout.Close()
+	return err
+}
+
+// socketRWCloser is a connection to a language server that was started by
+// socketLSConn. Closing it closes the connection and stops the process.
+type socketRWCloser struct {
+	net.Conn
+	*lsProcess
+}
+
+func (c *socketRWCloser) Close() error {
+	c.Conn.Close()
+	return c.stop()
+}
+
+// lsProcessOf returns the language server process behind lsConn, or nil if
+// lsConn is a connection to a language server lsp-adapter did not start.
+func lsProcessOf(lsConn io.ReadWriteCloser) *lsProcess {
+	switch c := lsConn.(type) {
+	case *cmdRWCloser:
+		return c.lsProcess
+	case *socketRWCloser:
+		return c.lsProcess
+	default:
+		return nil
+	}
+}
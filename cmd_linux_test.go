@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// TestHelperLanguageServer isn't a real test: it is the language server
+// started by the tests of starting and stopping language servers, which
+// behaves according to $LSP_ADAPTER_TEST_SERVER:
+//
+//   - exit: it exits on the 'exit' notification,
+//   - ignore-exit: it ignores the 'exit' notification,
+//   - ignore-sigterm: it also ignores SIGTERM, and starts a child which
+//     ignores it as well,
+//   - spin: it uses up CPU time on a 'test/spin' request, in a shell since
+//     Go programs ignore SIGXCPU,
+//   - listen: like exit, but it talks to the first connection to
+//     $LSP_ADAPTER_TEST_ADDRESS instead of stdio. It only starts listening
+//     after 300ms, and then prints the port.
+func TestHelperLanguageServer(t *testing.T) {
+	mode := os.Getenv("LSP_ADAPTER_TEST_SERVER")
+	if mode == "" {
+		return
+	}
+	if mode == "ignore-sigterm" {
+		signal.Ignore(syscall.SIGTERM)
+		child := exec.Command("sh", "-c", `trap "" TERM; exec sleep 60`)
+		if err := child.Start(); err != nil {
+			os.Exit(2)
+		}
+	}
+	var stream io.ReadWriteCloser = stdio{}
+	if mode == "listen" {
+		time.Sleep(300 * time.Millisecond)
+		lis, err := net.Listen("tcp", os.Getenv("LSP_ADAPTER_TEST_ADDRESS"))
+		if err != nil {
+			os.Exit(2)
+		}
+		fmt.Printf("listening on port %d\n", lis.Addr().(*net.TCPAddr).Port)
+		if stream, err = lis.Accept(); err != nil {
+			os.Exit(2)
+		}
+	}
+	jsonrpc2.NewConn(context.Background(), jsonrpc2.NewBufferedStream(stream, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2HandlerFunc(func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+		if req.Method == "exit" && (mode == "exit" || mode == "listen") {
+			os.Exit(0)
+		}
+		if req.Method == "test/spin" && mode == "spin" {
+			syscall.Exec("/bin/sh", []string{"sh", "-c", "while :; do :; done"}, os.Environ())
+			os.Exit(2)
+		}
+		if !req.Notif {
+			conn.Reply(ctx, req.ID, nil)
+		}
+	}))
+	// Closing stdin doesn't make it exit either.
+	select {}
+}
+
+type stdio struct{}
+
+func (stdio) Read(p []byte) (int, error)  { return os.Stdin.Read(p) }
+func (stdio) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+func (stdio) Close() error                { return nil }
+
+func TestLSProcessStop(t *testing.T) {
+	tests := []struct {
+		mode string
+		want string // the stage the language server exits at
+	}{
+		{"exit", "exited by itself"},
+		{"ignore-exit", "exited after SIGTERM"},
+		{"ignore-sigterm", "was killed with SIGKILL"},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			logs, restore := captureLogs("logfmt")
+			defer restore()
+
+			env, cmdArgs := helperLanguageServer(test.mode)
+			settings := &serverSettings{shutdownGrace: 500 * time.Millisecond}
+			rwc, err := stdIoLSConn("", env, settings, cmdArgs[0], cmdArgs[1:]...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			proc := lsProcessOf(rwc)
+			pgid := proc.cmd.Process.Pid
+
+			ctx := context.Background()
+			conn := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(rwc, jsonrpc2.VSCodeObjectCodec{}), nil)
+			if err := conn.Call(ctx, "shutdown", nil, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.Notify(ctx, "exit", nil); err != nil {
+				t.Fatal(err)
+			}
+			if test.mode == "ignore-sigterm" {
+				// Wait for the child, so that stop has to kill it too.
+				waitForGroupSize(t, pgid, 2)
+			}
+			// Closing the connection stops the process, see
+			// cmdRWCloser.Close. All stages share one grace period.
+			start := time.Now()
+			if err := rwc.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed > settings.shutdownGrace+300*time.Millisecond {
+				t.Errorf("expected the language server to be stopped within the grace period of %s, took %s", settings.shutdownGrace, elapsed)
+			}
+
+			if !strings.Contains(logs.String(), test.want) {
+				t.Errorf("expected the language server to have %s, got the logs %q", test.want, logs.String())
+			}
+			if pids := processGroupPIDs(pgid); len(pids) != 0 {
+				t.Errorf("expected no process of the language server's process group to survive, got %v", pids)
+			}
+		})
+	}
+}
+
+// waitForGroupSize waits until the process group pgid has n live processes.
+func waitForGroupSize(t *testing.T, pgid, n int) {
+	deadline := time.Now().Add(10 * time.Second)
+	for len(processGroupPIDs(pgid)) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d processes in the process group", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// helperLanguageServer returns the environment and command which start
+// TestHelperLanguageServer in mode.
+func helperLanguageServer(mode string, env ...string) ([]string, []string) {
+	// The race detector makes processes wait a second before they exit,
+	// which would be longer than the grace period.
+	env = append(env, "LSP_ADAPTER_TEST_SERVER="+mode, "GORACE=atexit_sleep_ms=0")
+	return env, []string{os.Args[0], "-test.run=^TestHelperLanguageServer$"}
+}
+
+func TestSocketLSConn(t *testing.T) {
+	logs, restore := captureLogs("logfmt")
+	defer restore()
+	ctx := context.Background()
+
+	// The language server only listens on the port it is told to use a
+	// while after it started, so connecting to it has to be retried.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := lis.Addr().String()
+	lis.Close()
+	env, cmdArgs := helperLanguageServer("listen", "LSP_ADAPTER_TEST_ADDRESS="+address)
+	settings := &serverSettings{dialTimeout: 10 * time.Second, shutdownGrace: 500 * time.Millisecond}
+	rwc, err := socketLSConn(ctx, "tcp", address, nil, "", env, settings, cmdArgs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(rwc, jsonrpc2.VSCodeObjectCodec{}), nil)
+	if err := conn.Call(ctx, "shutdown", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Notify(ctx, "exit", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := rwc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "exited by itself") {
+		t.Errorf("expected the language server to exit on the exit notification, got the logs %q", logs.String())
+	}
+
+	// Connecting is given up once the language server exits.
+	env, cmdArgs = helperLanguageServer("listen", "LSP_ADAPTER_TEST_ADDRESS=127.0.0.1:-1")
+	_, err = socketLSConn(ctx, "tcp", address, nil, "", env, settings, cmdArgs...)
+	if err == nil || !strings.Contains(err.Error(), "language server exited before listening on tcp://"+address) {
+		t.Errorf("got %v, want the error for the language server which exited", err)
+	}
+}
+
+func TestSocketLSConnPortZero(t *testing.T) {
+	_, restore := captureLogs("logfmt")
+	defer restore()
+	ctx := context.Background()
+	settings := &serverSettings{dialTimeout: 10 * time.Second, shutdownGrace: 500 * time.Millisecond}
+
+	// The language server picks its own port, which it prints.
+	env, cmdArgs := helperLanguageServer("listen", "LSP_ADAPTER_TEST_ADDRESS=127.0.0.1:0")
+	rwc, err := socketLSConn(ctx, "tcp", "127.0.0.1:0", regexp.MustCompile(`listening on port (\d+)`), "", env, settings, cmdArgs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(rwc, jsonrpc2.VSCodeObjectCodec{}), nil)
+	if err := conn.Call(ctx, "shutdown", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Notify(ctx, "exit", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := rwc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a pattern, the port it listens on is found in /proc.
+	rwc, err = socketLSConn(ctx, "tcp", "127.0.0.1:0", nil, "", env, settings, cmdArgs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn = jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(rwc, jsonrpc2.VSCodeObjectCodec{}), nil)
+	if err := conn.Call(ctx, "shutdown", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := rwc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// It is killed if it doesn't print a line matching the pattern in time.
+	settings.dialTimeout = 100 * time.Millisecond
+	_, err = socketLSConn(ctx, "tcp", "127.0.0.1:0", regexp.MustCompile(`serving at (\d+)`), "", env, settings, cmdArgs...)
+	if want := `language server did not print a line matching -lspPortPattern="serving at (\\d+)" within 100ms`; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+	_, err = socketLSConn(ctx, "tcp", "127.0.0.1:0", nil, "", env, settings, cmdArgs...)
+	if want := "language server did not listen on a TCP port within 100ms"; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestParseLSAddress(t *testing.T) {
+	tests := []struct {
+		rawAddr     string
+		wantNetwork string
+		wantAddress string
+		wantErr     bool
+	}{
+		{rawAddr: "127.0.0.1:7658", wantNetwork: "tcp", wantAddress: "127.0.0.1:7658"},
+		{rawAddr: "tcp://127.0.0.1:7658", wantNetwork: "tcp", wantAddress: "127.0.0.1:7658"},
+		{rawAddr: "unix:///tmp/ls.sock", wantNetwork: "unix", wantAddress: "/tmp/ls.sock"},
+		{rawAddr: "tcp://", wantErr: true},
+		{rawAddr: "unix://", wantErr: true},
+		{rawAddr: "udp://127.0.0.1:7658", wantErr: true},
+	}
+
+	for _, test := range tests {
+		network, address, err := parseLSAddress(test.rawAddr)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("expected error when parsing %q", test.rawAddr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("got error %s when parsing %q", err, test.rawAddr)
+			continue
+		}
+		if network != test.wantNetwork || address != test.wantAddress {
+			t.Errorf("for %q expected (%q, %q), actual (%q, %q)", test.rawAddr, test.wantNetwork, test.wantAddress, network, address)
+		}
+	}
+}
+
+func TestLSTemplatePort(t *testing.T) {
+	tmpl, err := parseLSTemplate("--port={{.Port}}", "--root={{.WorkspaceDir}}", "tcp://127.0.0.1:{{.Port}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	data := &lsTemplateData{
+		WorkspaceDir: "/tmp/ws",
+		allocPort: func() (int, error) {
+			calls++
+			return 1234, nil
+		},
+	}
+	args, err := tmpl.execute(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"--port=1234", "--root=/tmp/ws", "tcp://127.0.0.1:1234"}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("expected %v, actual %v", want, args)
+	}
+	if calls != 1 {
+		t.Errorf("expected a port to be allocated once, actual %d times", calls)
+	}
+}
+
+func TestNewLSConnectorPortZero(t *testing.T) {
+	// Without a port pattern, the port can only be discovered on Linux.
+	if _, err := newLSConnector("tcp://127.0.0.1:0", []string{"ls"}, nil, nil, 0, &serverSettings{}); (err == nil) != listeningPortsSupported {
+		t.Errorf("unexpected error when using port 0 without a port pattern: %v", err)
+	}
+	if _, err := newLSConnector("tcp://127.0.0.1:0", nil, nil, regexp.MustCompile(`PORT=(\d+)`), 0, &serverSettings{}); err == nil {
+		t.Error("expected error when using port 0 without LSP_COMMAND_ARGS")
+	}
+	if _, err := newLSConnector("tcp://127.0.0.1:0", []string{"ls"}, nil, regexp.MustCompile(`PORT=(\d+)`), 0, &serverSettings{}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestNewLSConnectorPool(t *testing.T) {
+	if _, err := newLSConnector("", []string{"ls", "--root={{.WorkspaceDir}}"}, nil, nil, 2, &serverSettings{}); err == nil {
+		t.Error("expected error when using a pool with {{.WorkspaceDir}}")
+	}
+	if _, err := newLSConnector("tcp://127.0.0.1:7658", nil, nil, nil, 2, &serverSettings{}); err == nil {
+		t.Error("expected error when using a pool without LSP_COMMAND_ARGS")
+	}
+	if _, err := newLSConnector("tcp://127.0.0.1:{{.Port}}", []string{"ls", "--port={{.Port}}"}, nil, nil, 2, &serverSettings{}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import "os/exec"
+
+// Windows has neither process groups we can signal nor SIGTERM, so we can
+// only kill the language server process itself.
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func terminateProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
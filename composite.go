@@ -0,0 +1,776 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/go-langserver/pkg/lsp"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// capabilityOf maps methods to the server capability a language server has
+// to advertise for requests of the method to be sent to it. Requests of
+// other methods are sent to every language server.
+var capabilityOf = map[string]string{
+	"textDocument/hover":             "hoverProvider",
+	"textDocument/definition":        "definitionProvider",
+	"textDocument/typeDefinition":    "typeDefinitionProvider",
+	"textDocument/implementation":    "implementationProvider",
+	"textDocument/references":        "referencesProvider",
+	"textDocument/documentHighlight": "documentHighlightProvider",
+	"textDocument/documentSymbol":    "documentSymbolProvider",
+	"textDocument/completion":        "completionProvider",
+	"textDocument/signatureHelp":     "signatureHelpProvider",
+	"textDocument/codeAction":        "codeActionProvider",
+	"textDocument/codeLens":          "codeLensProvider",
+	"textDocument/documentLink":      "documentLinkProvider",
+	"textDocument/formatting":        "documentFormattingProvider",
+	"textDocument/rangeFormatting":   "documentRangeFormattingProvider",
+	"textDocument/rename":            "renameProvider",
+	"textDocument/xdefinition":       "xdefinitionProvider",
+	"workspace/symbol":               "workspaceSymbolProvider",
+	"workspace/xreferences":          "xworkspaceReferencesProvider",
+}
+
+// firstResultMethods are the methods whose result is the first non-null
+// result of the language servers (in the order of the profile's servers)
+// rather than the merged results.
+var firstResultMethods = map[string]bool{
+	"textDocument/definition":     true,
+	"textDocument/typeDefinition": true,
+	"textDocument/xdefinition":    true,
+}
+
+// setComponents makes c the config of a composite language server made of
+// the language servers of the profiles called servers. Unless c has its own
+// globs, it handles the files any of them handles.
+func (c *sessionConfig) setComponents(servers []string) error {
+	components := make([]*sessionConfig, 0, len(servers))
+	var globs []string
+	seen := map[string]bool{}
+	allFiles := false
+	for _, name := range servers {
+		fs, settings, err := parseSettings(name)
+		if err != nil {
+			return errors.Wrapf(err, "server %s", name)
+		}
+		if len(settings.servers) > 0 {
+			return errors.Errorf("server %s: the servers of a composite profile can't be composite themselves", name)
+		}
+		component, err := newSessionConfig(fs, settings)
+		if err != nil {
+			return errors.Wrapf(err, "server %s", name)
+		}
+		component.name = name
+		components = append(components, component)
+		for _, g := range component.glob {
+			if !seen[g] {
+				seen[g] = true
+				globs = append(globs, g)
+			}
+		}
+		allFiles = allFiles || len(component.glob) == 0
+	}
+	if len(c.glob) == 0 && !allFiles {
+		c.glob = globs
+	}
+	c.components = components
+	c.connectLS = compositeConnector(components)
+	c.connectNew = c.connectLS
+	return nil
+}
+
+// compositeConnector returns an lsConnector for a composite language server
+// (see compositeServer) made of the language servers of components.
+func compositeConnector(components []*sessionConfig) lsConnector {
+	return func(ctx context.Context, data lsTemplateData, dir string) (io.ReadWriteCloser, error) {
+		a, b := net.Pipe()
+		s, err := startCompositeServer(ctx, components, data, dir, b)
+		if err != nil {
+			a.Close()
+			b.Close()
+			return nil, err
+		}
+		return &compositeConn{Conn: a, server: s}, nil
+	}
+}
+
+// compositeConn is the connection to a composite language server. Closing
+// it stops its language servers.
+type compositeConn struct {
+	net.Conn
+	server *compositeServer
+}
+
+func (c *compositeConn) Close() error {
+	err := c.Conn.Close()
+	<-c.server.stopped
+	return err
+}
+
+// setLogger makes the composite language server and its language servers
+// log with the logger returned by l (see lsProcess.setLogger).
+func (c *compositeConn) setLogger(l func() *logger) {
+	c.server.logMu.Lock()
+	c.server.logSource = l
+	c.server.logMu.Unlock()
+	for _, s := range c.server.servers {
+		if proc := lsProcessOf(s.rwc); proc != nil {
+			name := s.name
+			proc.setLogger(func() *logger { return l().with("server", name) })
+		}
+	}
+}
+
+// setSink makes the language servers of the composite language server pass
+// the lines they write to stderr to sink, prefixed with their names.
+func (c *compositeConn) setSink(sink func(line string)) {
+	for _, s := range c.server.servers {
+		if proc := lsProcessOf(s.rwc); proc != nil {
+			name := s.name
+			proc.output.setSink(func(line string) { sink(name + ": " + line) })
+		}
+	}
+}
+
+// compositeServer is a language server which lets several language servers
+// work on one workspace, e.x. for HTML files with embedded CSS. Requests are
+// sent to the language servers which advertise the capability for them and
+// whose globs match the document of the request, and their results are
+// merged (see mergeResults). Language servers which fail are left out, and
+// the composite language server only exits once all of them have.
+type compositeServer struct {
+	client  *jsonrpc2.Conn // the connection to the workspace
+	servers []*componentServer
+	stopped chan struct{} // closed once the language servers have been stopped
+
+	logMu     sync.Mutex
+	logSource func() *logger // see compositeConn.setLogger
+
+	diagMu      sync.Mutex
+	diagnostics map[string][]json.RawMessage // document URI -> the diagnostics of each language server
+}
+
+// componentServer is one of the language servers of a compositeServer.
+type componentServer struct {
+	name  string
+	globs []string // the files the language server handles, all if empty
+	rwc   io.ReadWriteCloser
+	conn  *jsonrpc2.Conn
+
+	shutdownGrace   time.Duration  // the -shutdownGracePeriod of the language server's profile
+	idRewrite       string         // the -jsonrpc2IDRewrite of the language server's profile
+	lastRequestID   *atomicCounter // the IDs of requests if they are rewritten
+	didOpenLanguage string         // the -didOpenLanguage of the language server's profile
+	closeOnce       sync.Once
+
+	mu           sync.Mutex
+	capabilities map[string]json.RawMessage // set once the language server has been initialized
+	exited       bool                       // set once the 'exit' notification has been sent
+	didOpen      map[string]bool            // the paths of the documents opened by openDocument
+}
+
+func startCompositeServer(ctx context.Context, components []*sessionConfig, data lsTemplateData, dir string, clientConn net.Conn) (*compositeServer, error) {
+	l := loggerFrom(ctx)
+	s := &compositeServer{
+		stopped:     make(chan struct{}),
+		logSource:   func() *logger { return l },
+		diagnostics: map[string][]json.RawMessage{},
+	}
+	for _, c := range components {
+		rwc, err := c.connectLS(ctx, data, dir)
+		if err != nil {
+			l.warnf("Composite language server: starting %s failed, continuing without it: %s", c.name, err)
+			continue
+		}
+		cs := &componentServer{
+			name:            c.name,
+			globs:           c.glob,
+			rwc:             rwc,
+			shutdownGrace:   c.server.shutdownGrace,
+			idRewrite:       c.jsonrpc2IDRewrite,
+			lastRequestID:   newAtomicCounter(),
+			didOpenLanguage: c.didOpenLanguage,
+			didOpen:         map[string]bool{},
+		}
+		index := len(s.servers)
+		cs.conn = jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(rwc, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2.AsyncHandler(jsonrpc2HandlerFunc(func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+			s.handleServerRequest(ctx, index, req)
+		})))
+		s.servers = append(s.servers, cs)
+	}
+	if len(s.servers) == 0 {
+		return nil, errors.New("none of the language servers of the composite language server could be started")
+	}
+
+	s.client = jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(clientConn, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2.AsyncHandler(jsonrpc2HandlerFunc(s.handleClientRequest)))
+	go s.watchServers()
+	go func() {
+		<-s.client.DisconnectNotify()
+		s.stop()
+	}()
+	return s, nil
+}
+
+// logger returns the logger for messages about the composite language
+// server.
+func (s *compositeServer) logger() *logger {
+	s.logMu.Lock()
+	l := s.logSource
+	s.logMu.Unlock()
+	return l()
+}
+
+// watchServers closes the connection to the workspace once all language
+// servers have exited, so that the workspace notices.
+func (s *compositeServer) watchServers() {
+	var wg sync.WaitGroup
+	for _, cs := range s.servers {
+		wg.Add(1)
+		go func(cs *componentServer) {
+			defer wg.Done()
+			select {
+			case <-cs.conn.DisconnectNotify():
+				if !cs.hasExited() {
+					s.logger().warnf("Composite language server: %s disconnected, continuing without it", cs.name)
+				}
+			case <-s.client.DisconnectNotify():
+			}
+		}(cs)
+	}
+	wg.Wait()
+	s.client.Close()
+}
+
+// stop shuts down the language servers once the workspace disconnected.
+func (s *compositeServer) stop() {
+	defer close(s.stopped)
+	var wg sync.WaitGroup
+	for _, cs := range s.servers {
+		wg.Add(1)
+		go func(cs *componentServer) {
+			defer wg.Done()
+			if !cs.hasExited() && cs.alive() {
+				// A process started by us has to fit the whole shutdown
+				// into its grace period, see lsProcess.stopDeadlines.
+				deadline := time.Now().Add(cs.shutdownGrace)
+				if proc := lsProcessOf(cs.rwc); proc != nil {
+					deadline, _ = proc.stopDeadlines()
+				}
+				ctx, cancel := context.WithDeadline(context.Background(), deadline)
+				if err := cs.conn.Call(ctx, "shutdown", nil, nil); err == nil {
+					cs.conn.Notify(ctx, "exit", nil)
+				}
+				cancel()
+			}
+			cs.close()
+		}(cs)
+	}
+	wg.Wait()
+}
+
+// close stops the language server. The connection notices that rwc has been
+// closed, rather than closing it itself, because jsonrpc2.Conn.Close doesn't
+// close rwc once the language server has disconnected.
+func (cs *componentServer) close() {
+	cs.closeOnce.Do(func() { cs.rwc.Close() })
+}
+
+func (cs *componentServer) alive() bool {
+	select {
+	case <-cs.conn.DisconnectNotify():
+		return false
+	default:
+		return true
+	}
+}
+
+func (cs *componentServer) hasExited() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.exited
+}
+
+// openDocument sends the language server a 'textDocument/didOpen'
+// notification for the document params refer to, unless it has been sent
+// one already, if its profile uses -didOpenLanguage. See the HACK comment in
+// forwardToServer.
+func (cs *componentServer) openDocument(ctx context.Context, params *json.RawMessage) {
+	if cs.didOpenLanguage == "" {
+		return
+	}
+	uri := documentURI(params)
+	u, err := url.Parse(uri)
+	if err != nil || !probablyFileURI(u) {
+		return
+	}
+	cs.mu.Lock()
+	sent := cs.didOpen[u.Path]
+	cs.didOpen[u.Path] = true
+	cs.mu.Unlock()
+	if sent {
+		return
+	}
+
+	b, err := ioutil.ReadFile(u.Path)
+	if err != nil {
+		return
+	}
+	cs.conn.Notify(ctx, "textDocument/didOpen", &lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{
+			URI:        lsp.DocumentURI(uri),
+			LanguageID: cs.didOpenLanguage,
+			Version:    1,
+			Text:       string(b),
+		},
+	})
+}
+
+// handles reports whether requests and notifications of method for the
+// document uri (empty if there is none) are sent to the language server.
+func (cs *componentServer) handles(method, uri string) bool {
+	if !cs.alive() {
+		return false
+	}
+	if capability, ok := capabilityOf[method]; ok {
+		cs.mu.Lock()
+		value, advertised := cs.capabilities[capability]
+		cs.mu.Unlock()
+		if !advertised || string(value) == "false" || string(value) == "null" {
+			return false
+		}
+	}
+	if uri == "" || len(cs.globs) == 0 {
+		return true
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return true
+	}
+	name := path.Base(u.Path)
+	for _, pattern := range cs.globs {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// documentURI returns the URI of the document params refer to, or "".
+func documentURI(params *json.RawMessage) string {
+	if params == nil {
+		return ""
+	}
+	var p struct {
+		TextDocument struct {
+			URI string `json:"uri"`
+		} `json:"textDocument"`
+	}
+	if err := json.Unmarshal(*params, &p); err != nil {
+		return ""
+	}
+	return p.TextDocument.URI
+}
+
+func (s *compositeServer) handleClientRequest(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	if req.Method == "initialize" {
+		s.initialize(ctx, req)
+		return
+	}
+
+	var targets []*componentServer
+	uri := documentURI(req.Params)
+	for _, cs := range s.servers {
+		if cs.handles(req.Method, uri) {
+			targets = append(targets, cs)
+		}
+	}
+
+	if req.Notif {
+		for _, cs := range targets {
+			if req.Method == "exit" {
+				cs.mu.Lock()
+				cs.exited = true
+				cs.mu.Unlock()
+			}
+			cs.openDocument(ctx, req.Params)
+			if err := cs.conn.Notify(ctx, req.Method, req.Params); err != nil {
+				s.logger().warnf("Composite language server: sending %s to %s failed: %s", req.Method, cs.name, err)
+			}
+		}
+		return
+	}
+
+	results, errs := s.fanOut(ctx, req, targets)
+	result, err := mergeResults(req.Method, results, errs)
+	if err != nil {
+		s.replyWithError(ctx, req, err)
+		return
+	}
+	if err := s.client.Reply(ctx, req.ID, result); err != nil {
+		s.logger().warnf("Composite language server: sending %s reply failed: %s", req.Method, err)
+	}
+}
+
+// fanOut sends req to targets at once, and returns their results and
+// errors in the same order.
+func (s *compositeServer) fanOut(ctx context.Context, req *jsonrpc2.Request, targets []*componentServer) ([]*json.RawMessage, []error) {
+	results := make([]*json.RawMessage, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, cs := range targets {
+		wg.Add(1)
+		go func(i int, cs *componentServer) {
+			defer wg.Done()
+			// The IDs are unique on the connection to the workspace, so they
+			// are passed on as they are unless the language server's profile
+			// rewrites them. That way '$/cancelRequest' works.
+			cs.openDocument(ctx, req.Params)
+			id := rewriteID(cs.idRewrite, req.ID, cs.lastRequestID)
+			errs[i] = cs.conn.Call(ctx, req.Method, req.Params, &results[i], jsonrpc2.PickID(id))
+			if errs[i] != nil && req.Method != "shutdown" {
+				s.logger().debugf("Composite language server: %s request to %s failed: %s", req.Method, cs.name, errs[i])
+			}
+		}(i, cs)
+	}
+	wg.Wait()
+	return results, errs
+}
+
+// initialize initializes all language servers and replies with the union
+// of their capabilities. Language servers which fail to initialize are left
+// out.
+func (s *compositeServer) initialize(ctx context.Context, req *jsonrpc2.Request) {
+	results, errs := s.fanOut(ctx, req, s.servers)
+
+	var firstErr error
+	capabilities := map[string]json.RawMessage{}
+	for i, cs := range s.servers {
+		var result struct {
+			Capabilities map[string]json.RawMessage `json:"capabilities"`
+		}
+		if errs[i] == nil && results[i] != nil {
+			errs[i] = json.Unmarshal(*results[i], &result)
+		}
+		if errs[i] != nil {
+			if firstErr == nil {
+				firstErr = errors.Wrapf(errs[i], "initializing %s failed", cs.name)
+			}
+			go cs.close()
+			continue
+		}
+
+		cs.mu.Lock()
+		cs.capabilities = result.Capabilities
+		cs.mu.Unlock()
+		for k, v := range result.Capabilities {
+			if old, ok := capabilities[k]; !ok || string(old) == "false" || string(old) == "null" {
+				capabilities[k] = v
+			}
+		}
+	}
+
+	alive := 0
+	for _, cs := range s.servers {
+		if cs.alive() {
+			alive++
+		}
+	}
+	if alive == 0 {
+		s.replyWithError(ctx, req, firstErr)
+		return
+	}
+	if err := s.client.Reply(ctx, req.ID, map[string]interface{}{"capabilities": capabilities}); err != nil {
+		s.logger().warnf("Composite language server: sending initialize reply failed: %s", err)
+	}
+}
+
+func (s *compositeServer) replyWithError(ctx context.Context, req *jsonrpc2.Request, err error) {
+	respErr, ok := errors.Cause(err).(*jsonrpc2.Error)
+	if !ok {
+		respErr = &jsonrpc2.Error{Code: jsonrpc2.CodeInternalError, Message: err.Error()}
+	}
+	if err := s.client.ReplyWithError(ctx, req.ID, respErr); err != nil {
+		s.logger().warnf("Composite language server: sending %s error reply failed: %s", req.Method, err)
+	}
+}
+
+// handleServerRequest passes requests and notifications of the language
+// server with the given index on to the workspace.
+func (s *compositeServer) handleServerRequest(ctx context.Context, index int, req *jsonrpc2.Request) {
+	cs := s.servers[index]
+	if req.Notif {
+		params := req.Params
+		if req.Method == "textDocument/publishDiagnostics" {
+			params = s.mergeDiagnostics(index, req.Params)
+		}
+		if err := s.client.Notify(ctx, req.Method, params); err != nil {
+			s.logger().warnf("Composite language server: passing on %s from %s failed: %s", req.Method, cs.name, err)
+		}
+		return
+	}
+
+	var result *json.RawMessage
+	if err := s.client.Call(ctx, req.Method, req.Params, &result); err != nil {
+		respErr, ok := err.(*jsonrpc2.Error)
+		if !ok {
+			respErr = &jsonrpc2.Error{Code: jsonrpc2.CodeInternalError, Message: err.Error()}
+		}
+		cs.conn.ReplyWithError(ctx, req.ID, respErr)
+		return
+	}
+	if err := cs.conn.Reply(ctx, req.ID, result); err != nil {
+		s.logger().warnf("Composite language server: sending %s reply to %s failed: %s", req.Method, cs.name, err)
+	}
+}
+
+// mergeDiagnostics records the diagnostics the language server with the
+// given index published, and returns the params of a
+// 'textDocument/publishDiagnostics' notification with the diagnostics of
+// all language servers for the document.
+func (s *compositeServer) mergeDiagnostics(index int, params *json.RawMessage) *json.RawMessage {
+	if params == nil {
+		return params
+	}
+	var p struct {
+		URI         string            `json:"uri"`
+		Diagnostics []json.RawMessage `json:"diagnostics"`
+	}
+	if err := json.Unmarshal(*params, &p); err != nil {
+		return params
+	}
+
+	s.diagMu.Lock()
+	byServer, ok := s.diagnostics[p.URI]
+	if !ok {
+		byServer = make([]json.RawMessage, len(s.servers))
+		s.diagnostics[p.URI] = byServer
+	}
+	b, _ := json.Marshal(p.Diagnostics)
+	byServer[index] = b
+	all := []json.RawMessage{}
+	for _, d := range byServer {
+		var diags []json.RawMessage
+		if len(d) > 0 && json.Unmarshal(d, &diags) == nil {
+			all = append(all, diags...)
+		}
+	}
+	s.diagMu.Unlock()
+
+	p.Diagnostics = all
+	b, err := json.Marshal(p)
+	if err != nil {
+		return params
+	}
+	merged := json.RawMessage(b)
+	return &merged
+}
+
+// mergeResults merges the results of the language servers a request of
+// method was sent to:
+//
+// - For definitions, the first non-null result wins.
+// - For hovers, the contents are combined.
+// - Lists (e.x. of locations) are concatenated, without duplicates.
+// - Otherwise, the first non-null result wins.
+//
+// The language servers which failed are left out. If all of them failed,
+// the first error is returned.
+func mergeResults(method string, results []*json.RawMessage, errs []error) (interface{}, error) {
+	var values []json.RawMessage
+	var firstErr error
+	for i, r := range results {
+		if errs[i] != nil {
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+			continue
+		}
+		if r != nil && !isNull(*r) {
+			values = append(values, *r)
+		}
+	}
+	if len(values) == 0 {
+		if firstErr != nil && len(results) > 0 && allFailed(errs) {
+			return nil, firstErr
+		}
+		return nil, nil
+	}
+	if len(values) == 1 || firstResultMethods[method] {
+		return values[0], nil
+	}
+	if method == "textDocument/hover" {
+		return mergeHovers(values), nil
+	}
+
+	var merged []json.RawMessage
+	seen := map[string]bool{}
+	for _, v := range values {
+		var list []json.RawMessage
+		if err := json.Unmarshal(v, &list); err != nil {
+			// Not a list.
+			return values[0], nil
+		}
+		for _, elem := range list {
+			key := canonicalJSON(elem)
+			if !seen[key] {
+				seen[key] = true
+				merged = append(merged, elem)
+			}
+		}
+	}
+	return merged, nil
+}
+
+func allFailed(errs []error) bool {
+	for _, err := range errs {
+		if err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// isNull reports whether v is null or an empty list.
+func isNull(v json.RawMessage) bool {
+	var list []json.RawMessage
+	if err := json.Unmarshal(v, &list); err == nil {
+		return len(list) == 0
+	}
+	return string(v) == "null"
+}
+
+// canonicalJSON returns v re-encoded with sorted keys, so that equal values
+// can be recognized.
+func canonicalJSON(v json.RawMessage) string {
+	var value interface{}
+	if err := json.Unmarshal(v, &value); err != nil {
+		return string(v)
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return string(v)
+	}
+	return string(b)
+}
+
+// mergeHovers combines the contents of hovers into one hover, with the range
+// of the first one. If any of them is MarkupContent, the contents are
+// combined into MarkupContent, which is markdown unless all of them are
+// plain text. Otherwise they are combined into a list of MarkedStrings.
+func mergeHovers(hovers []json.RawMessage) interface{} {
+	var (
+		contents   []json.RawMessage
+		hoverRange json.RawMessage
+		markup     bool // whether any of the contents is MarkupContent
+		markdown   bool // whether any of the contents is markdown
+	)
+	for _, h := range hovers {
+		var hover struct {
+			Contents json.RawMessage `json:"contents"`
+			Range    json.RawMessage `json:"range"`
+		}
+		if err := json.Unmarshal(h, &hover); err != nil {
+			continue
+		}
+		if hoverRange == nil && len(hover.Range) > 0 {
+			hoverRange = hover.Range
+		}
+		contents = append(contents, hover.Contents)
+		switch markupKind(hover.Contents) {
+		case "":
+			// MarkedStrings are markdown.
+			markdown = true
+		case "markdown":
+			markup, markdown = true, true
+		default:
+			markup = true
+		}
+	}
+
+	var merged map[string]interface{}
+	if markup {
+		kind, sep := "plaintext", "\n\n"
+		if markdown {
+			kind, sep = "markdown", "\n\n---\n\n"
+		}
+		var values []string
+		for _, c := range contents {
+			values = append(values, markupValues(c, markdown)...)
+		}
+		merged = map[string]interface{}{"contents": map[string]string{"kind": kind, "value": strings.Join(values, sep)}}
+	} else {
+		var list []interface{}
+		for _, c := range contents {
+			list = append(list, markedStrings(c)...)
+		}
+		merged = map[string]interface{}{"contents": list}
+	}
+	if hoverRange != nil {
+		merged["range"] = hoverRange
+	}
+	return merged
+}
+
+// markupKind returns the kind of the contents of a hover if they are
+// MarkupContent, or "" if they are MarkedStrings.
+func markupKind(contents json.RawMessage) string {
+	var markup struct {
+		Kind string `json:"kind"`
+	}
+	if err := json.Unmarshal(contents, &markup); err != nil {
+		return ""
+	}
+	return markup.Kind
+}
+
+// markupValues returns the contents of a hover as the values of
+// MarkupContent, in markdown or plain text. MarkedStrings with a language
+// become code blocks in markdown.
+func markupValues(contents json.RawMessage, markdown bool) []string {
+	var markup struct {
+		Kind  string `json:"kind"`
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(contents, &markup); err == nil && markup.Kind != "" {
+		return []string{markup.Value}
+	}
+	var values []string
+	for _, ms := range markedStrings(contents) {
+		switch v := ms.(type) {
+		case string:
+			values = append(values, v)
+		case map[string]interface{}:
+			language, _ := v["language"].(string)
+			value, _ := v["value"].(string)
+			if markdown {
+				value = "```" + language + "\n" + value + "\n```"
+			}
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// markedStrings returns the contents of a hover (a MarkedString or a list of
+// them) as a list of MarkedStrings.
+func markedStrings(contents json.RawMessage) []interface{} {
+	var list []interface{}
+	if err := json.Unmarshal(contents, &list); err == nil {
+		return list
+	}
+	var value interface{}
+	if err := json.Unmarshal(contents, &value); err != nil || value == nil {
+		return nil
+	}
+	return []interface{}{value}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/go-langserver/pkg/lsp"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+func TestMergeResults(t *testing.T) {
+	raw := func(s string) *json.RawMessage {
+		m := json.RawMessage(s)
+		return &m
+	}
+	failed := errors.New("failed")
+	cases := []struct {
+		method  string
+		results []*json.RawMessage
+		errs    []error
+		want    string
+	}{
+		{"textDocument/references", []*json.RawMessage{raw(`[{"a":1,"b":2}]`), raw(`[{"b":2,"a":1},{"a":3}]`)}, []error{nil, nil}, `[{"a":1,"b":2},{"a":3}]`},
+		{"textDocument/definition", []*json.RawMessage{raw(`null`), raw(`[{"a":1}]`), raw(`[{"a":2}]`)}, []error{nil, nil, nil}, `[{"a":1}]`},
+		{"textDocument/hover", []*json.RawMessage{raw(`{"contents":"css","range":{"x":1}}`), raw(`{"contents":[{"language":"html","value":"<p>"}]}`)}, []error{nil, nil}, `{"contents":["css",{"language":"html","value":"\u003cp\u003e"}],"range":{"x":1}}`},
+		{"textDocument/hover", []*json.RawMessage{raw(`{"contents":{"language":"css","value":"p {}"},"range":{"x":1}}`), raw(`{"contents":{"kind":"markdown","value":"*html*"}}`)}, []error{nil, nil}, `{"contents":{"kind":"markdown","value":"` + "```css\\np {}\\n```" + `\n\n---\n\n*html*"},"range":{"x":1}}`},
+		{"textDocument/hover", []*json.RawMessage{raw(`{"contents":{"kind":"plaintext","value":"css"}}`), raw(`{"contents":{"kind":"plaintext","value":"html"}}`)}, []error{nil, nil}, `{"contents":{"kind":"plaintext","value":"css\n\nhtml"}}`},
+		{"textDocument/references", []*json.RawMessage{nil, raw(`[{"a":1}]`)}, []error{failed, nil}, `[{"a":1}]`},
+		{"shutdown", []*json.RawMessage{raw(`null`), raw(`null`)}, []error{nil, nil}, `null`},
+		{"textDocument/completion", []*json.RawMessage{raw(`{"items":[]}`), raw(`[{"label":"a"}]`)}, []error{nil, nil}, `{"items":[]}`},
+	}
+	for _, c := range cases {
+		got, err := mergeResults(c.method, c.results, c.errs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := json.Marshal(got)
+		if string(b) != c.want {
+			t.Errorf("%s: got %s, want %s", c.method, b, c.want)
+		}
+	}
+
+	if _, err := mergeResults("textDocument/hover", []*json.RawMessage{nil, nil}, []error{failed, failed}); err != failed {
+		t.Errorf("expected the error of the language servers if all of them failed, got %v", err)
+	}
+}
+
+// fakeComponent returns a sessionConfig for a fake language server called
+// name, which handles the files matching glob and answers 'textDocument/hover'
+// and 'textDocument/references' with its name.
+func fakeComponent(name, glob string, stopped chan<- string) *sessionConfig {
+	connect := func(ctx context.Context, data lsTemplateData, dir string) (io.ReadWriteCloser, error) {
+		a, b := net.Pipe()
+		conn := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(b, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2HandlerFunc(func(ctx context.Context, c *jsonrpc2.Conn, req *jsonrpc2.Request) {
+			switch req.Method {
+			case "initialize":
+				c.Reply(ctx, req.ID, map[string]interface{}{"capabilities": map[string]interface{}{"hoverProvider": true, "referencesProvider": name == "css"}})
+			case "textDocument/hover":
+				c.Reply(ctx, req.ID, map[string]interface{}{"contents": name})
+			case "textDocument/references":
+				c.Reply(ctx, req.ID, []map[string]string{{"uri": name}})
+			case "textDocument/didOpen":
+				c.Notify(ctx, "textDocument/publishDiagnostics", map[string]interface{}{"uri": "file:///a.html", "diagnostics": []map[string]string{{"message": name}}})
+			case "shutdown":
+				c.Reply(ctx, req.ID, nil)
+			}
+		}))
+		go func() {
+			<-conn.DisconnectNotify()
+			stopped <- name
+		}()
+		return a, nil
+	}
+	return &sessionConfig{name: name, glob: []string{glob}, jsonrpc2IDRewrite: "none", connectLS: connect}
+}
+
+func TestCompositeServer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stopped := make(chan string, 2)
+	connect := compositeConnector([]*sessionConfig{fakeComponent("css", "*.css", stopped), fakeComponent("html", "*.html", stopped)})
+	rwc, err := connect(ctx, lsTemplateData{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diagnostics := make(chan []interface{}, 2)
+	client := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(rwc, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2.AsyncHandler(jsonrpc2HandlerFunc(func(ctx context.Context, c *jsonrpc2.Conn, req *jsonrpc2.Request) {
+		if req.Method == "textDocument/publishDiagnostics" {
+			var params struct {
+				Diagnostics []interface{} `json:"diagnostics"`
+			}
+			json.Unmarshal(*req.Params, &params)
+			diagnostics <- params.Diagnostics
+		}
+	})))
+
+	var init struct {
+		Capabilities map[string]bool `json:"capabilities"`
+	}
+	if err := client.Call(ctx, "initialize", map[string]interface{}{}, &init); err != nil {
+		t.Fatal(err)
+	}
+	if !init.Capabilities["hoverProvider"] || !init.Capabilities["referencesProvider"] {
+		t.Errorf("expected the union of the capabilities, got %v", init.Capabilities)
+	}
+
+	// Requests only go to the language servers handling the document.
+	var hover struct {
+		Contents string `json:"contents"`
+	}
+	if err := client.Call(ctx, "textDocument/hover", map[string]interface{}{"textDocument": map[string]string{"uri": "file:///a.css"}}, &hover); err != nil {
+		t.Fatal(err)
+	}
+	if hover.Contents != "css" {
+		t.Errorf("got hover %q for a CSS file, want the one of css", hover.Contents)
+	}
+
+	// Requests without a document go to the language servers with the
+	// capability for them.
+	var refs []map[string]string
+	if err := client.Call(ctx, "textDocument/references", map[string]interface{}{}, &refs); err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0]["uri"] != "css" {
+		t.Errorf("got references %v, want the ones of css", refs)
+	}
+
+	// The diagnostics of the language servers are combined.
+	timeout := time.After(5 * time.Second)
+	for want, uri := range []string{"file:///a.html", "file:///a.css"} {
+		client.Notify(ctx, "textDocument/didOpen", map[string]interface{}{"textDocument": map[string]string{"uri": uri}})
+		select {
+		case d := <-diagnostics:
+			if len(d) != want+1 {
+				t.Errorf("got %d diagnostics, want %d", len(d), want+1)
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for diagnostics")
+		}
+	}
+
+	client.Close()
+	rwc.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-stopped:
+		case <-timeout:
+			t.Fatal("expected the language servers to be stopped once the connection is closed")
+		}
+	}
+}
+
+func TestCompositeServerComponentHacks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f, err := ioutil.TempFile("", "composite-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("p { color: red }")
+	f.Close()
+	uri := "file://" + f.Name()
+
+	// The language server uses -jsonrpc2IDRewrite=string and
+	// -didOpenLanguage=css, which the composite language server applies to
+	// what it sends it.
+	received := make(chan *jsonrpc2.Request, 10)
+	component := &sessionConfig{name: "css", jsonrpc2IDRewrite: "string", didOpenLanguage: "css"}
+	component.connectLS = func(ctx context.Context, data lsTemplateData, dir string) (io.ReadWriteCloser, error) {
+		a, b := net.Pipe()
+		jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(b, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2HandlerFunc(func(ctx context.Context, c *jsonrpc2.Conn, req *jsonrpc2.Request) {
+			received <- req
+			if !req.Notif {
+				c.Reply(ctx, req.ID, map[string]interface{}{"capabilities": map[string]interface{}{"hoverProvider": true}})
+			}
+		}))
+		return a, nil
+	}
+	rwc, err := compositeConnector([]*sessionConfig{component})(ctx, lsTemplateData{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rwc.Close()
+	client := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(rwc, jsonrpc2.VSCodeObjectCodec{}), nil)
+	defer client.Close()
+
+	if err := client.Call(ctx, "initialize", map[string]interface{}{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call(ctx, "textDocument/hover", map[string]interface{}{"textDocument": map[string]string{"uri": uri}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var methods []string
+	timeout := time.After(5 * time.Second)
+	for len(methods) < 3 {
+		var req *jsonrpc2.Request
+		select {
+		case req = <-received:
+		case <-timeout:
+			t.Fatalf("timed out waiting for the requests of the language server, got %q", methods)
+		}
+		methods = append(methods, req.Method)
+		switch {
+		case !req.Notif && !req.ID.IsString:
+			t.Errorf("got the ID %s for %s, want a string ID", req.ID, req.Method)
+		case req.Method == "textDocument/didOpen":
+			var params lsp.DidOpenTextDocumentParams
+			json.Unmarshal(*req.Params, &params)
+			if params.TextDocument.URI != lsp.DocumentURI(uri) || params.TextDocument.LanguageID != "css" || params.TextDocument.Text != "p { color: red }" {
+				t.Errorf("unexpected didOpen params %+v", params.TextDocument)
+			}
+		}
+	}
+	if want := []string{"initialize", "textDocument/didOpen", "textDocument/hover"}; !reflect.DeepEqual(methods, want) {
+		t.Errorf("got the methods %q, want %q", methods, want)
+	}
+}
+
+func TestCompositeConfig(t *testing.T) {
+	filename := writeConfig(t, `{
+		"profiles": {
+			"web": {"servers": ["css", "html"]},
+			"css": {"command": ["css-languageserver", "--stdio"], "glob": ["*.css"]},
+			"html": {"command": ["html-languageserver", "--stdio"], "glob": ["*.html"]},
+			"nested": {"servers": ["web"]}
+		}
+	}`)
+	defer os.Remove(filename)
+	oldArgs := os.Args
+	defer func() { os.Args = oldArgs }()
+
+	os.Args = []string{"lsp-adapter", "-config=" + filename, "-profile=web"}
+	backends, err := loadBackends()
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := backends.backends[0]
+	if len(web.components) != 2 || web.components[0].name != "css" || !reflect.DeepEqual(web.glob, []string{"*.css", "*.html"}) {
+		t.Errorf("unexpected composite config %+v", web)
+	}
+
+	for _, args := range [][]string{
+		{"-config=" + filename, "-profile=nested"},
+		{"-config=" + filename, "-profile=web", "gopls"},
+	} {
+		os.Args = append([]string{"lsp-adapter"}, args...)
+		if _, err := loadBackends(); err == nil {
+			t.Errorf("expected an error for %q", args)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// envPrefix is the prefix of the environment variables which set flags,
+// e.x. LSP_ADAPTER_GLOB for -glob.
+const envPrefix = "LSP_ADAPTER_"
+
+// adapterConfig is the contents of the file passed to -config.
+type adapterConfig struct {
+	// DefaultProfile is the profile used unless -profile is specified.
+	DefaultProfile string `json:"defaultProfile"`
+
+	// Defaults applies to all profiles, which can override it.
+	Defaults profileConfig            `json:"defaults"`
+	Profiles map[string]profileConfig `json:"profiles"`
+}
+
+// profileConfig sets flags by their names (e.x. "glob" or
+// "shutdownGracePeriod"). Values may be strings, numbers, booleans, arrays
+// (joined with ":", e.x. for "glob") or objects (passed as JSON, e.x. for
+// "initializationOptions"). Additionally, "command" sets LSP_COMMAND_ARGS
+// and "env" the environment variables of the language server, "modes" and
+// "listenAddress" route sessions to the profile with -backends, and
+// "servers" makes it a composite of the language servers of other profiles.
+type profileConfig map[string]json.RawMessage
+
+// The keys of a profileConfig which are not flags.
+const (
+	configCommand       = "command"
+	configEnv           = "env"
+	configModes         = "modes"
+	configListenAddress = "listenAddress"
+	configServers       = "servers"
+)
+
+// profileSettings are the settings of a profile which are not flags.
+type profileSettings struct {
+	command, env  []string
+	modes         []string // the modes of 'initialize' requests routed to the profile
+	listenAddress string   // the address sessions routed to the profile are accepted at
+	servers       []string // the profiles of the language servers of a composite profile
+}
+
+// loadConfig reads the config file at filename and checks that all of its
+// profiles are valid.
+func loadConfig(filename string) (*adapterConfig, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var config adapterConfig
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s failed", filename)
+	}
+
+	if config.DefaultProfile != "" {
+		if _, ok := config.Profiles[config.DefaultProfile]; !ok {
+			return nil, errors.Errorf("%s: the default profile %q does not exist", filename, config.DefaultProfile)
+		}
+	}
+	if _, err := config.Defaults.resolve(copyFlagSet(flag.CommandLine)); err != nil {
+		return nil, errors.Wrapf(err, "%s: invalid defaults", filename)
+	}
+	for _, name := range config.profileNames() {
+		if _, err := config.Profiles[name].resolve(copyFlagSet(flag.CommandLine)); err != nil {
+			return nil, errors.Wrapf(err, "%s: invalid profile %q", filename, name)
+		}
+	}
+	return &config, nil
+}
+
+func (c *adapterConfig) profileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// profile returns the settings of the profile name (or of DefaultProfile if
+// name is empty), merged with Defaults.
+func (c *adapterConfig) profile(name string) (profileConfig, error) {
+	if name == "" {
+		name = c.DefaultProfile
+	}
+	merged := profileConfig{}
+	for k, v := range c.Defaults {
+		merged[k] = v
+	}
+	if name == "" {
+		return merged, nil
+	}
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return nil, errors.Errorf("unknown profile %q, expected one of %s", name, strings.Join(c.profileNames(), ", "))
+	}
+	for k, v := range profile {
+		merged[k] = v
+	}
+	return merged, nil
+}
+
+// resolve sets the flags of fs listed in p, except for the ones in skip
+// (which were set on the command line or in the environment). It returns
+// the settings which are not flags.
+func (p profileConfig) resolve(fs *flag.FlagSet, skip ...map[string]bool) (profileSettings, error) {
+	var settings profileSettings
+	keys := make([]string, 0, len(p))
+	for k := range p {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := p[k]
+		switch k {
+		case configCommand, configModes, configServers:
+			var list []string
+			if err := json.Unmarshal(v, &list); err != nil {
+				return settings, errors.Errorf("%s: expected an array of strings", k)
+			}
+			switch k {
+			case configCommand:
+				settings.command = list
+			case configModes:
+				settings.modes = list
+			default:
+				settings.servers = list
+			}
+			continue
+		case configEnv:
+			var vars map[string]string
+			if err := json.Unmarshal(v, &vars); err != nil {
+				return settings, errors.Errorf("%s: expected an object with string values", k)
+			}
+			for name, value := range vars {
+				settings.env = append(settings.env, name+"="+value)
+			}
+			sort.Strings(settings.env)
+			continue
+		case configListenAddress:
+			if err := json.Unmarshal(v, &settings.listenAddress); err != nil {
+				return settings, errors.Errorf("%s: expected a string", k)
+			}
+			continue
+		case "config", "profile", "backends":
+			return settings, errors.Errorf("%s can't be set in the config file", k)
+		}
+
+		if fs.Lookup(k) == nil {
+			return settings, errors.Errorf("%s: unknown setting", k)
+		}
+		s, err := configValueString(v)
+		if err != nil {
+			return settings, errors.Wrap(err, k)
+		}
+		if len(skip) > 0 && skip[0][k] {
+			continue
+		}
+		if err := fs.Set(k, s); err != nil {
+			return settings, errors.Wrap(err, k)
+		}
+	}
+	return settings, nil
+}
+
+// configValueString converts the JSON value v of a profileConfig to the
+// string passed to flag.Value.Set.
+func configValueString(v json.RawMessage) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal(v, &value); err != nil {
+		return "", err
+	}
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case bool, float64:
+		return strings.TrimSpace(string(v)), nil
+	case []interface{}:
+		parts := make([]string, len(value))
+		for i, elem := range value {
+			s, ok := elem.(string)
+			if !ok {
+				return "", errors.New("expected an array of strings")
+			}
+			parts[i] = s
+		}
+		return strings.Join(parts, ":"), nil
+	case map[string]interface{}:
+		return strings.TrimSpace(string(v)), nil
+	default:
+		return "", errors.Errorf("unexpected value %s", v)
+	}
+}
+
+// copyFlagSet returns a copy of the flags of fs, set to their default
+// values. The profiles of a config file are applied to copies of
+// flag.CommandLine in order to check them.
+func copyFlagSet(fs *flag.FlagSet) *flag.FlagSet {
+	copied := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	copied.SetOutput(ioutil.Discard)
+	fs.VisitAll(func(f *flag.Flag) {
+		// The flag package's values (and byteSize) are pointer types.
+		t := reflect.TypeOf(f.Value)
+		if t.Kind() != reflect.Ptr {
+			return
+		}
+		if v, ok := reflect.New(t.Elem()).Interface().(flag.Value); ok {
+			v.Set(f.DefValue)
+			copied.Var(v, f.Name, f.Usage)
+		}
+	})
+	return copied
+}
+
+// envName returns the name of the environment variable setting the flag
+// name, e.x. LSP_ADAPTER_JSONRPC2_ID_REWRITE for -jsonrpc2IDRewrite.
+func envName(name string) string {
+	var b strings.Builder
+	b.WriteString(envPrefix)
+	runes := []rune(name)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// setFlagsFromEnv sets the flags of fs which are not in set from their
+// environment variables (see envName), and adds them to set.
+func setFlagsFromEnv(fs *flag.FlagSet, set map[string]bool) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = errors.Errorf("invalid value %q for %s: %s", value, envName(f.Name), setErr)
+			return
+		}
+		set[f.Name] = true
+	})
+	return err
+}
+
+// loadSettings applies the environment variables and the profile of the
+// -config file to the flags of fs which were not set on the command line. It
+// returns the settings of the profile which are not flags, with the
+// arguments of fs (LSP_COMMAND_ARGS) as the command unless there are none.
+func loadSettings(fs *flag.FlagSet) (profileSettings, error) {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if err := setFlagsFromEnv(fs, set); err != nil {
+		return profileSettings{}, err
+	}
+
+	settings := profileSettings{command: fs.Args()}
+	configFile := flagValue(fs, "config").(string)
+	if configFile == "" {
+		return settings, nil
+	}
+	config, err := loadConfig(configFile)
+	if err != nil {
+		return profileSettings{}, err
+	}
+	profile, err := config.profile(flagValue(fs, "profile").(string))
+	if err != nil {
+		return profileSettings{}, err
+	}
+	resolved, err := profile.resolve(fs, set)
+	if err != nil {
+		return profileSettings{}, err
+	}
+	if len(settings.command) > 0 {
+		resolved.command = settings.command
+	}
+	return resolved, nil
+}
+
+// withInitOptions returns params, the params of an 'initialize' request,
+// with the fields of initOptions (see -initializationOptions) added to its
+// initializationOptions (unless the client set them).
+func withInitOptions(params *json.RawMessage, initOptions map[string]json.RawMessage) (*json.RawMessage, error) {
+	if len(initOptions) == 0 || params == nil {
+		return params, nil
+	}
+	var p map[string]json.RawMessage
+	if err := json.Unmarshal(*params, &p); err != nil {
+		return nil, errors.Wrap(err, "invalid initialize params")
+	}
+	options := map[string]json.RawMessage{}
+	if raw, ok := p["initializationOptions"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &options); err != nil {
+			// Not an object, so there is nothing to add to.
+			return params, nil
+		}
+	}
+	for k, v := range initOptions {
+		if _, ok := options[k]; !ok {
+			options[k] = v
+		}
+	}
+	b, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	p["initializationOptions"] = b
+	b, err = json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	merged := json.RawMessage(b)
+	return &merged, nil
+}
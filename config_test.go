@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	for name, want := range map[string]string{
+		"glob":              "LSP_ADAPTER_GLOB",
+		"proxyAddress":      "LSP_ADAPTER_PROXY_ADDRESS",
+		"jsonrpc2IDRewrite": "LSP_ADAPTER_JSONRPC2_ID_REWRITE",
+		"rlimitNOFILE":      "LSP_ADAPTER_RLIMIT_NOFILE",
+		"cgroupCPUMax":      "LSP_ADAPTER_CGROUP_CPU_MAX",
+	} {
+		if got := envName(name); got != want {
+			t.Errorf("envName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+// writeConfig writes config to a new temporary file, which the caller has
+// to remove, and returns its name.
+func writeConfig(t *testing.T, config string) string {
+	f, err := ioutil.TempFile("", "config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(config); err != nil {
+		os.Remove(f.Name())
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestLoadConfig(t *testing.T) {
+	filename := writeConfig(t, `{
+		"defaultProfile": "css",
+		"defaults": {"shutdownGracePeriod": "10s", "didOpenLanguage": "none"},
+		"profiles": {
+			"css": {
+				"command": ["css-languageserver", "--stdio"],
+				"env": {"NODE_OPTIONS": "--max-old-space-size=4096"},
+				"glob": ["*.css", "*.scss"],
+				"didOpenLanguage": "css",
+				"initializationOptions": {"provideFormatter": false}
+			}
+		}
+	}`)
+	defer os.Remove(filename)
+	config, err := loadConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile, err := config.profile("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		fs          = flag.NewFlagSet("test", flag.ContinueOnError)
+		glob        = fs.String("glob", "", "")
+		didOpen     = fs.String("didOpenLanguage", "", "")
+		grace       = fs.Duration("shutdownGracePeriod", time.Second, "")
+		initOptions = fs.String("initializationOptions", "", "")
+	)
+	settings, err := profile.resolve(fs, map[string]bool{"didOpenLanguage": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"css-languageserver", "--stdio"}; !reflect.DeepEqual(settings.command, want) {
+		t.Errorf("got command %q, want %q", settings.command, want)
+	}
+	if want := []string{"NODE_OPTIONS=--max-old-space-size=4096"}; !reflect.DeepEqual(settings.env, want) {
+		t.Errorf("got env %q, want %q", settings.env, want)
+	}
+	if *glob != "*.css:*.scss" || *grace != 10*time.Second || *initOptions != `{"provideFormatter": false}` {
+		t.Errorf("unexpected flags glob=%q shutdownGracePeriod=%s initializationOptions=%q", *glob, *grace, *initOptions)
+	}
+	if *didOpen != "" {
+		t.Errorf("expected didOpenLanguage, which was set on the command line, to be kept, got %q", *didOpen)
+	}
+
+	if _, err := config.profile("html"); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	for _, config := range []string{
+		`{"profiles": {"a": {"noSuchFlag": "x"}}}`,
+		`{"profiles": {"a": {"shutdownGracePeriod": "soon"}}}`,
+		`{"profiles": {"a": {"command": "ls"}}}`,
+		`{"profiles": {"a": {"config": "other.json"}}}`,
+		`{"defaultProfile": "b", "profiles": {"a": {}}}`,
+		`{"profiles": {}, "unknown": true}`,
+	} {
+		filename := writeConfig(t, config)
+		if _, err := loadConfig(filename); err == nil {
+			t.Errorf("expected an error for %s", config)
+		}
+		os.Remove(filename)
+	}
+}
+
+func TestWithInitOptions(t *testing.T) {
+	initOptions := map[string]json.RawMessage{"a": json.RawMessage(`1`), "b": json.RawMessage(`2`)}
+
+	params := json.RawMessage(`{"rootUri":"file:///","initializationOptions":{"b":3}}`)
+	merged, err := withInitOptions(&params, initOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(*merged); !strings.Contains(got, `"initializationOptions":{"a":1,"b":3}`) || !strings.Contains(got, `"rootUri":"file:///"`) {
+		t.Errorf("unexpected params %s", got)
+	}
+}
@@ -4,7 +4,7 @@ go 1.14
 
 require (
 	github.com/google/uuid v0.0.0-20161128191214-064e2069ce9c
-	github.com/gorilla/websocket v1.4.1 // indirect
+	github.com/gorilla/websocket v1.4.1
 	github.com/hashicorp/errwrap v0.0.0-20141028054710-7554cd9344ce // indirect
 	github.com/hashicorp/go-multierror v0.0.0-20171204182908-b7773ae21874
 	github.com/neelance/parallel v0.0.0-20160708114440-4de9ce63d14c
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/go-langserver/pkg/lsp"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// The states of the accept loop, as seen by the health checks.
+const (
+	stateStarting int32 = iota
+	stateAccepting
+	stateDraining
+	stateStopped
+)
+
+// healthChecker answers the health check endpoints of the debug server.
+type healthChecker struct {
+	state   int32 // the state of the accept loop, accessed atomically
+	limiter *sessionLimiter
+
+	// checkServer starts and initializes new instances of the language
+	// servers, see checkBackends.
+	checkServer func(ctx context.Context) error
+	checkMu     sync.Mutex // only one language server is started at a time
+}
+
+func (h *healthChecker) setState(state int32) {
+	atomic.StoreInt32(&h.state, state)
+}
+
+// live reports whether the accept loop is running (or lsp-adapter is
+// draining on purpose).
+func (h *healthChecker) live() error {
+	switch atomic.LoadInt32(&h.state) {
+	case stateAccepting, stateDraining:
+		return nil
+	case stateStarting:
+		return errors.New("not accepting connections yet")
+	default:
+		return errors.New("shutting down")
+	}
+}
+
+// ready reports whether new sessions are handled right away.
+func (h *healthChecker) ready() error {
+	switch atomic.LoadInt32(&h.state) {
+	case stateAccepting:
+	case stateDraining:
+		return errors.New("draining")
+	default:
+		return h.live()
+	}
+	if h.limiter.full() {
+		return errors.New("the maximum number of sessions is active")
+	}
+	return nil
+}
+
+// deep starts a new instance of the language server and initializes it.
+func (h *healthChecker) deep(ctx context.Context) error {
+	h.checkMu.Lock()
+	defer h.checkMu.Unlock()
+	return h.checkServer(ctx)
+}
+
+// ServeHTTP serves /healthz/live, /healthz/ready and /healthz/deep. The
+// status is 200 if the check passed, 503 otherwise.
+func (h *healthChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	var err error
+	switch r.URL.Path {
+	case "/healthz/live":
+		err = h.live()
+	case "/healthz/ready":
+		err = h.ready()
+	case "/healthz/deep":
+		ctx, cancel := context.WithTimeout(r.Context(), *healthCheckTimeout)
+		err = h.deep(ctx)
+		cancel()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	fmt.Fprintf(w, "ok (%s)\n", time.Since(start))
+}
+
+// checkLanguageServer starts a new instance of the language server of config
+// (not one from the pool), sends it an 'initialize' request for an empty
+// workspace and shuts it down again.
+func checkLanguageServer(ctx context.Context, config *sessionConfig) error {
+	dir, err := ioutil.TempDir(*cacheDir, "healthcheck-")
+	if err != nil {
+		return errors.Wrap(err, "creating empty workspace failed")
+	}
+	defer os.RemoveAll(dir)
+
+	unpooled := *config
+	unpooled.connectLS = config.connectNew
+	ws := newWorkspace(ctx, dir, &unpooled, nil)
+	defer ws.close()
+
+	serverDir := ""
+	if config.lazyStart {
+		serverDir = dir
+	}
+	if err := ws.startServer(serverDir); err != nil {
+		return err
+	}
+
+	params := &lsp.InitializeParams{
+		RootPath: dir,
+		RootURI:  clientToServerURI("file:///", dir),
+	}
+	var opts []jsonrpc2.CallOption
+	if config.jsonrpc2IDRewrite != "none" {
+		opts = append(opts, jsonrpc2.PickID(rewriteID(config.jsonrpc2IDRewrite, jsonrpc2.ID{}, ws.lastRequestID)))
+	}
+	if err := ws.serverConn().Call(ctx, "initialize", params, nil, opts...); err != nil {
+		if _, ok := err.(*jsonrpc2.Error); !ok {
+			if proc := ws.exitedProcess(); proc != nil {
+				return errors.Errorf("the language server exited during the initialize request: %s", proc.describeExit())
+			}
+		}
+		return errors.Wrap(err, "initialize request failed")
+	}
+	return nil
+}
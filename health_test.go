@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/sourcegraph/go-langserver/pkg/lsp"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+func TestHealthChecker(t *testing.T) {
+	h := &healthChecker{limiter: newSessionLimiter(1, 0, 0, 0)}
+	check := func(name string, err error, wantOK bool) {
+		t.Helper()
+		if (err == nil) != wantOK {
+			t.Errorf("%s: got %v, want ok=%v", name, err, wantOK)
+		}
+	}
+
+	check("live while starting", h.live(), false)
+	check("ready while starting", h.ready(), false)
+
+	h.setState(stateAccepting)
+	check("live", h.live(), true)
+	check("ready", h.ready(), true)
+
+	release, err := h.limiter.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("ready at the session limit", h.ready(), false)
+	release()
+	check("ready below the session limit", h.ready(), true)
+
+	h.setState(stateDraining)
+	check("live while draining", h.live(), true)
+	check("ready while draining", h.ready(), false)
+
+	h.setState(stateStopped)
+	check("live after shutdown", h.live(), false)
+
+	h.checkServer = func(ctx context.Context) error {
+		return checkBackends(ctx, &backendSet{backends: []*sessionConfig{{}}})
+	}
+	check("deep without LSP_COMMAND_ARGS", h.deep(context.Background()), false)
+}
+
+func TestCheckLanguageServer(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "health-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	oldCacheDir := cacheDir
+	cacheDir = &tmp
+	defer func() { cacheDir = oldCacheDir }()
+
+	// The fake language server fails the 'initialize' request unless its
+	// rootUri is the empty workspace.
+	connect := func(ctx context.Context, data lsTemplateData, dir string) (io.ReadWriteCloser, error) {
+		a, b := net.Pipe()
+		jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(b, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2HandlerFunc(func(ctx context.Context, c *jsonrpc2.Conn, req *jsonrpc2.Request) {
+			var params lsp.InitializeParams
+			if err := json.Unmarshal(*req.Params, &params); err != nil || params.RootURI != lsp.DocumentURI("file://"+data.WorkspaceDir) {
+				c.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{Message: "unexpected rootUri"})
+				return
+			}
+			if _, err := os.Stat(data.WorkspaceDir); err != nil {
+				c.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{Message: err.Error()})
+				return
+			}
+			c.Reply(ctx, req.ID, map[string]interface{}{"capabilities": map[string]interface{}{}})
+		}))
+		return a, nil
+	}
+	if err := checkLanguageServer(context.Background(), &sessionConfig{connectNew: connect, jsonrpc2IDRewrite: "none"}); err != nil {
+		t.Fatal(err)
+	}
+
+	failing := func(ctx context.Context, data lsTemplateData, dir string) (io.ReadWriteCloser, error) {
+		a, b := net.Pipe()
+		b.Close()
+		return a, nil
+	}
+	if err := checkLanguageServer(context.Background(), &sessionConfig{connectNew: failing, jsonrpc2IDRewrite: "none"}); err == nil {
+		t.Error("expected an error for a language server which disconnects")
+	}
+
+	if files, _ := ioutil.ReadDir(tmp); len(files) != 0 {
+		t.Errorf("expected the empty workspaces to be removed, found %d files", len(files))
+	}
+}
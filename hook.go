@@ -2,9 +2,9 @@ package main
 
 import (
 	"context"
-	"log"
 	"os"
 	"os/exec"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -23,8 +23,10 @@ func (p *cloneProxy) runHook(ctx context.Context, program string) error {
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	log.Printf("Running pre-init hook: '%s %s'\n", program, p.workspaceCacheDir())
+	loggerFrom(ctx).infof("Running pre-init hook: '%s %s'", program, p.workspaceCacheDir())
+	start := time.Now()
 	err := cmd.Run()
+	metricHookDuration.observeDuration(start, exitStatusLabel(err))
 	if err != nil {
 		return errors.Wrapf(err, "When running pre-init hook: '%s %s'", program, p.workspaceCacheDir())
 	}
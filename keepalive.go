@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// workspaceRegistry keeps track of the workspaces (and their language
+// servers) of each repository. It keeps the workspaces of ended sessions
+// alive for -keepAlive, so that new sessions for the same repository can
+// reuse them, and with -multiplex it lets concurrent sessions for the same
+// repository share a workspace.
+type workspaceRegistry struct {
+	ttl       time.Duration // 0 disables keeping workspaces alive
+	maxIdle   int
+	multiplex bool
+
+	mu     sync.Mutex
+	active map[string]*workspace // key -> the workspace sessions are using
+	idle   []*idleWorkspace      // ordered from the longest to the most recently idle
+}
+
+type idleWorkspace struct {
+	ws      *workspace
+	timer   *time.Timer
+	removed chan struct{} // closed when the workspace is no longer idle
+}
+
+func newWorkspaceRegistry(ttl time.Duration, maxIdle int, multiplex bool) *workspaceRegistry {
+	return &workspaceRegistry{ttl: ttl, maxIdle: maxIdle, multiplex: multiplex, active: map[string]*workspace{}}
+}
+
+// acquire returns the workspace a session which initializes the repository
+// identified by key should use: the workspace another session is using
+// (with -multiplex), an idle workspace (with -keepAlive) or otherwise own,
+// the session's own workspace. Workspaces created with a configuration that
+// has since been reloaded are not reused. Once the session is done with the
+// workspace, it must call release.
+func (r *workspaceRegistry) acquire(key string, own *workspace) *workspace {
+	if key == "" {
+		return own
+	}
+
+	r.mu.Lock()
+	if ws, ok := r.active[key]; ok && r.multiplex && ws.config == own.config && ws.ctx.Err() == nil && !ws.serverExited() {
+		ws.users++
+		r.mu.Unlock()
+		return ws
+	}
+	var (
+		retired *workspace
+		reason  string
+	)
+	if i := r.indexLocked(key); i >= 0 {
+		ws := r.removeLocked(i)
+		switch {
+		case ws.config != own.config:
+			retired, reason = ws, "the configuration has been reloaded"
+		case ws.serverAlive():
+			ws.users++
+			r.active[key] = ws
+			r.mu.Unlock()
+			return ws
+		default:
+			retired, reason = ws, "its language server exited"
+		}
+	}
+	own.key = key
+	own.users++
+	r.active[key] = own
+	r.mu.Unlock()
+
+	if retired != nil {
+		retireWorkspace(retired, reason)
+	}
+	return own
+}
+
+// release is called when a session is done with ws. It returns true if the
+// workspace is still in use by other sessions or is kept alive, otherwise
+// the caller has to remove it.
+func (r *workspaceRegistry) release(ws *workspace) bool {
+	r.mu.Lock()
+	if ws.key == "" {
+		r.mu.Unlock()
+		return false
+	}
+	ws.users--
+	if ws.users > 0 {
+		r.mu.Unlock()
+		return true
+	}
+	if r.active[ws.key] == ws {
+		delete(r.active, ws.key)
+	}
+	r.mu.Unlock()
+
+	if r.ttl == 0 || !ws.reusable() {
+		return false
+	}
+	r.park(ws)
+	return true
+}
+
+// park keeps ws alive until it is taken, it has been idle for the TTL, its
+// language server exits, or it has to make room for other workspaces. An
+// idle workspace with the same key is replaced.
+func (r *workspaceRegistry) park(ws *workspace) {
+	iw := &idleWorkspace{ws: ws, removed: make(chan struct{})}
+
+	r.mu.Lock()
+	var evicted []*workspace
+	if i := r.indexLocked(ws.key); i >= 0 {
+		evicted = append(evicted, r.removeLocked(i))
+	}
+	for r.maxIdle > 0 && len(r.idle) >= r.maxIdle {
+		evicted = append(evicted, r.removeLocked(0))
+	}
+	iw.timer = time.AfterFunc(r.ttl, func() { r.evict(ws, "it has been idle for "+r.ttl.String()) })
+	r.idle = append(r.idle, iw)
+	r.mu.Unlock()
+
+	ws.logger().infof("CloneProxy: keeping the workspace alive for %s", r.ttl)
+
+	go func() {
+		select {
+		case <-ws.serverDone:
+			r.evict(ws, "its language server exited")
+		case <-iw.removed:
+		}
+	}()
+
+	for _, ws := range evicted {
+		retireWorkspace(ws, "it was replaced by a more recently used workspace")
+	}
+}
+
+// evict removes ws if it is still idle.
+func (r *workspaceRegistry) evict(ws *workspace, reason string) {
+	r.mu.Lock()
+	i := -1
+	for j, iw := range r.idle {
+		if iw.ws == ws {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		r.mu.Unlock()
+		return
+	}
+	r.removeLocked(i)
+	r.mu.Unlock()
+
+	retireWorkspace(ws, reason)
+}
+
+// closeAll removes all idle workspaces.
+func (r *workspaceRegistry) closeAll() {
+	r.mu.Lock()
+	var all []*workspace
+	for len(r.idle) > 0 {
+		all = append(all, r.removeLocked(0))
+	}
+	r.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, ws := range all {
+		wg.Add(1)
+		go func(ws *workspace) {
+			defer wg.Done()
+			retireWorkspace(ws, "lsp-adapter is shutting down")
+		}(ws)
+	}
+	wg.Wait()
+}
+
+func (r *workspaceRegistry) indexLocked(key string) int {
+	for i, iw := range r.idle {
+		if iw.ws.key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *workspaceRegistry) removeLocked(i int) *workspace {
+	iw := r.idle[i]
+	r.idle = append(r.idle[:i], r.idle[i+1:]...)
+	iw.timer.Stop()
+	close(iw.removed)
+	return iw.ws
+}
+
+// retireWorkspace stops the language server of an idle workspace and
+// removes its cache directory.
+func retireWorkspace(ws *workspace, reason string) {
+	ws.logger().infof("CloneProxy: removing idle workspace because %s", reason)
+	ws.close()
+	ws.cleanWorkspaceCache()
+}
+
+// workspaceKey returns the key identifying the repository of the
+// 'initialize' request with params for -keepAlive and -multiplex, or an
+// empty string if it has none. Sessions of different backends (see
+// -backends) don't share workspaces.
+func workspaceKey(backend string, params *json.RawMessage) string {
+	if params == nil {
+		return ""
+	}
+	var p struct {
+		OriginalRootURI string `json:"originalRootUri"`
+		RootURI         string `json:"rootUri"`
+		RootPath        string `json:"rootPath"`
+	}
+	if err := json.Unmarshal(*params, &p); err != nil {
+		return ""
+	}
+	key := p.RootPath
+	switch {
+	case p.OriginalRootURI != "":
+		key = p.OriginalRootURI
+	case p.RootURI != "":
+		key = p.RootURI
+	}
+	if key != "" && backend != "" {
+		key = backend + " " + key
+	}
+	return key
+}
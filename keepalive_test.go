@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWorkspaceRegistry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tmp, err := ioutil.TempDir("", "keepalive-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	connect := func(ctx context.Context, data lsTemplateData, dir string) (io.ReadWriteCloser, error) {
+		a, _ := net.Pipe()
+		return a, nil
+	}
+	config := &sessionConfig{connectLS: connect}
+	newTestWorkspace := func() *workspace {
+		dir, err := ioutil.TempDir(tmp, "ws")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws := newWorkspace(ctx, dir, config, nil)
+		if err := ws.startServer(""); err != nil {
+			t.Fatal(err)
+		}
+		ws.finishInitialize(nil, nil)
+		return ws
+	}
+	removed := func(ws *workspace) bool {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if _, err := os.Stat(ws.dir); os.IsNotExist(err) {
+				return true
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return false
+	}
+
+	t.Run("keepAlive", func(t *testing.T) {
+		r := newWorkspaceRegistry(time.Hour, 2, false)
+
+		a := newTestWorkspace()
+		if ws := r.acquire("a", a); ws != a {
+			t.Fatal("expected the session's own workspace for key a")
+		}
+		if !r.release(a) {
+			t.Fatal("expected the workspace for key a to be kept alive")
+		}
+		if ws := r.acquire("a", newTestWorkspace()); ws != a {
+			t.Fatal("expected the idle workspace for key a to be reused")
+		}
+		b := newTestWorkspace()
+		if ws := r.acquire("b", b); ws != b {
+			t.Fatal("expected the session's own workspace for key b")
+		}
+		// Without -multiplex concurrent sessions don't share workspaces.
+		if ws := r.acquire("b", newTestWorkspace()); ws == b {
+			t.Fatal("expected the workspace for key b not to be shared")
+		}
+		r.release(a)
+		r.release(b)
+
+		// The workspace that has been idle the longest makes room.
+		c := newTestWorkspace()
+		r.acquire("c", c)
+		r.release(c)
+		if !removed(a) {
+			t.Error("expected the workspace for key a to be removed")
+		}
+		if ws := r.acquire("b", newTestWorkspace()); ws != b {
+			t.Error("expected the idle workspace for key b to be reused")
+		}
+
+		// Workspaces whose language server exited are removed.
+		c.serverConn().Close()
+		if !removed(c) {
+			t.Error("expected the workspace for key c to be removed after its language server exited")
+		}
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		r := newWorkspaceRegistry(10*time.Millisecond, 2, false)
+		a := newTestWorkspace()
+		r.acquire("a", a)
+		r.release(a)
+		if !removed(a) {
+			t.Error("expected the workspace for key a to be removed after the TTL")
+		}
+	})
+
+	t.Run("multiplex", func(t *testing.T) {
+		r := newWorkspaceRegistry(0, 0, true)
+		a := newTestWorkspace()
+		if ws := r.acquire("a", a); ws != a {
+			t.Fatal("expected the session's own workspace for key a")
+		}
+		if ws := r.acquire("a", newTestWorkspace()); ws != a {
+			t.Fatal("expected the workspace for key a to be shared")
+		}
+		if !r.release(a) {
+			t.Fatal("expected the workspace for key a to be kept while another session uses it")
+		}
+		if r.release(a) {
+			t.Fatal("expected the workspace for key a to be removed once no session uses it")
+		}
+		if ws := r.acquire("a", newTestWorkspace()); ws == a {
+			t.Fatal("expected a released workspace not to be shared")
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		r := newWorkspaceRegistry(time.Minute, 2, false)
+		a := newTestWorkspace()
+		r.acquire("a", a)
+		r.release(a)
+
+		// Sessions started after a reload don't reuse workspaces created
+		// with the old configuration.
+		reloaded := newWorkspace(ctx, filepath.Join(tmp, "reloaded"), &sessionConfig{connectLS: connect}, nil)
+		if ws := r.acquire("a", reloaded); ws != reloaded {
+			t.Fatal("expected the session's own workspace after a reload")
+		}
+		if !removed(a) {
+			t.Error("expected the workspace created with the old configuration to be removed")
+		}
+	})
+}
+
+func TestWorkspaceKey(t *testing.T) {
+	cases := []struct {
+		params string
+		want   string
+	}{
+		{`{"rootUri": "file:///", "originalRootUri": "git://github.com/foo/bar?abc"}`, "git://github.com/foo/bar?abc"},
+		{`{"rootUri": "file:///foo"}`, "file:///foo"},
+		{`{"rootPath": "/foo"}`, "/foo"},
+		{`{}`, ""},
+	}
+	for _, c := range cases {
+		params := json.RawMessage(c.params)
+		if got := workspaceKey("", &params); got != c.want {
+			t.Errorf("workspaceKey(%s) = %q, want %q", c.params, got, c.want)
+		}
+	}
+
+	params := json.RawMessage(`{"rootUri": "file:///foo"}`)
+	if got, want := workspaceKey("css", &params), "css file:///foo"; got != want {
+		t.Errorf("got %q for the css backend, want %q", got, want)
+	}
+}
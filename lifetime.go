@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// The reasons a session ends, see cloneProxy.waitForEnd.
+const (
+	endClientDisconnected = "client_disconnected"
+	endServerExited       = "server_exited"
+	endIdleTimeout        = "idle_timeout"
+	endMaxLifetime        = "max_lifetime"
+	endShutdown           = "shutdown"
+)
+
+// waitForEnd blocks until the session should end: when one side of the
+// connection disconnects, the session has been idle for -sessionIdleTimeout
+// or has reached -maxSessionLifetime, or lsp-adapter is shutting down. It
+// returns the reason, which is also recorded in endReason.
+func (p *cloneProxy) waitForEnd() string {
+	idleTimeout, maxLifetime := p.config.sessionIdleTimeout, p.config.maxSessionLifetime
+
+	var lifetime <-chan time.Time
+	if maxLifetime > 0 {
+		t := time.NewTimer(maxLifetime)
+		defer t.Stop()
+		lifetime = t.C
+	}
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if idleTimeout > 0 {
+		idleTimer = time.NewTimer(idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	var reason string
+	for reason == "" {
+		select {
+		case <-p.client.DisconnectNotify():
+			reason = endClientDisconnected
+		case <-p.serverDone:
+			reason = endServerExited
+		case <-lifetime:
+			reason = endMaxLifetime
+		case <-idle:
+			if d := p.idleFor(); d >= idleTimeout {
+				reason = endIdleTimeout
+			} else {
+				idleTimer.Reset(idleTimeout - d)
+			}
+		case <-p.ctx.Done():
+			reason = endShutdown
+		}
+	}
+
+	p.endReason.Store(reason)
+	return reason
+}
+
+// recordActivity is a jsonrpc2.OnRecv callback for the connection to the
+// client, which keeps track of when the client last sent something.
+func (p *cloneProxy) recordActivity(req *jsonrpc2.Request, resp *jsonrpc2.Response) {
+	atomic.StoreInt64(&p.lastActivity, time.Now().UnixNano())
+}
+
+// idleFor returns how long the client hasn't sent anything. The session is
+// not idle while requests of the client are being handled.
+func (p *cloneProxy) idleFor() time.Duration {
+	if atomic.LoadInt32(&p.inFlight) > 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&p.lastActivity)))
+}
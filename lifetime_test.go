@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+func TestWaitForEnd(t *testing.T) {
+	var servers []net.Conn
+	defer func() {
+		for _, b := range servers {
+			b.Close()
+		}
+	}()
+	newSession := func(idle, lifetime time.Duration) *cloneProxy {
+		a, b := net.Pipe()
+		servers = append(servers, b)
+		config := &sessionConfig{sessionIdleTimeout: idle, maxSessionLifetime: lifetime}
+		p := &cloneProxy{ctx: context.Background(), config: config, serverDone: make(chan struct{}), lastActivity: time.Now().UnixNano()}
+		p.client = jsonrpc2.NewConn(p.ctx, jsonrpc2.NewBufferedStream(a, jsonrpc2.VSCodeObjectCodec{}), nil)
+		return p
+	}
+
+	p := newSession(20*time.Millisecond, 0)
+	if reason := p.waitForEnd(); reason != endIdleTimeout {
+		t.Errorf("expected %s, got %s", endIdleTimeout, reason)
+	}
+
+	// A session handling a request is not idle.
+	p = newSession(20*time.Millisecond, 100*time.Millisecond)
+	atomic.AddInt32(&p.inFlight, 1)
+	if reason := p.waitForEnd(); reason != endMaxLifetime {
+		t.Errorf("expected %s, got %s", endMaxLifetime, reason)
+	}
+	if reason := p.endReason.Load(); reason != endMaxLifetime {
+		t.Errorf("expected the end reason %s to be recorded, got %v", endMaxLifetime, reason)
+	}
+
+	p = newSession(0, 0)
+	p.client.Close()
+	if reason := p.waitForEnd(); reason != endClientDisconnected {
+		t.Errorf("expected %s, got %s", endClientDisconnected, reason)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// codeServerBusy is the JSON-RPC error code sent to clients which are
+// rejected because lsp-adapter is handling too many sessions. It is in the
+// range reserved for implementation-defined server errors.
+const codeServerBusy = -32000
+
+var (
+	errQueueFull    = errors.New("too many sessions: the session queue is full")
+	errQueueTimeout = errors.New("too many sessions: timed out waiting in the session queue")
+)
+
+// sessionLimiter bounds the number of sessions that are active at once (see
+// -maxSessions), and the number of sessions that are cloning their
+// workspace at once (see -maxCloningSessions). Sessions over the limit wait
+// in a bounded queue.
+type sessionLimiter struct {
+	active  chan struct{} // semaphore for active sessions, nil if unlimited
+	cloning chan struct{} // semaphore for cloning sessions, nil if unlimited
+	queue   chan struct{} // the slots of the queue
+	timeout time.Duration // how long a session waits in the queue
+
+	mu    sync.Mutex
+	stats limiterStats
+}
+
+type limiterStats struct {
+	admitted       int           // sessions which became active
+	queued         int           // sessions which had to wait in the queue
+	rejected       int           // sessions rejected because the queue was full
+	timedOut       int           // sessions rejected because they waited too long
+	totalWait      time.Duration // time spent in the queue by sessions which became active
+	maxWait        time.Duration
+	lastWait       time.Duration
+	cloneWaits     int // clones which had to wait for another one to finish
+	totalCloneWait time.Duration
+}
+
+func newSessionLimiter(maxSessions, maxCloning, queueSize int, timeout time.Duration) *sessionLimiter {
+	l := &sessionLimiter{
+		queue:   make(chan struct{}, queueSize),
+		timeout: timeout,
+	}
+	if maxSessions > 0 {
+		l.active = make(chan struct{}, maxSessions)
+	}
+	if maxCloning > 0 {
+		l.cloning = make(chan struct{}, maxCloning)
+	}
+	return l
+}
+
+// acquire blocks until a new session may become active. It returns a
+// function that must be called when the session ends, or errQueueFull or
+// errQueueTimeout if the session is rejected.
+func (l *sessionLimiter) acquire(ctx context.Context) (release func(), err error) {
+	if l.active == nil {
+		l.admitted(0)
+		return func() {}, nil
+	}
+	release = func() { <-l.active }
+
+	select {
+	case l.active <- struct{}{}:
+		l.admitted(0)
+		return release, nil
+	default:
+	}
+
+	select {
+	case l.queue <- struct{}{}:
+	default:
+		l.mu.Lock()
+		l.stats.rejected++
+		l.mu.Unlock()
+		return nil, errQueueFull
+	}
+	defer func() { <-l.queue }()
+
+	l.mu.Lock()
+	l.stats.queued++
+	l.mu.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.active <- struct{}{}:
+		l.admitted(time.Since(start))
+		return release, nil
+	case <-timer.C:
+		l.mu.Lock()
+		l.stats.timedOut++
+		l.mu.Unlock()
+		return nil, errQueueTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *sessionLimiter) admitted(wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stats.admitted++
+	l.stats.totalWait += wait
+	l.stats.lastWait = wait
+	if wait > l.stats.maxWait {
+		l.stats.maxWait = wait
+	}
+}
+
+// full reports whether the maximum number of sessions is active, so that
+// new sessions have to wait in the queue.
+func (l *sessionLimiter) full() bool {
+	return l.active != nil && len(l.active) >= cap(l.active)
+}
+
+// acquireClone blocks until the session may clone its workspace. It returns
+// a function that must be called once the clone is done.
+func (l *sessionLimiter) acquireClone(ctx context.Context) (release func(), err error) {
+	if l.cloning == nil {
+		return func() {}, nil
+	}
+	release = func() { <-l.cloning }
+
+	select {
+	case l.cloning <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	start := time.Now()
+	select {
+	case l.cloning <- struct{}{}:
+		l.mu.Lock()
+		l.stats.cloneWaits++
+		l.stats.totalCloneWait += time.Since(start)
+		l.mu.Unlock()
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// writeStats writes the current state of the limiter in a human readable
+// form to w. It is shown on the debug server.
+func (l *sessionLimiter) writeStats(w io.Writer) {
+	l.mu.Lock()
+	stats := l.stats
+	l.mu.Unlock()
+
+	limit := func(sem chan struct{}) string {
+		if sem == nil {
+			return "unlimited"
+		}
+		return fmt.Sprintf("%d/%d", len(sem), cap(sem))
+	}
+	avg := func(total time.Duration, n int) time.Duration {
+		if n == 0 {
+			return 0
+		}
+		return total / time.Duration(n)
+	}
+
+	fmt.Fprintf(w, "active sessions:    %s\n", limit(l.active))
+	fmt.Fprintf(w, "cloning sessions:   %s\n", limit(l.cloning))
+	fmt.Fprintf(w, "queue depth:        %d/%d\n", len(l.queue), cap(l.queue))
+	fmt.Fprintf(w, "queue timeout:      %s\n", l.timeout)
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "admitted sessions:  %d\n", stats.admitted)
+	fmt.Fprintf(w, "queued sessions:    %d\n", stats.queued)
+	fmt.Fprintf(w, "rejected (full):    %d\n", stats.rejected)
+	fmt.Fprintf(w, "rejected (timeout): %d\n", stats.timedOut)
+	fmt.Fprintf(w, "average wait:       %s\n", avg(stats.totalWait, stats.admitted))
+	fmt.Fprintf(w, "max wait:           %s\n", stats.maxWait)
+	fmt.Fprintf(w, "last wait:          %s\n", stats.lastWait)
+	fmt.Fprintf(w, "clone waits:        %d\n", stats.cloneWaits)
+	fmt.Fprintf(w, "average clone wait: %s\n", avg(stats.totalCloneWait, stats.cloneWaits))
+}
+
+// rejectSession tells the client on conn that its session was rejected
+// because of err: requests (in particular 'initialize') are answered with
+// an error with code. The connection is closed after the 'initialize' request, or
+// once the client has had a minute to send it.
+func rejectSession(ctx context.Context, conn net.Conn, code int64, err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	done := make(chan struct{})
+	var once sync.Once
+	client := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(conn, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2HandlerFunc(func(ctx context.Context, c *jsonrpc2.Conn, req *jsonrpc2.Request) {
+		if req.Notif {
+			return
+		}
+		if replyErr := c.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{Code: code, Message: err.Error()}); replyErr != nil {
+			rootLogger.with("remote_addr", conn.RemoteAddr()).warnf("rejectSession(): sending error reply failed: %s", replyErr)
+		}
+		if req.Method == "initialize" {
+			once.Do(func() { close(done) })
+		}
+	}))
+	defer client.Close()
+
+	select {
+	case <-done:
+	case <-client.DisconnectNotify():
+	case <-ctx.Done():
+	}
+}
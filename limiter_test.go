@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionLimiter(t *testing.T) {
+	ctx := context.Background()
+	l := newSessionLimiter(1, 0, 1, 50*time.Millisecond)
+
+	releaseA, err := l.acquire(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// B waits in the queue until A is done.
+	admittedB := make(chan error)
+	go func() {
+		_, err := l.acquire(ctx)
+		admittedB <- err
+	}()
+	for {
+		l.mu.Lock()
+		queued := l.stats.queued
+		l.mu.Unlock()
+		if queued == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// C is rejected since the queue is full.
+	if _, err := l.acquire(ctx); err != errQueueFull {
+		t.Errorf("expected errQueueFull, got %v", err)
+	}
+
+	releaseA()
+	if err := <-admittedB; err != nil {
+		t.Fatal(err)
+	}
+
+	// D waits in the queue, but B takes too long.
+	if _, err := l.acquire(ctx); err != errQueueTimeout {
+		t.Errorf("expected errQueueTimeout, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	l.writeStats(&buf)
+	for _, want := range []string{"active sessions:    1/1", "admitted sessions:  2", "rejected (full):    1", "rejected (timeout): 1"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected stats to contain %q, got:\n%s", want, buf.String())
+		}
+	}
+}
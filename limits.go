@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// byteSize is a flag.Value for sizes in bytes with an optional K, M or G
+// suffix (powers of 1024).
+type byteSize uint64
+
+func (b *byteSize) String() string {
+	return strconv.FormatUint(uint64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	mult := uint64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return errors.Errorf("invalid size %q", s)
+	}
+	*b = byteSize(n * mult)
+	return nil
+}
+
+func (b *byteSize) Get() interface{} {
+	return *b
+}
+
+func byteSizeFlag(name string, usage string) *byteSize {
+	b := new(byteSize)
+	flag.Var(b, name, usage)
+	return b
+}
+
+// resourceLimits are the limits applied to each language server process,
+// set by the -rlimit* and -cgroup* flags.
+type resourceLimits struct {
+	as              byteSize
+	cpu             time.Duration
+	noFile          int
+	cgroupParent    string
+	cgroupMemoryMax string
+	cgroupCPUMax    string
+}
+
+// enabled reports whether any of the limits is set.
+func (l *resourceLimits) enabled() bool {
+	return l.as > 0 || l.cpu > 0 || l.noFile > 0 || l.cgroupParent != ""
+}
+
+// cpuSeconds converts d to the whole seconds RLIMIT_CPU is specified in,
+// rounding up.
+func cpuSeconds(d time.Duration) uint64 {
+	return uint64((d + time.Second - 1) / time.Second)
+}
+
+// status describes how the process exited for logging. It must only be
+// called once exited is closed.
+func (p *lsProcess) status() string {
+	if p.limitExceeded == "" {
+		return exitStatus(p.waitErr)
+	}
+	return fmt.Sprintf("%s, the process %s", exitStatus(p.waitErr), p.limitExceeded)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// setupResourceLimits checks the resource limits when the configuration is
+// loaded, and enables the cgroup controllers needed for -cgroupMemoryMax and
+// -cgroupCPUMax in -cgroupParent.
+func setupResourceLimits(l *resourceLimits) error {
+	if l.cgroupParent == "" {
+		if l.cgroupMemoryMax != "" || l.cgroupCPUMax != "" {
+			return errors.New("-cgroupMemoryMax and -cgroupCPUMax require -cgroupParent")
+		}
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(l.cgroupParent, "cgroup.controllers")); err != nil {
+		return errors.Wrapf(err, "-cgroupParent=%q is not a cgroup v2 directory", l.cgroupParent)
+	}
+	var controllers []string
+	if l.cgroupMemoryMax != "" {
+		controllers = append(controllers, "+memory")
+	}
+	if l.cgroupCPUMax != "" {
+		controllers = append(controllers, "+cpu")
+	}
+	if len(controllers) > 0 {
+		if err := ioutil.WriteFile(filepath.Join(l.cgroupParent, "cgroup.subtree_control"), []byte(strings.Join(controllers, " ")), 0644); err != nil {
+			return errors.Wrapf(err, "enabling the %s controllers in -cgroupParent=%q failed", strings.Join(controllers, " "), l.cgroupParent)
+		}
+	}
+	return nil
+}
+
+// applyResourceLimits applies the -rlimit* flags to the language server
+// process p which has just been started, and moves it into a cgroup of its
+// own below -cgroupParent. Since this happens after the process started,
+// processes it spawns right away may escape the limits.
+func applyResourceLimits(p *lsProcess) error {
+	pid := p.cmd.Process.Pid
+	l := &p.settings.limits
+
+	if l.as > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_AS, uint64(l.as), uint64(l.as)); err != nil {
+			return errors.Wrap(err, "setting RLIMIT_AS failed")
+		}
+	}
+	if l.cpu > 0 {
+		// The process receives SIGXCPU at the soft limit, and SIGKILL at
+		// the hard limit in case it ignores that.
+		secs := cpuSeconds(l.cpu)
+		if err := prlimit(pid, syscall.RLIMIT_CPU, secs, secs+5); err != nil {
+			return errors.Wrap(err, "setting RLIMIT_CPU failed")
+		}
+	}
+	if l.noFile > 0 {
+		if err := prlimit(pid, syscall.RLIMIT_NOFILE, uint64(l.noFile), uint64(l.noFile)); err != nil {
+			return errors.Wrap(err, "setting RLIMIT_NOFILE failed")
+		}
+	}
+
+	if l.cgroupParent == "" {
+		return nil
+	}
+	dir := filepath.Join(l.cgroupParent, fmt.Sprintf("lsp-adapter-%d", pid))
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return errors.Wrap(err, "creating cgroup failed")
+	}
+	p.cgroup = dir
+
+	var files [][2]string
+	if l.cgroupMemoryMax != "" {
+		// memory.oom.group makes the kernel kill the whole language
+		// server (not just one of its processes) when it runs out of
+		// memory.
+		files = append(files, [2]string{"memory.max", l.cgroupMemoryMax}, [2]string{"memory.oom.group", "1"})
+	}
+	if l.cgroupCPUMax != "" {
+		files = append(files, [2]string{"cpu.max", l.cgroupCPUMax})
+	}
+	files = append(files, [2]string{"cgroup.procs", strconv.Itoa(pid)})
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f[0]), []byte(f[1]), 0644); err != nil {
+			return errors.Wrapf(err, "writing %s of cgroup failed", f[0])
+		}
+	}
+	return nil
+}
+
+func prlimit(pid int, resource int, cur, max uint64) error {
+	limit := syscall.Rlimit{Cur: cur, Max: max}
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(&limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// checkResourceLimits is called once p has exited. If the kernel killed it
+// because it exceeded one of its resource limits, it returns a description
+// of what happened.
+func (p *lsProcess) checkResourceLimits() string {
+	l := &p.settings.limits
+	if p.cgroup != "" && cgroupEvent(p.cgroup, "memory.events", "oom_kill") > 0 {
+		return fmt.Sprintf("was killed by the kernel for exceeding its memory limit (-cgroupMemoryMax=%s)", l.cgroupMemoryMax)
+	}
+
+	state := p.cmd.ProcessState
+	if state == nil {
+		return ""
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return ""
+	}
+	switch status.Signal() {
+	case syscall.SIGXCPU:
+		return fmt.Sprintf("was killed by the kernel for exceeding its CPU time limit (-rlimitCPU=%s)", l.cpu)
+	case syscall.SIGKILL:
+		if l.cpu > 0 && state.UserTime()+state.SystemTime() >= time.Duration(cpuSeconds(l.cpu))*time.Second {
+			return fmt.Sprintf("was killed by the kernel for exceeding its CPU time limit (-rlimitCPU=%s)", l.cpu)
+		}
+		if atomic.LoadInt32(&p.killing) == 0 {
+			return "was killed with SIGKILL by someone other than lsp-adapter, most likely by the kernel because the system ran out of memory"
+		}
+	}
+	return ""
+}
+
+// cgroupEvent returns the value of key in the flat keyed file name (e.x.
+// memory.events) of the cgroup dir, or 0 if it can't be read.
+func cgroupEvent(dir, name, key string) int {
+	b, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			n, _ := strconv.Atoi(fields[1])
+			return n
+		}
+	}
+	return 0
+}
+
+// removeCgroup kills anything left in the cgroup of p once it has exited,
+// and removes the cgroup.
+func (p *lsProcess) removeCgroup() {
+	if p.cgroup == "" {
+		return
+	}
+	// cgroup.kill only exists since Linux 5.14, older kernels rely on
+	// killProcessGroup.
+	_ = ioutil.WriteFile(filepath.Join(p.cgroup, "cgroup.kill"), []byte("1"), 0644)
+
+	deadline := time.Now().Add(p.settings.shutdownGrace)
+	for {
+		err := os.Remove(p.cgroup)
+		if err == nil || os.IsNotExist(err) {
+			return
+		}
+		if time.Now().After(deadline) {
+			p.logger().warnf("CloneProxy: removing cgroup %s of language server failed: %s", p.cgroup, err)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/go-langserver/pkg/lsp"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+func TestApplyResourceLimits(t *testing.T) {
+	_, restore := captureLogs("logfmt")
+	defer restore()
+
+	// The limits are only applied once the process has started, so the
+	// shell waits for them before printing its limit.
+	cmd := exec.Command("sh", "-c", "read x; ulimit -n")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := captureOutput(cmd, true, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := &serverSettings{limits: resourceLimits{noFile: 64}}
+	proc, err := startLSProcess(cmd, output, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(stdin, "\n")
+	<-proc.exited
+
+	if proc.waitErr != nil {
+		t.Fatal(proc.describeExit())
+	}
+	if lines := output.tail(0); len(lines) != 1 || lines[0] != "64" {
+		t.Errorf("got the output %q, want the RLIMIT_NOFILE 64", lines)
+	}
+}
+
+func TestResourceLimitsRequireCommand(t *testing.T) {
+	fs := copyFlagSet(flag.CommandLine)
+	if err := fs.Parse([]string{"-rlimitNOFILE=64", "-lspAddress=tcp://127.0.0.1:7658"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := newSessionConfig(fs, profileSettings{command: fs.Args()})
+	if err == nil || !strings.Contains(err.Error(), "resource limits can only be applied to language servers started by lsp-adapter") {
+		t.Errorf("got %v, want the error for limits without a command", err)
+	}
+}
+
+func TestCheckResourceLimits(t *testing.T) {
+	_, restore := captureLogs("logfmt")
+	defer restore()
+
+	cmd := exec.Command("sleep", "60")
+	output, err := captureOutput(cmd, true, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc, err := startLSProcess(cmd, output, &serverSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Kill(cmd.Process.Pid, syscall.SIGKILL)
+	<-proc.exited
+
+	if want := "was killed with SIGKILL by someone other than lsp-adapter"; !strings.HasPrefix(proc.limitExceeded, want) {
+		t.Errorf("got %q, want it to start with %q", proc.limitExceeded, want)
+	}
+}
+
+func TestResourceLimitExceeded(t *testing.T) {
+	_, restore := captureLogs("logfmt")
+	defer restore()
+	ctx := context.Background()
+
+	fs := copyFlagSet(flag.CommandLine)
+	env, cmdArgs := helperLanguageServer("spin")
+	if err := fs.Parse(append([]string{"-rlimitCPU=1s", "-shutdownGracePeriod=100ms"}, cmdArgs...)); err != nil {
+		t.Fatal(err)
+	}
+	config, err := newSessionConfig(fs, profileSettings{command: fs.Args(), env: env})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan string, 10)
+	client, done, teardown := serveTestSession(t, config, func(req *jsonrpc2.Request) interface{} {
+		var params lsp.ShowMessageParams
+		if req.Method == "window/showMessage" && json.Unmarshal(*req.Params, &params) == nil {
+			messages <- params.Message
+		}
+		return nil
+	})
+	defer teardown()
+	if err := client.Call(ctx, "initialize", lsp.InitializeParams{RootURI: "file:///"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The request the language server was killed in the middle of fails
+	// with the reason, which the client is also told about.
+	want := "was killed by the kernel for exceeding its CPU time limit (-rlimitCPU=1s)"
+	err = client.Call(ctx, "test/spin", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "the language server "+want) {
+		t.Errorf("got the error %v, want it to explain that the language server %s", err, want)
+	}
+	select {
+	case msg := <-messages:
+		if !strings.HasPrefix(msg, "The language server (pid ") || !strings.HasSuffix(msg, want+".") {
+			t.Errorf("got the message %q, want it to say the language server %s", msg, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("timed out waiting for the window/showMessage notification")
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the session to end with the language server")
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "github.com/pkg/errors"
+
+func setupResourceLimits(l *resourceLimits) error {
+	if l.enabled() || l.cgroupMemoryMax != "" || l.cgroupCPUMax != "" {
+		return errors.New("resource limits for the language server are only supported on Linux")
+	}
+	return nil
+}
+
+func applyResourceLimits(p *lsProcess) error {
+	return nil
+}
+
+func (p *lsProcess) checkResourceLimits() string {
+	return ""
+}
+
+func (p *lsProcess) removeCgroup() {}
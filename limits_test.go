@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestByteSize(t *testing.T) {
+	cases := map[string]byteSize{
+		"0":    0,
+		"4096": 4096,
+		"512K": 512 << 10,
+		"2M":   2 << 20,
+		"1G":   1 << 30,
+	}
+	for s, want := range cases {
+		var b byteSize
+		if err := b.Set(s); err != nil {
+			t.Errorf("Set(%q) failed: %s", s, err)
+			continue
+		}
+		if b != want {
+			t.Errorf("Set(%q) = %d, want %d", s, b, want)
+		}
+	}
+
+	for _, s := range []string{"", "G", "1T", "-1", "1.5G"} {
+		var b byteSize
+		if err := b.Set(s); err == nil {
+			t.Errorf("expected Set(%q) to fail", s)
+		}
+	}
+}
+
+func TestCPUSeconds(t *testing.T) {
+	cases := map[time.Duration]uint64{
+		time.Second:             1,
+		1500 * time.Millisecond: 2,
+		time.Minute:             60,
+	}
+	for d, want := range cases {
+		if got := cpuSeconds(d); got != want {
+			t.Errorf("cpuSeconds(%s) = %d, want %d", d, got, want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// listen listens on rawAddr, which is host:port, tcp://host:port or
+// unix:///path/to/socket. A socket file left behind by a previous run is
+// removed first.
+func listen(rawAddr string) (net.Listener, error) {
+	network, address := "tcp", rawAddr
+	if strings.Contains(rawAddr, "://") {
+		u, err := url.Parse(rawAddr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid listen address %q", rawAddr)
+		}
+		switch u.Scheme {
+		case "tcp":
+			address = u.Host
+		case "unix":
+			network, address = "unix", u.Path
+		default:
+			return nil, errors.Errorf("unsupported scheme %q in listen address %q (expected tcp or unix)", u.Scheme, rawAddr)
+		}
+		if address == "" {
+			return nil, errors.Errorf("listen address %q is missing the host:port or socket path", rawAddr)
+		}
+	}
+
+	if network == "unix" {
+		if fi, err := os.Stat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	return net.Listen(network, address)
+}
+
+// connBackend returns the backend of a session accepted by a
+// backendListener for backend: the one in the path of a WebSocket
+// connection, or else backend.
+func connBackend(conn net.Conn, backend string) string {
+	if c, ok := conn.(*websocketConn); ok && c.backend != "" {
+		return c.backend
+	}
+	return backend
+}
+
+// websocketListener accepts client connections over WebSocket. Each
+// WebSocket message carries one JSON-RPC message (without the Content-Length
+// header). Clients connecting to /<backend> use that backend, and clients
+// connecting to / are routed by their mode.
+type websocketListener struct {
+	lis      net.Listener
+	server   *http.Server
+	upgrader websocket.Upgrader
+	known    func(backend string) bool // reports whether a backend exists
+
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newWebsocketListener serves WebSocket connections on lis. Unless origins
+// is empty, browsers may connect from these origins ("*" allows any) in
+// addition to the adapter's own.
+func newWebsocketListener(lis net.Listener, origins []string, known func(backend string) bool) *websocketListener {
+	l := &websocketListener{
+		lis:    lis,
+		known:  known,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	if len(origins) > 0 {
+		l.upgrader.CheckOrigin = func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			for _, o := range origins {
+				if o == "*" || o == origin {
+					return true
+				}
+			}
+			u, err := url.Parse(origin)
+			return origin == "" || (err == nil && u.Host == r.Host)
+		}
+	}
+	l.server = &http.Server{Handler: l}
+	go l.server.Serve(lis)
+	return l
+}
+
+func (l *websocketListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	backend := strings.Trim(r.URL.Path, "/")
+	if backend != "" && !l.known(backend) {
+		http.NotFound(w, r)
+		return
+	}
+	ws, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has replied with an error.
+		rootLogger.warnf("CloneProxy: WebSocket upgrade from %s failed: %s", r.RemoteAddr, err)
+		return
+	}
+	c := &websocketConn{ws: ws, backend: backend, header: r.Header}
+	select {
+	case l.conns <- c:
+	case <-l.closed:
+		c.Close()
+	}
+}
+
+func (l *websocketListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("the WebSocket listener has been closed")
+	}
+}
+
+// Close stops accepting connections. Connections which have already been
+// accepted are not affected.
+func (l *websocketListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.server.Close()
+	})
+	return err
+}
+
+func (l *websocketListener) Addr() net.Addr {
+	return l.lis.Addr()
+}
+
+// websocketConn is a net.Conn over a WebSocket connection, which converts
+// between WebSocket messages and the Content-Length framing of the
+// connections to clients.
+type websocketConn struct {
+	ws      *websocket.Conn
+	backend string      // the backend in the path the client connected to, if any
+	header  http.Header // the headers of the WebSocket handshake
+
+	r io.Reader // the rest of the current message, including its header
+
+	wmu  sync.Mutex
+	wbuf []byte // written data which does not form a complete message yet
+}
+
+func (c *websocketConn) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			_, r, err := c.ws.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			data, err := ioutil.ReadAll(r)
+			if err != nil {
+				return 0, err
+			}
+			header := "Content-Length: " + strconv.Itoa(len(data)) + "\r\n\r\n"
+			c.r = io.MultiReader(strings.NewReader(header), bytes.NewReader(data))
+		}
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *websocketConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wbuf = append(c.wbuf, b...)
+	for {
+		msg, rest, err := nextMessage(c.wbuf)
+		if err != nil {
+			return 0, err
+		}
+		if msg == nil {
+			return len(b), nil
+		}
+		if err := c.ws.WriteMessage(websocket.TextMessage, msg); err != nil {
+			return 0, err
+		}
+		c.wbuf = rest
+	}
+}
+
+// nextMessage returns the body of the first complete message in buf (in
+// the Content-Length framing) and what follows it, or a nil body if buf
+// doesn't contain a complete message yet.
+func nextMessage(buf []byte) (msg, rest []byte, err error) {
+	end := bytes.Index(buf, []byte("\r\n\r\n"))
+	if end < 0 {
+		return nil, buf, nil
+	}
+	length := -1
+	for _, line := range strings.Split(string(buf[:end]), "\r\n") {
+		if i := strings.IndexByte(line, ':'); i >= 0 && strings.EqualFold(strings.TrimSpace(line[:i]), "Content-Length") {
+			length, err = strconv.Atoi(strings.TrimSpace(line[i+1:]))
+			if err != nil {
+				return nil, buf, errors.Wrap(err, "invalid Content-Length header")
+			}
+		}
+	}
+	if length < 0 {
+		return nil, buf, errors.New("missing Content-Length header")
+	}
+	start := end + len("\r\n\r\n")
+	if len(buf) < start+length {
+		return nil, buf, nil
+	}
+	return buf[start : start+length], buf[start+length:], nil
+}
+
+func (c *websocketConn) Close() error {
+	c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return c.ws.Close()
+}
+
+func (c *websocketConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *websocketConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *websocketConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *websocketConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *websocketConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+func TestNextMessage(t *testing.T) {
+	buf := []byte("Content-Length: 2\r\nContent-Type: application/vscode-jsonrpc\r\n\r\n{}Content-Length: 4\r\n\r\nnu")
+	msg, rest, err := nextMessage(buf)
+	if err != nil || string(msg) != "{}" {
+		t.Fatalf("got %q, %v, want the first message", msg, err)
+	}
+	if msg, _, err := nextMessage(rest); err != nil || msg != nil {
+		t.Fatalf("got %q, %v for an incomplete message", msg, err)
+	}
+	if _, _, err := nextMessage([]byte("Content-Type: text\r\n\r\n{}")); err == nil {
+		t.Error("expected an error for a message without Content-Length")
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets are not supported everywhere on Windows")
+	}
+	tmp, err := ioutil.TempDir("", "listen-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, "lsp.sock")
+
+	// A socket left behind by a previous run doesn't get in the way.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	lis, err := listen("unix://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		if conn, err := lis.Accept(); err == nil {
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if b, _ := ioutil.ReadAll(conn); string(b) != "ok" {
+		t.Errorf("got %q, want ok", b)
+	}
+
+	if _, err := listen("http://localhost:8080"); err == nil {
+		t.Error("expected an error for an unsupported scheme")
+	}
+}
+
+func TestWebsocketListener(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis := newWebsocketListener(tcp, nil, func(backend string) bool { return backend == "css" })
+	defer lis.Close()
+
+	url := "ws://" + lis.Addr().String()
+	if _, resp, err := websocket.DefaultDialer.Dial(url+"/go", nil); err == nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown backend, got %v", err)
+	}
+
+	client, _, err := websocket.DefaultDialer.Dial(url+"/css", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if backend := connBackend(conn, ""); backend != "css" {
+		t.Errorf("got backend %q, want css", backend)
+	}
+
+	// Messages from the client are read with their Content-Length header.
+	if err := client.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`)); err != nil {
+		t.Fatal(err)
+	}
+	var req jsonrpc2.Request
+	if err := (jsonrpc2.VSCodeObjectCodec{}).ReadObject(bufio.NewReader(conn), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != "initialize" {
+		t.Errorf("got method %q, want initialize", req.Method)
+	}
+
+	// Messages to the client are sent as one WebSocket message each, even if
+	// they are written in pieces.
+	if err := (jsonrpc2.VSCodeObjectCodec{}).WriteObject(conn, map[string]int{"id": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := client.ReadMessage(); err != nil || string(msg) != `{"id":1}` {
+		t.Errorf("got message %q, %v", msg, err)
+	}
+}
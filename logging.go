@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	if int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+	return strconv.Itoa(int(l))
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, errors.Errorf("unknown log level %q, expected one of %s", s, strings.Join(levelNames, ", "))
+}
+
+var (
+	minLogLevel = int32(levelInfo) // accessed atomically, see setLogLevel
+	logFmt      = "text"           // text, json or logfmt, set by setupLogging
+	logOutMu    sync.Mutex         // serializes writes to logOut
+	logOut      io.Writer          = os.Stderr
+)
+
+// setupLogging configures the output of the loggers (and of the log
+// package) according to -logFormat and -logLevel.
+func setupLogging(format, level string) error {
+	switch format {
+	case "text":
+	case "json", "logfmt":
+		// Lines logged with the log package are passed on as messages at
+		// the info level, see stdLogWriter.
+		log.SetFlags(log.Lshortfile)
+		log.SetOutput(stdLogWriter{})
+	default:
+		return errors.Errorf("unknown log format %q, expected text, json or logfmt", format)
+	}
+	logFmt = format
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	setLogLevel(l)
+	return nil
+}
+
+func setLogLevel(l logLevel) {
+	atomic.StoreInt32(&minLogLevel, int32(l))
+}
+
+func currentLogLevel() logLevel {
+	return logLevel(atomic.LoadInt32(&minLogLevel))
+}
+
+// logger writes log messages with a set of fields (e.x. the session ID) in
+// the format set by -logFormat.
+type logger struct {
+	fields []interface{} // alternating keys (strings) and values
+}
+
+var rootLogger = &logger{}
+
+// with returns a logger which adds the fields keyvals (alternating keys
+// and values) to the fields of l.
+func (l *logger) with(keyvals ...interface{}) *logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	return &logger{fields: append(fields, keyvals...)}
+}
+
+func (l *logger) debugf(format string, args ...interface{}) {
+	l.output(levelDebug, 2, fmt.Sprintf(format, args...))
+}
+
+func (l *logger) infof(format string, args ...interface{}) {
+	l.output(levelInfo, 2, fmt.Sprintf(format, args...))
+}
+
+func (l *logger) warnf(format string, args ...interface{}) {
+	l.output(levelWarn, 2, fmt.Sprintf(format, args...))
+}
+
+func (l *logger) errorf(format string, args ...interface{}) {
+	l.output(levelError, 2, fmt.Sprintf(format, args...))
+}
+
+// output logs msg at level. calldepth is the number of stack frames to skip
+// to find the caller, or 0 to log no caller.
+func (l *logger) output(level logLevel, calldepth int, msg string) {
+	if level < currentLogLevel() {
+		return
+	}
+	if logFmt == "text" {
+		var b strings.Builder
+		if level != levelInfo {
+			b.WriteString(strings.ToUpper(level.String()) + " ")
+		}
+		b.WriteString(msg)
+		b.WriteString(formatFields(l.fields))
+		log.Output(calldepth+1, b.String())
+		return
+	}
+
+	var caller string // omitted for calldepth 0
+	if calldepth > 0 {
+		caller = "???"
+		if _, file, line, ok := runtime.Caller(calldepth); ok {
+			caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+		}
+	}
+	writeLogEntry(time.Now(), level, caller, msg, l.fields)
+}
+
+func writeLogEntry(t time.Time, level logLevel, caller, msg string, fields []interface{}) {
+	var b bytes.Buffer
+	if logFmt == "json" {
+		// Build the object by hand to keep the order of the keys.
+		b.WriteString("{")
+		writeJSONField(&b, "time", t.UTC().Format(time.RFC3339Nano))
+		b.WriteString(",")
+		writeJSONField(&b, "level", level.String())
+		b.WriteString(",")
+		if caller != "" {
+			writeJSONField(&b, "caller", caller)
+			b.WriteString(",")
+		}
+		writeJSONField(&b, "msg", msg)
+		for i := 0; i+1 < len(fields); i += 2 {
+			b.WriteString(",")
+			writeJSONField(&b, fmt.Sprint(fields[i]), fields[i+1])
+		}
+		b.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&b, "time=%s level=%s", t.UTC().Format(time.RFC3339Nano), level)
+		if caller != "" {
+			fmt.Fprintf(&b, " caller=%s", caller)
+		}
+		fmt.Fprintf(&b, " msg=%s", logfmtValue(msg))
+		b.WriteString(formatFields(fields))
+		b.WriteString("\n")
+	}
+
+	logOutMu.Lock()
+	logOut.Write(b.Bytes())
+	logOutMu.Unlock()
+}
+
+func writeJSONField(b *bytes.Buffer, key string, value interface{}) {
+	writeJSON(b, key)
+	b.WriteString(":")
+	switch v := value.(type) {
+	case json.RawMessage:
+		b.Write(v)
+		return
+	case error:
+		value = v.Error()
+	case fmt.Stringer:
+		value = v.String()
+	}
+	if err := writeJSON(b, value); err != nil {
+		writeJSON(b, fmt.Sprint(value))
+	}
+}
+
+// writeJSON writes v to b without escaping HTML characters, which are
+// common in messages (e.x. "-->").
+func writeJSON(b *bytes.Buffer, v interface{}) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return err
+	}
+	b.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	return nil
+}
+
+// logfmtValue formats v as a logfmt value, quoting it if necessary.
+func logfmtValue(v interface{}) string {
+	var s string
+	if m, ok := v.(json.RawMessage); ok {
+		s = string(m)
+	} else {
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\\\n\t") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// formatFields formats fields as " key=value" pairs in the logfmt format,
+// leaving out the keys in skip.
+func formatFields(fields []interface{}, skip ...string) string {
+	var b strings.Builder
+fields:
+	for i := 0; i+1 < len(fields); i += 2 {
+		for _, key := range skip {
+			if fields[i] == key {
+				continue fields
+			}
+		}
+		fmt.Fprintf(&b, " %s=%s", fields[i], logfmtValue(fields[i+1]))
+	}
+	return b.String()
+}
+
+// stdLogWriter passes lines written by the log package (with the
+// log.Lshortfile flag) on to writeLogEntry.
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	caller := "???"
+	if i := strings.Index(line, ": "); i >= 0 {
+		caller, line = line[:i], line[i+2:]
+	}
+	writeLogEntry(time.Now(), levelInfo, caller, line, nil)
+	return len(p), nil
+}
+
+// logMessages returns the ConnOpt tracing the messages of a session on its
+// connection to peer ("client" or "server") for -trace: in the text format
+// this is jsonrpc2.LogMessages with lines prefixed with "TRACE <session ID>
+// <peer>", in the other formats each message is logged with the fields of l,
+// the peer and its method and request ID.
+func logMessages(l *logger, sessionID, peer string) jsonrpc2.ConnOpt {
+	if logFmt == "text" {
+		return jsonrpc2.LogMessages(log.New(os.Stderr, fmt.Sprintf("TRACE %s %s ", sessionID, peer), log.Ltime))
+	}
+	l = l.with("component", "trace", "peer", peer)
+	return func(c *jsonrpc2.Conn) {
+		// Remember the methods of the requests received to show them for
+		// the responses sent.
+		var (
+			mu      sync.Mutex
+			methods = map[jsonrpc2.ID]string{}
+		)
+		logMessage := func(direction string, req *jsonrpc2.Request, resp *jsonrpc2.Response) {
+			switch {
+			case req != nil && resp == nil:
+				fields := []interface{}{"method", req.Method}
+				if !req.Notif {
+					fields = append(fields, "request_id", formatID(req.ID))
+				}
+				l.with(append(fields, "params", rawJSON(req.Params))...).output(levelInfo, 0, direction+" request")
+			case resp != nil:
+				// Responses received come with the request we sent, the
+				// ones sent are looked up by the ID of the request received
+				// (the IDs of both directions may overlap).
+				var method string
+				if req != nil {
+					method = req.Method
+				} else {
+					mu.Lock()
+					method = methods[resp.ID]
+					delete(methods, resp.ID)
+					mu.Unlock()
+				}
+				fields := []interface{}{"method", method, "request_id", formatID(resp.ID)}
+				if resp.Error != nil {
+					fields = append(fields, "error", resp.Error.Message)
+				} else {
+					fields = append(fields, "result", rawJSON(resp.Result))
+				}
+				l.with(fields...).output(levelInfo, 0, direction+" response")
+			}
+		}
+		jsonrpc2.OnRecv(func(req *jsonrpc2.Request, resp *jsonrpc2.Response) {
+			if req != nil && resp == nil && !req.Notif {
+				mu.Lock()
+				methods[req.ID] = req.Method
+				mu.Unlock()
+			}
+			logMessage("-->", req, resp)
+		})(c)
+		jsonrpc2.OnSend(func(req *jsonrpc2.Request, resp *jsonrpc2.Response) {
+			logMessage("<--", req, resp)
+		})(c)
+	}
+}
+
+// rawJSON returns *m, or null if m is nil.
+func rawJSON(m *json.RawMessage) json.RawMessage {
+	if m == nil {
+		return json.RawMessage("null")
+	}
+	return *m
+}
+
+type loggerContextKey struct{}
+
+// withLogger returns a copy of ctx carrying l.
+func withLogger(ctx context.Context, l *logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, l)
+}
+
+// loggerFrom returns the logger carried by ctx, or rootLogger.
+func loggerFrom(ctx context.Context) *logger {
+	if l, ok := ctx.Value(loggerContextKey{}).(*logger); ok {
+		return l
+	}
+	return rootLogger
+}
+
+// repoFields returns the repo and rev fields for the 'originalRootUri' (e.x.
+// git://github.com/foo/bar?abc) of the 'initialize' request with params.
+func repoFields(params *json.RawMessage) []interface{} {
+	if params == nil {
+		return nil
+	}
+	var p struct {
+		OriginalRootURI string `json:"originalRootUri"`
+	}
+	if err := json.Unmarshal(*params, &p); err != nil || p.OriginalRootURI == "" {
+		return nil
+	}
+	u, err := url.Parse(p.OriginalRootURI)
+	if err != nil {
+		return []interface{}{"repo", p.OriginalRootURI}
+	}
+	fields := []interface{}{"repo", u.Host + u.Path}
+	if u.RawQuery != "" {
+		fields = append(fields, "rev", u.RawQuery)
+	}
+	return fields
+}
+
+// serveLogLevel shows the current log level, and changes it to the level
+// passed in the 'level' form value of POST requests.
+func serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.Method == "POST" || r.Method == "PUT" {
+		level, err := parseLogLevel(r.FormValue("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		old := currentLogLevel()
+		setLogLevel(level)
+		rootLogger.infof("Changed the log level from %s to %s", old, level)
+	}
+	fmt.Fprintln(w, currentLogLevel())
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+)
+
+// captureLogs sets the log format to format and returns the buffer the log
+// entries are written to, and a function which restores the previous
+// logging settings.
+func captureLogs(format string) (*bytes.Buffer, func()) {
+	oldFmt, oldOut, oldLevel := logFmt, logOut, currentLogLevel()
+	var buf bytes.Buffer
+	logFmt, logOut = format, &buf
+	setLogLevel(levelInfo)
+	return &buf, func() {
+		logFmt, logOut = oldFmt, oldOut
+		setLogLevel(oldLevel)
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	buf, restore := captureLogs("json")
+	defer restore()
+
+	l := rootLogger.with("session", "abc").with("repo", "github.com/foo/bar")
+	l.debugf("not logged")
+	l.warnf("hello %s", "world")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected a single JSON object, got %q: %s", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"level":   "warn",
+		"msg":     "hello world",
+		"session": "abc",
+		"repo":    "github.com/foo/bar",
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("got %s=%v, want %v", k, entry[k], v)
+		}
+	}
+	if caller, _ := entry["caller"].(string); !strings.HasPrefix(caller, "logging_test.go:") {
+		t.Errorf("got caller %q, want logging_test.go:<line>", caller)
+	}
+}
+
+func TestLoggerLogfmt(t *testing.T) {
+	buf, restore := captureLogs("logfmt")
+	defer restore()
+
+	setLogLevel(levelDebug)
+	rootLogger.with("method", "textDocument/hover", "request_id", 1).debugf("a \"quoted\" message")
+
+	line := buf.String()
+	for _, want := range []string{
+		"level=debug ",
+		` msg="a \"quoted\" message"`,
+		" method=textDocument/hover request_id=1\n",
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("expected %q to contain %q", line, want)
+		}
+	}
+}
+
+func TestStdLogWriter(t *testing.T) {
+	buf, restore := captureLogs("logfmt")
+	defer restore()
+
+	logger := log.New(stdLogWriter{}, "", log.Lshortfile)
+	logger.Println("from the log package")
+
+	line := buf.String()
+	if !strings.Contains(line, " level=info caller=logging_test.go:") || !strings.Contains(line, ` msg="from the log package"`) {
+		t.Errorf("unexpected log entry %q", line)
+	}
+}
+
+func TestRepoFields(t *testing.T) {
+	params := json.RawMessage(`{"rootUri":"file:///","originalRootUri":"git://github.com/foo/bar?deadbeef"}`)
+	got := repoFields(&params)
+	want := []interface{}{"repo", "github.com/foo/bar", "rev", "deadbeef"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+
+	if got := repoFields(nil); got != nil {
+		t.Errorf("got %v for no params, want nil", got)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// The metrics exposed in the Prometheus text format at /metrics on the debug
+// server.
+var (
+	metricSessionsActive  = newMetric("lsp_adapter_sessions_active", "gauge", "Number of sessions which are currently active.")
+	metricSessionsStarted = newMetric("lsp_adapter_sessions_started_total", "counter", "Number of sessions which were started.")
+	metricSessionsEnded   = newMetric("lsp_adapter_sessions_ended_total", "counter", "Number of sessions which ended, by the reason they ended.", "reason")
+	metricAuthFailures    = newMetric("lsp_adapter_auth_failures_total", "counter", "Number of sessions rejected because the client failed to authenticate, by reason (missing, invalid or expired token, or error if it couldn't be checked).", "reason")
+
+	metricCloneDuration = newHistogram("lsp_adapter_clone_duration_seconds", "Time it took to clone the workspace of a session.", []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300})
+	metricCloneFiles    = newHistogram("lsp_adapter_clone_files", "Number of files cloned per session.", []float64{1, 10, 100, 1000, 10000, 100000})
+	metricCloneBytes    = newHistogram("lsp_adapter_clone_bytes", "Number of bytes cloned per session.", []float64{1 << 10, 10 << 10, 100 << 10, 1 << 20, 10 << 20, 100 << 20, 1 << 30})
+
+	metricHookDuration = newHistogram("lsp_adapter_hook_duration_seconds", "Time it took to run the beforeInitializeHook, by its exit status.", []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600}, "exit_status")
+
+	metricRequests        = newMetric("lsp_adapter_requests_total", "counter", "Number of requests and notifications received, by direction (client_to_server or server_to_client) and method.", "direction", "method")
+	metricRequestErrors   = newMetric("lsp_adapter_request_errors_total", "counter", "Number of requests answered with an error, by direction and method.", "direction", "method")
+	metricRequestDuration = newHistogram("lsp_adapter_request_duration_seconds", "Time it took to answer requests, by direction and method.", []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}, "direction", "method")
+
+	metricServerRestarts = newMetric("lsp_adapter_server_restarts_total", "counter", "Number of times a language server was restarted after it exited unexpectedly.")
+	metricServerExits    = newMetric("lsp_adapter_server_exits_total", "counter", "Number of language server processes which exited, by exit status.", "exit_status")
+)
+
+var (
+	metricsMu sync.Mutex
+	metrics   []*metric
+)
+
+// maxMethods bounds the number of distinct methods metrics are recorded
+// for, since clients and language servers can send anything. Further
+// methods are recorded as "other".
+const maxMethods = 200
+
+// metric is a counter, gauge or histogram with an optional set of labels.
+type metric struct {
+	name    string
+	typ     string
+	help    string
+	labels  []string
+	buckets []float64 // upper bounds of the buckets of a histogram
+
+	mu     sync.Mutex
+	series map[string]*series // label values joined by \xff -> series
+}
+
+type series struct {
+	labelValues []string
+	value       float64  // the value of a counter or gauge, the sum of a histogram
+	counts      []uint64 // the number of observations per bucket of a histogram
+	count       uint64
+}
+
+func newMetric(name, typ, help string, labels ...string) *metric {
+	m := &metric{name: name, typ: typ, help: help, labels: labels, series: map[string]*series{}}
+	metricsMu.Lock()
+	metrics = append(metrics, m)
+	metricsMu.Unlock()
+	return m
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	m := newMetric(name, "histogram", help, labels...)
+	m.buckets = buckets
+	return m
+}
+
+// seriesLocked returns the series for labelValues, creating it if needed.
+func (m *metric) seriesLocked(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues}
+		if m.buckets != nil {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add adds v to the counter or gauge with labelValues.
+func (m *metric) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	m.seriesLocked(labelValues).value += v
+	m.mu.Unlock()
+}
+
+func (m *metric) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+// observe records the observation v in the histogram with labelValues.
+func (m *metric) observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.seriesLocked(labelValues)
+	for i, bound := range m.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+func (m *metric) observeDuration(start time.Time, labelValues ...string) {
+	m.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// write writes m in the Prometheus text format to w.
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.typ)
+	if len(m.labels) == 0 && len(m.series) == 0 && m.buckets == nil {
+		// Report unlabeled counters and gauges before their first update.
+		fmt.Fprintf(w, "%s 0\n", m.name)
+		return
+	}
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	bucketLabels := append(append([]string(nil), m.labels...), "le")
+	for _, key := range keys {
+		s := m.series[key]
+		labels := formatLabels(m.labels, s.labelValues)
+		if m.buckets == nil {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labels, formatValue(s.value))
+			continue
+		}
+		bucket := func(le string) string {
+			return formatLabels(bucketLabels, append(append([]string(nil), s.labelValues...), le))
+		}
+		for i, bound := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, bucket(formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, bucket("+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, s.count)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, v)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeMetrics writes all metrics in the Prometheus text format to w.
+func writeMetrics(w io.Writer) {
+	metricsMu.Lock()
+	all := append([]*metric(nil), metrics...)
+	metricsMu.Unlock()
+	sort.Slice(all, func(i, j int) bool { return all[i].name < all[j].name })
+	for _, m := range all {
+		m.write(w)
+	}
+}
+
+var (
+	methodsMu sync.Mutex
+	methods   = map[string]bool{}
+)
+
+// methodLabel returns the value of the method label for method.
+func methodLabel(method string) string {
+	methodsMu.Lock()
+	defer methodsMu.Unlock()
+	if !methods[method] {
+		if len(methods) >= maxMethods {
+			return "other"
+		}
+		methods[method] = true
+	}
+	return method
+}
+
+// exitStatusLabel returns the value of the exit_status label for the error
+// returned by waiting for a process: its exit code, the signal that killed
+// it, or "error" if it could not be run.
+func exitStatusLabel(waitErr error) string {
+	if waitErr == nil {
+		return "0"
+	}
+	exitErr, ok := waitErr.(*exec.ExitError)
+	if !ok {
+		return "error"
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return "error"
+	}
+	if status.Signaled() {
+		return "signal: " + status.Signal().String()
+	}
+	return strconv.Itoa(status.ExitStatus())
+}
+
+// measureRequests records the requests the other side sends on a
+// connection in the request metrics for direction (client_to_server or
+// server_to_client).
+func measureRequests(direction string) jsonrpc2.ConnOpt {
+	return func(c *jsonrpc2.Conn) {
+		type pending struct {
+			method string
+			start  time.Time
+		}
+		var (
+			mu       sync.Mutex
+			requests = map[jsonrpc2.ID]pending{}
+		)
+
+		jsonrpc2.OnRecv(func(req *jsonrpc2.Request, resp *jsonrpc2.Response) {
+			if req == nil || resp != nil {
+				return
+			}
+			method := methodLabel(req.Method)
+			metricRequests.inc(direction, method)
+			if req.Notif {
+				return
+			}
+			mu.Lock()
+			requests[req.ID] = pending{method: method, start: time.Now()}
+			mu.Unlock()
+		})(c)
+		jsonrpc2.OnSend(func(req *jsonrpc2.Request, resp *jsonrpc2.Response) {
+			if resp == nil {
+				return
+			}
+			mu.Lock()
+			p, ok := requests[resp.ID]
+			delete(requests, resp.ID)
+			mu.Unlock()
+			if !ok {
+				return
+			}
+			if resp.Error != nil {
+				metricRequestErrors.inc(direction, p.method)
+			}
+			metricRequestDuration.observeDuration(p.start, direction, p.method)
+		})(c)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+func TestMetricWrite(t *testing.T) {
+	counter := &metric{name: "test_total", typ: "counter", help: "Test.", labels: []string{"method"}, series: map[string]*series{}}
+	counter.inc(`a"b`)
+	counter.add(2, "c")
+
+	histogram := &metric{name: "test_seconds", typ: "histogram", help: "Test.", buckets: []float64{1, 10}, series: map[string]*series{}}
+	histogram.observe(0.5)
+	histogram.observe(5)
+
+	var buf bytes.Buffer
+	counter.write(&buf)
+	histogram.write(&buf)
+	want := `# HELP test_total Test.
+# TYPE test_total counter
+test_total{method="a\"b"} 1
+test_total{method="c"} 2
+# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="1"} 1
+test_seconds_bucket{le="10"} 2
+test_seconds_bucket{le="+Inf"} 2
+test_seconds_sum 5.5
+test_seconds_count 2
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestExitStatusLabel(t *testing.T) {
+	if got := exitStatusLabel(nil); got != "0" {
+		t.Errorf("got %q for nil, want 0", got)
+	}
+	if got := exitStatusLabel(errors.New("not found")); got != "error" {
+		t.Errorf("got %q for an error starting the process, want error", got)
+	}
+	if runtime.GOOS == "windows" {
+		return
+	}
+	if got := exitStatusLabel(exec.Command("sh", "-c", "exit 3").Run()); got != "3" {
+		t.Errorf("got %q for exit 3, want 3", got)
+	}
+	if got := exitStatusLabel(exec.Command("sh", "-c", "kill -9 $$").Run()); got != "signal: killed" {
+		t.Errorf("got %q for SIGKILL, want signal: killed", got)
+	}
+}
+
+func TestMeasureRequests(t *testing.T) {
+	ctx := context.Background()
+	a, b := net.Pipe()
+	server := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(a, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2HandlerFunc(func(ctx context.Context, c *jsonrpc2.Conn, req *jsonrpc2.Request) {
+		if req.Notif {
+			return
+		}
+		if req.Method == "fail" {
+			c.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{Message: "failed"})
+			return
+		}
+		c.Reply(ctx, req.ID, nil)
+	}), measureRequests("test_direction"))
+	defer server.Close()
+	client := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(b, jsonrpc2.VSCodeObjectCodec{}), nil)
+	defer client.Close()
+
+	client.Call(ctx, "test/ok", nil, nil)
+	client.Call(ctx, "test/ok", nil, nil)
+	client.Call(ctx, "fail", nil, nil)
+
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	for _, want := range []string{
+		`lsp_adapter_requests_total{direction="test_direction",method="test/ok"} 2`,
+		`lsp_adapter_request_errors_total{direction="test_direction",method="fail"} 1`,
+		`lsp_adapter_request_duration_seconds_count{direction="test_direction",method="test/ok"} 2`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected the metrics to contain %s, got\n%s", want, buf.String())
+		}
+	}
+}
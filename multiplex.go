@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+
+	"github.com/sourcegraph/go-langserver/pkg/lsp"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// handleDocumentSync keeps track of the documents the session opens and
+// closes with the 'textDocument/didOpen' and 'textDocument/didClose'
+// notification req. Since the language server may be shared with other
+// sessions, it returns true only if req should be passed on to it: for the
+// first session to open a document, and the last one to close it.
+func (p *cloneProxy) handleDocumentSync(req *jsonrpc2.Request) bool {
+	if req.Params == nil {
+		return true
+	}
+	var params struct {
+		TextDocument struct {
+			URI lsp.DocumentURI `json:"uri"`
+		} `json:"textDocument"`
+	}
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		return true
+	}
+	uri := params.TextDocument.URI
+	ws := p.workspace()
+
+	p.docsMu.Lock()
+	defer p.docsMu.Unlock()
+	switch req.Method {
+	case "textDocument/didOpen":
+		p.openDocs[uri]++
+		return ws.openDocument(uri)
+	case "textDocument/didClose":
+		if p.openDocs[uri] == 0 {
+			// Not opened by this session, so it's not ours to close.
+			return false
+		}
+		p.openDocs[uri]--
+		if p.openDocs[uri] == 0 {
+			delete(p.openDocs, uri)
+		}
+		return ws.closeDocument(uri)
+	}
+	return true
+}
+
+// closeDocuments closes the documents the session left open in ws. The
+// language server is sent 'textDocument/didClose' for the ones no other
+// session has open.
+func (p *cloneProxy) closeDocuments(ws *workspace) {
+	p.docsMu.Lock()
+	openDocs := p.openDocs
+	p.openDocs = map[lsp.DocumentURI]int{}
+	p.docsMu.Unlock()
+
+	server := ws.serverConn()
+	for uri, n := range openDocs {
+		for i := 0; i < n; i++ {
+			if !ws.closeDocument(uri) || server == nil {
+				continue
+			}
+			err := server.Notify(context.Background(), "textDocument/didClose", &lsp.DidCloseTextDocumentParams{
+				TextDocument: lsp.TextDocumentIdentifier{URI: clientToServerURI(uri, ws.dir)},
+			})
+			if err != nil {
+				p.logger().warnf("CloneProxy.closeDocuments(): sending didClose failed: %s", err)
+			}
+		}
+	}
+}
+
+// namespaceCancelRequest returns a copy of the '$/cancelRequest'
+// notification req which refers to the namespaced ID the request to cancel
+// was sent to the language server with.
+func (p *cloneProxy) namespaceCancelRequest(req *jsonrpc2.Request) *jsonrpc2.Request {
+	if req.Params == nil {
+		return req
+	}
+	var params struct {
+		ID jsonrpc2.ID `json:"id"`
+	}
+	if err := json.Unmarshal(*req.Params, &params); err != nil {
+		return req
+	}
+	params.ID = namespaceID(p.sessionID.String(), params.ID)
+	b, err := json.Marshal(params)
+	if err != nil {
+		return req
+	}
+	rawParams := json.RawMessage(b)
+
+	namespaced := *req
+	namespaced.Params = &rawParams
+	return &namespaced
+}
+
+// namespaceID returns a string ID made up of ns and id.
+func namespaceID(ns string, id jsonrpc2.ID) jsonrpc2.ID {
+	s := id.Str
+	if !id.IsString {
+		s = strconv.FormatUint(id.Num, 10)
+	}
+	return jsonrpc2.ID{
+		Str:      ns + "/" + s,
+		IsString: true,
+	}
+}
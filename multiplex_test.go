@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sourcegraph/go-langserver/pkg/lsp"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+func TestHandleDocumentSync(t *testing.T) {
+	ws := newWorkspace(context.Background(), "/ws", &sessionConfig{}, nil)
+	newSession := func() *cloneProxy {
+		return &cloneProxy{ws: ws, openDocs: map[lsp.DocumentURI]int{}}
+	}
+	notif := func(method string) *jsonrpc2.Request {
+		params := json.RawMessage(`{"textDocument": {"uri": "file:///a.go"}}`)
+		return &jsonrpc2.Request{Method: method, Params: &params, Notif: true}
+	}
+
+	p1, p2 := newSession(), newSession()
+	steps := []struct {
+		p      *cloneProxy
+		method string
+		want   bool
+	}{
+		{p1, "textDocument/didOpen", true},
+		{p2, "textDocument/didOpen", false},
+		{p1, "textDocument/didClose", false},
+		{p1, "textDocument/didClose", false}, // not open in p1 anymore
+		{p2, "textDocument/didClose", true},
+		{p2, "textDocument/didOpen", true},
+	}
+	for i, s := range steps {
+		if got := s.p.handleDocumentSync(notif(s.method)); got != s.want {
+			t.Errorf("step %d: %s forwarded = %v, want %v", i, s.method, got, s.want)
+		}
+	}
+
+	// The session's documents are closed when it goes away.
+	p2.closeDocuments(ws)
+	if got := p1.handleDocumentSync(notif("textDocument/didOpen")); !got {
+		t.Error("expected didOpen to be forwarded after the other session closed its documents")
+	}
+}
+
+func TestNamespaceCancelRequest(t *testing.T) {
+	p := &cloneProxy{sessionID: uuid.Must(uuid.Parse("6ba7b810-9dad-11d1-80b4-00c04fd430c8"))}
+	params := json.RawMessage(`{"id": 3}`)
+	req := p.namespaceCancelRequest(&jsonrpc2.Request{Method: "$/cancelRequest", Params: &params, Notif: true})
+
+	want := `{"id":"6ba7b810-9dad-11d1-80b4-00c04fd430c8/3"}`
+	if got := string(*req.Params); got != want {
+		t.Errorf("got params %s, want %s", got, want)
+	}
+}
+
+func TestServeMultiplex(t *testing.T) {
+	_, restore := captureLogs("logfmt")
+	defer restore()
+	restoreCacheDir := useTempCacheDir(t)
+	defer restoreCacheDir()
+	oldMultiplex := *multiplex
+	*multiplex = true
+	defer func() { *multiplex = oldMultiplex }()
+	ctx := context.Background()
+
+	// The fake language server counts the initialize requests it receives.
+	var initializes int32
+	servers := make(chan *jsonrpc2.Conn, 2)
+	config := testSessionConfig(t, "-shutdownGracePeriod=100ms", "fake-language-server")
+	config.connectLS = func(ctx context.Context, data lsTemplateData, dir string) (io.ReadWriteCloser, error) {
+		a, b := net.Pipe()
+		servers <- jsonrpc2.NewConn(context.Background(), jsonrpc2.NewBufferedStream(b, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2HandlerFunc(func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+			switch {
+			case req.Notif:
+			case req.Method == "initialize":
+				atomic.AddInt32(&initializes, 1)
+				conn.Reply(ctx, req.ID, map[string]interface{}{"capabilities": map[string]interface{}{"hoverProvider": true}})
+			default:
+				conn.Reply(ctx, req.ID, nil)
+			}
+		}))
+		return a, nil
+	}
+
+	// Each client has an empty workspace, records the other messages it
+	// receives and answers requests with its name.
+	s := &sessionServer{workspaces: newWorkspaceRegistry(0, 0, true), limiter: newSessionLimiter(0, 0, 0, 0), sessions: &sessionList{}}
+	received := make(chan string, 10)
+	newClient := func(name string) (*jsonrpc2.Conn, <-chan struct{}) {
+		return connectTestClient(s, config, func(req *jsonrpc2.Request) interface{} {
+			if req.Method == "workspace/xfiles" {
+				return []lsp.TextDocumentIdentifier{}
+			}
+			received <- name + " " + req.Method
+			return name
+		})
+	}
+	expect := func(want ...string) {
+		var got []string
+		for range want {
+			select {
+			case msg := <-received:
+				got = append(got, msg)
+			case <-time.After(10 * time.Second):
+				t.Fatalf("timed out waiting for %q, got %q", want, got)
+			}
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	client1, done1 := newClient("client1")
+	defer func() {
+		client1.Close()
+		<-done1
+	}()
+	params := lsp.InitializeParams{RootURI: "file:///"}
+	if err := client1.Call(ctx, "initialize", params, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := client1.Notify(ctx, "initialized", struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	server := <-servers
+
+	// The second client's initialize request is answered with the result of
+	// the first one, without starting another language server.
+	client2, done2 := newClient("client2")
+	defer func() {
+		client2.Close()
+		<-done2
+	}()
+	var result lsp.InitializeResult
+	if err := client2.Call(ctx, "initialize", params, &result); err != nil {
+		t.Fatal(err)
+	}
+	if !result.Capabilities.HoverProvider {
+		t.Errorf("got %+v, want the capabilities of the shared language server", result.Capabilities)
+	}
+	if n := atomic.LoadInt32(&initializes); n != 1 {
+		t.Errorf("expected the language server to be initialized once, got %d initialize requests", n)
+	}
+	select {
+	case <-servers:
+		t.Error("expected the second session to share the language server of the first one")
+	default:
+	}
+
+	// Notifications reach every client, requests the one which has been
+	// connected the longest.
+	if err := server.Notify(ctx, "window/logMessage", lsp.LogMessageParams{Message: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	expect("client1 window/logMessage", "client2 window/logMessage")
+	var answer string
+	if err := server.Call(ctx, "window/showMessageRequest", lsp.ShowMessageRequestParams{Message: "ok?"}, &answer); err != nil {
+		t.Fatal(err)
+	}
+	if answer != "client1" {
+		t.Errorf("got the answer of %q, want that of client1", answer)
+	}
+	expect("client1 window/showMessageRequest")
+
+	// Once the first client is gone, requests go to the second one.
+	client1.Close()
+	if err := server.Call(ctx, "window/showMessageRequest", lsp.ShowMessageRequestParams{Message: "ok?"}, &answer); err != nil {
+		t.Fatal(err)
+	}
+	if answer != "client2" {
+		t.Errorf("got the answer of %q, want that of client2", answer)
+	}
+	expect("client2 window/showMessageRequest")
+}
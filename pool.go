@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// serverPool keeps a number of idle language servers running, so that new
+// sessions don't have to wait for a language server to start up. The idle
+// language servers have not been sent anything yet, they are just waiting for
+// the 'initialize' request of the session which takes them.
+type serverPool struct {
+	connect func(ctx context.Context) (io.ReadWriteCloser, error)
+	idle    chan io.ReadWriteCloser
+	wg      sync.WaitGroup
+}
+
+// newServerPool starts size language servers with connect, and replaces each
+// one as soon as a session takes it from the pool. The pool shuts down once
+// ctx is done.
+func newServerPool(ctx context.Context, size int, connect func(ctx context.Context) (io.ReadWriteCloser, error)) *serverPool {
+	sp := &serverPool{
+		connect: connect,
+		idle:    make(chan io.ReadWriteCloser),
+	}
+	sp.wg.Add(size)
+	for i := 0; i < size; i++ {
+		go func() {
+			defer sp.wg.Done()
+			sp.fill(ctx)
+		}()
+	}
+	return sp
+}
+
+// wait waits for the pool to shut down the idle language servers once its
+// context is done.
+func (sp *serverPool) wait() {
+	sp.wg.Wait()
+}
+
+// fill keeps one idle language server ready until ctx is done.
+func (sp *serverPool) fill(ctx context.Context) {
+	backoff := 100 * time.Millisecond
+	for {
+		lsConn, err := sp.connect(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			loggerFrom(ctx).errorf("CloneProxy: starting language server for the pool failed, retrying in %s: %s", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = 100 * time.Millisecond
+
+		select {
+		case sp.idle <- lsConn:
+		case <-ctx.Done():
+			lsConn.Close()
+			return
+		}
+	}
+}
+
+// get returns an idle language server from the pool. If none is ready yet,
+// it starts a new one instead of waiting. It is an lsConnector, but the pool
+// can only be used if the language server command does not depend on the
+// session, so data and dir are ignored.
+func (sp *serverPool) get(ctx context.Context, data lsTemplateData, dir string) (io.ReadWriteCloser, error) {
+	for {
+		select {
+		case lsConn := <-sp.idle:
+			if proc := lsProcessOf(lsConn); proc != nil {
+				select {
+				case <-proc.exited:
+					loggerFrom(ctx).warnf("CloneProxy: discarding language server (pid %d) from the pool which exited while idle: %s", proc.cmd.Process.Pid, proc.status())
+					lsConn.Close()
+					continue
+				default:
+				}
+			}
+			return lsConn, nil
+		default:
+			return sp.connect(ctx)
+		}
+	}
+}
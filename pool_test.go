@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServerPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var started int32
+	connect := func(ctx context.Context) (io.ReadWriteCloser, error) {
+		atomic.AddInt32(&started, 1)
+		a, _ := net.Pipe()
+		return a, nil
+	}
+
+	sp := newServerPool(ctx, 2, connect)
+
+	waitForStarted := func(want int32) {
+		deadline := time.Now().Add(5 * time.Second)
+		for atomic.LoadInt32(&started) < want {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d language servers to be started, actual %d", want, atomic.LoadInt32(&started))
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// The pool fills up in the background.
+	waitForStarted(2)
+
+	for i := 0; i < 2; i++ {
+		if _, err := sp.get(ctx, lsTemplateData{}, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Taking from the pool refills it.
+	waitForStarted(4)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// listeningPortsSupported reports whether listeningPort can discover the
+// port of a language server, so that -lspAddress may use port 0 without
+// -lspPortPattern.
+const listeningPortsSupported = true
+
+// listeningPort returns a TCP port which a process of the process group pgid
+// listens on, or 0 if none of them does (yet). The sockets of the processes
+// are looked up in /proc/<pid>/net/tcp{,6}, which lists the sockets of the
+// network namespace of the process.
+func listeningPort(pgid int) int {
+	pids := processGroupPIDs(pgid)
+	inodes := make(map[string]bool)
+	for _, pid := range pids {
+		dir := filepath.Join("/proc", strconv.Itoa(pid), "fd")
+		fds, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue // the process has exited
+		}
+		for _, fd := range fds {
+			target, err := os.Readlink(filepath.Join(dir, fd.Name()))
+			if err == nil && strings.HasPrefix(target, "socket:[") {
+				inodes[strings.TrimSuffix(strings.TrimPrefix(target, "socket:["), "]")] = true
+			}
+		}
+	}
+	if len(inodes) == 0 {
+		return 0
+	}
+
+	for _, pid := range pids {
+		for _, name := range []string{"tcp", "tcp6"} {
+			if port := listeningPortIn(filepath.Join("/proc", strconv.Itoa(pid), "net", name), inodes); port != 0 {
+				return port
+			}
+		}
+	}
+	return 0
+}
+
+// listeningPortIn returns the local port of the first socket in LISTEN state
+// of the /proc/net/tcp{,6} file filename whose inode is one of inodes, or 0.
+func listeningPortIn(filename string, inodes map[string]bool) int {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	// Each line after the header is "sl local_address rem_address st ...",
+	// with the inode as the tenth field. Addresses are hex-encoded ip:port
+	// and 0A is the LISTEN state.
+	scanner := bufio.NewScanner(f)
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != "0A" || !inodes[fields[9]] {
+			continue
+		}
+		i := strings.LastIndexByte(fields[1], ':')
+		if port, err := strconv.ParseUint(fields[1][i+1:], 16, 16); err == nil && i >= 0 {
+			return int(port)
+		}
+	}
+	return 0
+}
+
+// processGroupPIDs returns the live processes (not zombies) of the process
+// group pgid.
+func processGroupPIDs(pgid int) []int {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return nil
+	}
+	var pids []int
+	for _, stat := range stats {
+		b, err := ioutil.ReadFile(stat)
+		if err != nil {
+			continue // the process has exited
+		}
+		// The fields after the command, which is in parentheses, are the
+		// state, the parent PID and the process group.
+		fields := strings.Fields(string(b[strings.LastIndexByte(string(b), ')')+1:]))
+		if len(fields) < 3 || fields[0] == "Z" || fields[0] == "X" || fields[2] != strconv.Itoa(pgid) {
+			continue
+		}
+		pid, _ := strconv.Atoi(filepath.Base(filepath.Dir(stat)))
+		pids = append(pids, pid)
+	}
+	return pids
+}
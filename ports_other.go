@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// listeningPortsSupported reports whether listeningPort can discover the
+// port of a language server, so that -lspAddress may use port 0 without
+// -lspPortPattern.
+const listeningPortsSupported = false
+
+func listeningPort(pgid int) int {
+	return 0
+}
@@ -2,10 +2,11 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net"
 	"net/url"
@@ -15,7 +16,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/google/uuid"
 	multierror "github.com/hashicorp/go-multierror"
@@ -25,7 +28,14 @@ import (
 )
 
 var (
-	proxyAddr          = flag.String("proxyAddress", "127.0.0.1:8080", "proxy server listen address (tcp)")
+	proxyAddr          = flag.String("proxyAddress", "127.0.0.1:8080", "proxy server listen address (host:port, tcp://host:port or unix:///path/to/socket)")
+	websocketAddr      = flag.String("websocketAddress", "", "If non-empty, also accept client connections over WebSocket at this address (host:port, tcp://host:port or unix:///path/to/socket). Each WebSocket message carries one JSON-RPC message. With -backends, clients connecting to /<backend> use that backend.")
+	websocketOrigins   = flag.String("websocketOrigins", "", "A comma-separated list of origins browsers may open WebSocket connections (see -websocketAddress) from, or '*' for any origin. By default only the adapter's own origin is allowed.")
+	tlsCertFile        = flag.String("tlsCert", "", "If non-empty, accept client connections (at -proxyAddress, -websocketAddress and the listenAddress of each backend) over TLS with the certificate (and intermediates) in this PEM file. Requires -tlsKey. The certificate is reloaded when the file changes.")
+	tlsKeyFile         = flag.String("tlsKey", "", "The PEM file with the private key of -tlsCert.")
+	tlsClientCAFile    = flag.String("tlsClientCA", "", "If non-empty, clients must present a certificate signed by one of the CAs in this PEM file (mutual TLS). Requires -tlsCert.")
+	authTokenFile      = flag.String("authTokenFile", "", "If non-empty, clients must authenticate with one of the tokens in this file (one per line) before their session starts. See -authHMACKeyFile for how clients present the token. The file is read for each session.")
+	authHMACKeyFile    = flag.String("authHMACKeyFile", "", "If non-empty, clients may authenticate with a token signed with one of the keys in this file (one per line): '<subject>.<expiry>.<signature>', where subject identifies the client (or is a nonce), expiry is a Unix timestamp and signature the unpadded base64url encoded HMAC-SHA256 of '<subject>.<expiry>'. The token is taken from the 'Authorization: Bearer <token>' header of the WebSocket handshake or the first message, or from the authToken field of the initializationOptions. The file is read for each session.")
 	pprofAddr          = flag.String("pprofAddr", "", "server listen address for pprof")
 	cacheDir           *string
 	unresolvedCacheDir = flag.String("cacheDirectory", filepath.Join(os.TempDir(), "proxy-cache"), "cache directory location")
@@ -34,33 +44,326 @@ var (
 	glob               = flag.String("glob", "", "A colon (:) separated list of file globs to sync locally. By default we place all files into the workspace, but some language servers may only look at a subset of files. Specifying this allows us to avoid syncing all files. Note: This is done by basename only.")
 	beforeInitHook     = flag.String("beforeInitializeHook", "", "A program to run after cloning the repository, but before the 'initialize' call is forwarded to the language server. (For example, you can use this to run a script to install dependencies for the project). The program's cwd will be the workspace's cache directory, and it will also be passed the cache directory as an argument.")
 	trace              = flag.Bool("trace", true, "trace logs to stderr")
+	lspAddr            = flag.String("lspAddress", "", "If non-empty, connect to the language server listening on this address (tcp://host:port or unix:///path/to/socket) instead of talking to it over stdio. If LSP_COMMAND_ARGS are also specified, they are used to start the language server for each session before connecting to it.")
+	lspDialTimeout     = flag.Duration("lspDialTimeout", 10*time.Second, "How long to wait for a language server started by lsp-adapter to start listening on -lspAddress.")
+	lspPortPattern     = flag.String("lspPortPattern", "", "A regular expression which is matched against each line of stdout and stderr of the language server to discover the port it listens on when -lspAddress uses port 0. The first submatch must be the port (e.x. 'PORT=(\\d+)'). On Linux, it may be omitted to use the first TCP port the language server listens on.")
+	shutdownGrace      = flag.Duration("shutdownGracePeriod", 5*time.Second, "When a session ends, how long the language server has to exit after the 'shutdown' request and 'exit' notification. It is sent SIGTERM after the first half, and SIGKILL at the end.")
+	maxServerRestarts  = flag.Int("maxServerRestarts", 0, "How many times the language server is restarted within a session if it exits unexpectedly. The restarted language server is sent the original 'initialize' request again, and requests that were in flight are retried once. 0 (the default) disables restarting.")
+	serverPoolSize     = flag.Int("serverPoolSize", 0, "The number of idle language servers to keep running, so that new sessions don't have to wait for the language server to start up. Can't be used together with -lazyStart. 0 (the default) disables the pool.")
+	keepAlive          = flag.Duration("keepAlive", 0, "How long to keep the workspace and language server of a session alive after the session ended, so that new sessions for the same repository (identified by the 'originalRootUri' or 'rootUri' of the 'initialize' request) can reuse them instead of cloning the repository again. 0 (the default) disables keeping them alive.")
+	keepAliveMax       = flag.Int("keepAliveMax", 10, "The maximum number of idle workspaces kept alive by -keepAlive. When a workspace would exceed it, the one that has been idle the longest is removed.")
+	multiplex          = flag.Bool("multiplex", false, "Let concurrent sessions for the same repository (identified by the 'originalRootUri' or 'rootUri' of the 'initialize' request) share one workspace and language server.")
+	maxSessions        = flag.Int("maxSessions", 0, "The maximum number of sessions that are active at once. Further sessions wait in a queue (see -sessionQueueSize) until an active session ends. 0 (the default) means no limit.")
+	maxCloning         = flag.Int("maxCloningSessions", 0, "The maximum number of sessions that clone their workspace at once. Further sessions wait until a clone is done before they start cloning. 0 (the default) means no limit.")
+	sessionQueueSize   = flag.Int("sessionQueueSize", 10, "The maximum number of sessions waiting for an active session to end when -maxSessions is reached. Further sessions are rejected with an error.")
+	sessionQueueWait   = flag.Duration("sessionQueueTimeout", 30*time.Second, "How long a session waits in the queue (see -sessionQueueSize) before it is rejected with an error.")
+	rlimitAS           = byteSizeFlag("rlimitAS", "If non-zero, limit the address space (RLIMIT_AS) of the language server to this many bytes (e.x. '2G'). Linux only.")
+	rlimitCPU          = flag.Duration("rlimitCPU", 0, "If non-zero, limit the CPU time (RLIMIT_CPU) the language server may use. It is killed once it used up this much. Linux only.")
+	rlimitNoFile       = flag.Int("rlimitNOFILE", 0, "If non-zero, limit the number of files the language server can open (RLIMIT_NOFILE). Linux only.")
+	cgroupParent       = flag.String("cgroupParent", "", "If non-empty, each language server is moved into a cgroup of its own below this cgroup v2 directory (e.x. '/sys/fs/cgroup/lsp-adapter'). lsp-adapter must be allowed to create cgroups in it, and it must not contain any processes itself. Linux only.")
+	cgroupMemoryMax    = flag.String("cgroupMemoryMax", "", "If non-empty, the memory.max of the cgroup of each language server (e.x. '1G'). Requires -cgroupParent.")
+	cgroupCPUMax       = flag.String("cgroupCPUMax", "", "If non-empty, the cpu.max of the cgroup of each language server (e.x. '50000 100000' for half a CPU). Requires -cgroupParent.")
+	sessionIdleTimeout = flag.Duration("sessionIdleTimeout", 0, "End sessions whose client hasn't sent anything for this long (while no request is being handled). 0 (the default) disables the timeout.")
+	maxSessionLifetime = flag.Duration("maxSessionLifetime", 0, "End sessions which have been running for this long. 0 (the default) disables the limit.")
+	drainTimeout       = flag.Duration("drainTimeout", 30*time.Second, "When lsp-adapter receives SIGTERM, it stops accepting connections and waits up to this long for the active sessions to end before ending them itself.")
+	healthCheckTimeout = flag.Duration("healthCheckTimeout", 30*time.Second, "How long the language server started by /healthz/deep on the debug server (see -pprofAddr) may take to start and answer the 'initialize' request.")
+	canaryConfigFile   = flag.String("canaryConfig", "", "If non-empty, periodically run a session against the fixture repository described in this JSON file and check the results of the requests it lists. The results are shown on the debug server (see -pprofAddr) at /debug/canary.")
+	canaryInterval     = flag.Duration("canaryInterval", 5*time.Minute, "How long to wait between two probes of the canary (see -canaryConfig).")
+	canaryTimeout      = flag.Duration("canaryTimeout", time.Minute, "How long a probe of the canary (see -canaryConfig) may take.")
+	traceExportFile    = flag.String("traceExportFile", "", "If non-empty, append OpenTelemetry spans (in the OTLP/JSON encoding) with a timing breakdown of each client request to this file.")
+	traceExportURL     = flag.String("traceExportEndpoint", "", "If non-empty, send OpenTelemetry spans with a timing breakdown of each client request to this OTLP/HTTP collector (e.x. 'http://localhost:4318').")
+	logFormat          = flag.String("logFormat", "text", "The format of log messages: text, json or logfmt. json and logfmt messages carry the session ID, repository, method and request ID they belong to as fields.")
+	logLevelFlag       = flag.String("logLevel", "info", "The minimum level of log messages to write: debug, info, warn or error. It can be changed at runtime on the debug server (see -pprofAddr) at /debug/loglevel.")
+	stderrLines        = flag.Int("stderrLines", 100, "The number of lines of language server stderr kept per session. They are shown on the debug server (see -pprofAddr) at /debug/stderr, and the last ones are included in the errors about language servers which exited unexpectedly.")
+	forwardStderr      = flag.Bool("forwardStderr", false, "Forward the lines the language server writes to stderr to the client as 'window/logMessage' notifications.")
+	configFile         = flag.String("config", "", "If non-empty, read settings from this JSON config file. The profile (see -profile) sets the language server command and environment, and any of these flags. Flags passed on the command line and environment variables (e.x. LSP_ADAPTER_GLOB for -glob) take precedence over the config file.")
+	profileName        = flag.String("profile", "", "The profile of the -config file to use. Defaults to the file's defaultProfile.")
+	initOptionsFlag    = flag.String("initializationOptions", "", "If non-empty, a JSON object whose fields are added to the 'initializationOptions' of the 'initialize' request sent to the language server. Fields sent by the client take precedence.")
+	backendsFlag       = flag.String("backends", "", "A comma-separated list of profiles of the -config file to host in one process. Each session uses one of them, chosen by the 'mode' of its 'initialize' request (the profile's modes, which default to its name), or by the profile's listenAddress the session connected to. The first profile is used for sessions without a mode.")
+	lazyStart          = flag.Bool("lazyStart", false, "Delay starting the language server until the workspace has been cloned and the beforeInitializeHook has run. The language server's cwd will be the workspace's cache directory.")
 )
 
 type cloneProxy struct {
 	client *jsonrpc2.Conn // connection to the browser
-	server *jsonrpc2.Conn // connection to the language server
 
 	sessionID     uuid.UUID      // unique ID for this session
 	lastRequestID *atomicCounter // counter that is incremented for each new request that is sent across the wire for this session
 
-	ready chan struct{} // barrier to block handling requests until the proxy is fully initialized
-	ctx   context.Context
-
-	// HACK
-	didOpenMu sync.Mutex
-	didOpen   map[string]bool
+	ready  chan struct{} // barrier to block handling requests until the proxy is fully initialized
+	ctx    context.Context
+	config *sessionConfig // the configuration that was current when the session started
+
+	lastActivity int64 // when the client last sent something (in Unix nanoseconds), accessed atomically
+	inFlight     int32 // number of client requests being handled, accessed atomically
+	handlersMu   sync.Mutex
+	handlers     sync.WaitGroup // the goroutines handling client requests, see handleAsync
+	ending       bool           // set by waitForReplies once no new client requests are handled
+	endReason    atomic.Value   // why the session ended (string), set by waitForEnd
+
+	wsMu       sync.Mutex         // protects ws
+	ws         *workspace         // the workspace and language server used by this session, use workspace to access it
+	workspaces *workspaceRegistry // workspaces shared by -keepAlive and -multiplex, nil if both are disabled
+	limiter    *sessionLimiter    // bounds the number of sessions cloning at once
+	spans      *spanExporter      // nil unless -traceExportFile or -traceExportEndpoint is used
+
+	logMu      sync.Mutex
+	sessionLog *logger     // logs with the session ID (and repository once known), use logger to access it
+	stderr     *lineBuffer // the last lines the language server wrote to stderr while the session used it
+
+	docsMu   sync.Mutex
+	openDocs map[lsp.DocumentURI]int // the number of times each document is open in this session, see handleDocumentSync
+
+	serverOnce  sync.Once     // protects serverErr and closing serverReady
+	serverReady chan struct{} // barrier to block handling requests until startServer (or reuseWorkspace) has run
+	serverErr   error         // set if the language server could not be connected to
+	serverDone  chan struct{} // closed by endServer once the language server disconnects for good (or failed to connect)
+	doneOnce    sync.Once     // protects closing serverDone
 }
 
+// lsConnector connects to a language server for a session. dir is the cwd
+// to start the language server in, or empty to use the cwd of lsp-adapter.
+type lsConnector func(ctx context.Context, data lsTemplateData, dir string) (io.ReadWriteCloser, error)
+
 func (p *cloneProxy) start() {
 	close(p.ready)
 }
 
+// workspace returns the workspace used by this session.
+func (p *cloneProxy) workspace() *workspace {
+	p.wsMu.Lock()
+	defer p.wsMu.Unlock()
+	return p.ws
+}
+
+// logger returns the logger for the session.
+func (p *cloneProxy) logger() *logger {
+	p.logMu.Lock()
+	defer p.logMu.Unlock()
+	return p.sessionLog
+}
+
+// addLogFields adds the fields keyvals to the messages logged for the
+// session from now on.
+func (p *cloneProxy) addLogFields(keyvals ...interface{}) {
+	if len(keyvals) == 0 {
+		return
+	}
+	p.logMu.Lock()
+	p.sessionLog = p.sessionLog.with(keyvals...)
+	p.logMu.Unlock()
+}
+
+// startServer starts the language server of the session's workspace. Only
+// the first call has an effect, later calls return the result of the first
+// one.
+func (p *cloneProxy) startServer(dir string) error {
+	p.serverOnce.Do(func() {
+		defer close(p.serverReady)
+
+		ws := p.workspace()
+		if err := ws.startServer(dir); err != nil {
+			// The caller ends the session with endServer, once it has
+			// told the client.
+			p.serverErr = err
+			return
+		}
+		go p.watchWorkspace(ws)
+	})
+	return p.serverErr
+}
+
+// endServer ends the session because its language server has gone away (see
+// waitForEnd).
+func (p *cloneProxy) endServer() {
+	p.doneOnce.Do(func() { close(p.serverDone) })
+}
+
+// reuseWorkspace makes the session use ws, a workspace kept alive by
+// -keepAlive or used by other sessions with -multiplex, instead of its own.
+// It returns false if the session has already started a language server.
+func (p *cloneProxy) reuseWorkspace(ws *workspace) bool {
+	reused := false
+	p.serverOnce.Do(func() {
+		defer close(p.serverReady)
+
+		p.wsMu.Lock()
+		own := p.ws
+		p.ws = ws
+		p.wsMu.Unlock()
+
+		own.detach(p)
+		own.close()
+		ws.attach(p)
+		go p.watchWorkspace(ws)
+		reused = true
+	})
+	return reused
+}
+
+// watchWorkspace ends the session once the language server of ws has gone
+// away.
+func (p *cloneProxy) watchWorkspace(ws *workspace) {
+	select {
+	case <-ws.serverDone:
+		p.endServer()
+	case <-p.ctx.Done():
+	}
+}
+
+// waitForServer blocks until startServer has run, and returns its error.
+func (p *cloneProxy) waitForServer() error {
+	<-p.serverReady
+	return p.serverErr
+}
+
+// close closes both sides of the proxy. It prevents the language server from
+// being started (or restarted) if that has not happened yet.
+func (p *cloneProxy) close() {
+	p.client.Close()
+	p.serverOnce.Do(func() {
+		p.serverErr = errors.New("session closed before the language server was started")
+		close(p.serverReady)
+		p.endServer()
+	})
+
+	p.releaseWorkspace(p.workspace())
+}
+
+// releaseWorkspace stops using ws. Unless other sessions are using it or it
+// is kept alive by -keepAlive, the workspace is removed.
+func (p *cloneProxy) releaseWorkspace(ws *workspace) {
+	ws.detach(p)
+	p.closeDocuments(ws)
+	if p.workspaces != nil && p.workspaces.release(ws) {
+		return
+	}
+	ws.close()
+
+	// Remove the cache contents for this workspace after the connection closes
+	ws.cleanWorkspaceCache()
+}
+
 type jsonrpc2HandlerFunc func(context.Context, *jsonrpc2.Conn, *jsonrpc2.Request)
 
 func (h jsonrpc2HandlerFunc) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
 	h(ctx, conn, req)
 }
 
+// sessionServer runs the sessions of lsp-adapter once they have been routed
+// to a backend and admitted by the sessionLimiter.
+type sessionServer struct {
+	workspaces *workspaceRegistry // workspaces shared by -keepAlive and -multiplex, nil if both are disabled
+	limiter    *sessionLimiter
+	spans      *spanExporter // nil unless -traceExportFile or -traceExportEndpoint is used
+	sessions   *sessionList
+}
+
+// serve handles the session of the client connected to clientNetConn with
+// the backend config until it ends.
+func (s *sessionServer) serve(ctx context.Context, clientNetConn net.Conn, config *sessionConfig) {
+	metricSessionsStarted.inc()
+	metricSessionsActive.add(1)
+	defer metricSessionsActive.add(-1)
+
+	sessionID := uuid.New()
+	traceID := sessionID.String()
+	sessionLog := rootLogger.with("session", traceID)
+	if config.name != "" {
+		sessionLog = sessionLog.with("backend", config.name)
+	}
+
+	var serverOpts []jsonrpc2.ConnOpt
+	if *trace {
+		serverOpts = append(serverOpts, logMessages(sessionLog, traceID, "server"))
+	}
+	if *pprofAddr != "" {
+		serverOpts = append(serverOpts, traceRequests(traceID, false), traceEventLog("server", traceID), measureRequests("server_to_client"))
+	}
+
+	// The workspace may outlive the session with -keepAlive, so it
+	// doesn't use the session's context.
+	ws := newWorkspace(ctx, filepath.Join(*cacheDir, traceID), config, serverOpts)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	proxy := &cloneProxy{
+		ready:         make(chan struct{}),
+		ctx:           ctx,
+		config:        config,
+		sessionID:     sessionID,
+		lastRequestID: newAtomicCounter(),
+		ws:            ws,
+		workspaces:    s.workspaces,
+		limiter:       s.limiter,
+		spans:         s.spans,
+		sessionLog:    sessionLog,
+		stderr:        newLineBuffer(config.server.stderrLines),
+		openDocs:      map[lsp.DocumentURI]int{},
+		serverReady:   make(chan struct{}),
+		serverDone:    make(chan struct{}),
+	}
+	// The connection to the client is set up before the session is attached
+	// to the workspace, since the language server can write to stderr (see
+	// handleStderr) as soon as it has started. Requests wait for start.
+	proxy.lastActivity = time.Now().UnixNano()
+	clientOpts := []jsonrpc2.ConnOpt{jsonrpc2.OnRecv(proxy.recordActivity)}
+	if *trace {
+		clientOpts = append(clientOpts, logMessages(sessionLog, traceID, "client"))
+	}
+	if *pprofAddr != "" {
+		clientOpts = append(clientOpts, traceRequests("client "+traceID, true), traceEventLog("client", traceID), measureRequests("client_to_server"))
+	}
+	proxy.client = jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(clientNetConn, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2HandlerFunc(proxy.handleAsync), clientOpts...)
+
+	ws.attach(proxy)
+	s.sessions.add(proxy)
+	defer s.sessions.remove(proxy)
+
+	// With -keepAlive and -multiplex the language server is started once we
+	// know whether there is one to reuse.
+	if !config.lazyStart && s.workspaces == nil {
+		if err := proxy.startServer(""); err != nil {
+			sessionLog.errorf("%s", err)
+			proxy.client.Close()
+			// The requests the client already sent fail, since the
+			// language server isn't there.
+			proxy.start()
+			ws.detach(proxy)
+			ws.close()
+			proxy.waitForRequests()
+			return
+		}
+	}
+
+	proxy.start()
+
+	// When one side of the connection disconnects (or the session expires),
+	// close the other side.
+	reason := proxy.waitForEnd()
+	msg := reason
+	if reason == endServerExited {
+		if proc := proxy.workspace().exitedProcess(); proc != nil {
+			msg += ": " + proc.describeExit()
+		}
+	}
+	proxy.logger().with("reason", reason).infof("Session %s ended: %s", proxy.sessionID, msg)
+	metricSessionsEnded.inc(reason)
+	if reason == endServerExited {
+		// The requests in flight fail now that the language server is
+		// gone, and their errors explain why it exited (see
+		// explainServerError), so the client gets them before it is
+		// disconnected.
+		proxy.waitForReplies(config.server.shutdownGrace)
+	}
+	proxy.close()
+
+	// Requests which are still being handled, e.x. by a language server
+	// shared with other sessions, are canceled.
+	cancel()
+	proxy.waitForRequests()
+}
+
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [OPTIONS] LSP_COMMAND_ARGS...\n\nOptions:\n", os.Args[0])
@@ -69,16 +372,16 @@ func main() {
 
 	flag.Parse()
 	log.SetFlags(log.Flags() | log.Lshortfile)
-
-	lspBin := flag.Args()
-	if len(lspBin) == 0 {
-		log.Fatal("You must specify an LSP command (positional arguments).")
+	if _, err := loadSettings(flag.CommandLine); err != nil {
+		log.Fatalf("Invalid configuration: %s", err)
+	}
+	if err := setupLogging(*logFormat, *logLevelFlag); err != nil {
+		log.Fatal(err)
 	}
 
-	switch *jsonrpc2IDRewrite {
-	case "none", "string", "number":
-	default:
-		log.Fatalf("Invalid jsonrpc2IDRewrite value %q", *jsonrpc2IDRewrite)
+	backends, err := loadBackends()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %s", err)
 	}
 
 	// Ensure the path exists, otherwise symlinks to it cannot be resolved.
@@ -95,93 +398,274 @@ func main() {
 	}
 	cacheDir = &resolvedCacheDir
 
-	lis, err := net.Listen("tcp", *proxyAddr)
+	var tlsConfig *tls.Config
+	if *tlsCertFile != "" || *tlsKeyFile != "" || *tlsClientCAFile != "" {
+		tlsConfig, err = newTLSConfig(*tlsCertFile, *tlsKeyFile, *tlsClientCAFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	// listenClients sets up a listener for clients, with TLS if it is
+	// enabled.
+	listenClients := func(addr string) (net.Listener, error) {
+		lis, err := listen(addr)
+		if err != nil || tlsConfig == nil {
+			return lis, err
+		}
+		return tls.NewListener(lis, tlsConfig), nil
+	}
+
+	lis, err := listenClients(*proxyAddr)
 	if err != nil {
 		err = errors.Wrap(err, "setting up proxy listener failed")
 		log.Fatal(err)
 	}
 
-	log.Printf("CloneProxy: accepting connections at %s", lis.Addr())
+	rootLogger.infof("CloneProxy: accepting connections at %s", lis.Addr())
 
-	if *pprofAddr != "" {
-		go debugServer(*pprofAddr)
+	listeners := []backendListener{{Listener: lis}}
+	for _, b := range backends.backends {
+		if b.listenAddress == "" {
+			continue
+		}
+		lis, err := listenClients(b.listenAddress)
+		if err != nil {
+			log.Fatal(errors.Wrapf(err, "setting up the listener of backend %s failed", b.name))
+		}
+		rootLogger.infof("CloneProxy: accepting connections for backend %s at %s", b.name, lis.Addr())
+		listeners = append(listeners, backendListener{Listener: lis, backend: b.name})
+	}
+
+	auth, err := newAuthenticator(*authTokenFile, *authHMACKeyFile)
+	if err != nil {
+		log.Fatal(err)
 	}
 
+	spans, err := newSpanExporter(*traceExportFile, *traceExportURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	limiter := newSessionLimiter(*maxSessions, *maxCloning, *sessionQueueSize, *sessionQueueWait)
+
 	ctx, cancel := context.WithCancel(context.Background())
+	configs := newConfigReloader(ctx, backends, loadBackends)
 
-	shutdown := func() {
-		cancel()
-		lis.Close()
+	if *websocketAddr != "" {
+		lis, err := listenClients(*websocketAddr)
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "setting up the WebSocket listener failed"))
+		}
+		origins := strings.FieldsFunc(*websocketOrigins, func(r rune) bool { return r == ',' })
+		known := func(backend string) bool { return configs.current().byName(backend) != nil }
+		rootLogger.infof("CloneProxy: accepting WebSocket connections at %s", lis.Addr())
+		listeners = append(listeners, backendListener{Listener: newWebsocketListener(lis, origins, known)})
+	}
 
-		// Remove the entire cache when the program is exiting
-		os.RemoveAll(*cacheDir)
+	health := &healthChecker{limiter: limiter}
+	sessions := &sessionList{}
+	health.checkServer = func(ctx context.Context) error {
+		return checkBackends(ctx, configs.current())
 	}
 
-	defer shutdown()
-	go trapSignalsForShutdown(shutdown)
+	var canaryProbe *canary
+	if *canaryConfigFile != "" {
+		config, files, err := loadCanaryConfig(*canaryConfigFile)
+		if err != nil {
+			log.Fatalf("Invalid -canaryConfig: %s", err)
+		}
+		canaryProbe = &canary{config: config, files: files, timeout: *canaryTimeout}
+	}
 
-	var wg sync.WaitGroup
-	for {
-		clientNetConn, err := lis.Accept()
+	if *pprofAddr != "" {
+		go debugServer(*pprofAddr, limiter, health, canaryProbe, sessions, configs)
+	}
+
+	go trapSignalsForReload(configs.reload)
+
+	var workspaces *workspaceRegistry
+	if *keepAlive > 0 || *multiplex {
+		workspaces = newWorkspaceRegistry(*keepAlive, *keepAliveMax, *multiplex)
+	}
+	server := &sessionServer{workspaces: workspaces, limiter: limiter, spans: spans, sessions: sessions}
+
+	// serveSession handles the session of the client connected to
+	// clientNetConn until it ends. It uses the backend called backend, or
+	// if it is empty the one for the mode of the session.
+	serveSession := func(clientNetConn net.Conn, backend string) {
+		config, clientNetConn, err := configs.current().route(clientNetConn, backend)
 		if err != nil {
-			if ctx.Err() != nil { // shutdown
-				break
-			}
-			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				log.Println("error when accepting client connection: ", err.Error())
-				continue
+			rootLogger.with("remote_addr", clientNetConn.RemoteAddr()).warnf("Rejecting session: %s", err)
+			if _, ok := err.(*noBackendError); ok {
+				rejectSession(ctx, clientNetConn, jsonrpc2.CodeInvalidParams, err)
+			} else {
+				clientNetConn.Close()
 			}
-			log.Fatal(err)
+			return
 		}
 
-		wg.Add(1)
-		go func(clientNetConn net.Conn) {
-			defer wg.Done()
+		release, err := limiter.acquire(ctx)
+		if err != nil {
+			rootLogger.with("remote_addr", clientNetConn.RemoteAddr()).warnf("Rejecting session: %s", err)
+			rejectSession(ctx, clientNetConn, codeServerBusy, err)
+			return
+		}
+		defer release()
 
-			ctx, cancel := context.WithCancel(ctx)
-			defer cancel()
+		server.serve(ctx, clientNetConn, config)
+	}
 
-			var lsConn, err = stdIoLSConn(ctx, lspBin[0], lspBin[1:]...)
-			if err != nil {
-				log.Println("connecting to language server over stdio failed", err.Error())
+	// serveClient handles the connection of a client accepted on a listener
+	// for backend.
+	serveClient := func(clientNetConn net.Conn, backend string) {
+		if err := handshake(clientNetConn); err != nil {
+			rootLogger.warnf("CloneProxy: TLS handshake with %s failed: %s", clientNetConn.RemoteAddr(), err)
+			clientNetConn.Close()
+			return
+		}
+		backend = connBackend(clientNetConn, backend)
+		if auth != nil {
+			var err error
+			if clientNetConn, err = auth.authenticate(clientNetConn); err != nil {
+				rejectUnauthenticated(ctx, clientNetConn, err)
 				return
 			}
+		}
+		serveSession(clientNetConn, backend)
+	}
+	clients := newAcceptor(listeners, serveClient)
 
-			proxy := &cloneProxy{
-				ready:         make(chan struct{}),
-				ctx:           ctx,
-				sessionID:     uuid.New(),
-				lastRequestID: newAtomicCounter(),
-				didOpen:       map[string]bool{},
-			}
-			traceID := proxy.sessionID.String()
+	// shutdown ends all sessions right away.
+	shutdown := func() {
+		health.setState(stateStopped)
+		cancel()
+		clients.stopAccepting()
+	}
 
-			var serverConnOpts []jsonrpc2.ConnOpt
-			if *trace {
-				serverConnOpts = append(serverConnOpts, jsonrpc2.LogMessages(log.New(os.Stderr, fmt.Sprintf("TRACE %s ", traceID), log.Ltime)))
-			}
-			if *pprofAddr != "" {
-				serverConnOpts = append(serverConnOpts, traceRequests(traceID), traceEventLog("server", traceID))
-			}
-			proxy.client = jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(clientNetConn, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2.AsyncHandler(jsonrpc2HandlerFunc(proxy.handleClientRequest)))
-			proxy.server = jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(lsConn, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2.AsyncHandler(jsonrpc2HandlerFunc(proxy.handleServerRequest)), serverConnOpts...)
+	// drain lets the active sessions end by themselves, but only until
+	// -drainTimeout has passed.
+	drain := func() {
+		health.setState(stateDraining)
+		clients.drain(ctx, *drainTimeout, cancel)
+	}
 
-			proxy.start()
+	defer func() {
+		shutdown()
 
-			// When one side of the connection disconnects, close the other side.
-			select {
-			case <-proxy.client.DisconnectNotify():
-				proxy.server.Close()
-			case <-proxy.server.DisconnectNotify():
-				proxy.client.Close()
-			}
+		// Remove the entire cache when the program is exiting
+		os.RemoveAll(*cacheDir)
+	}()
+	go trapSignalsForShutdown(shutdown, drain)
+	health.setState(stateAccepting)
 
-			// Remove the cache contents for this workspace after the connection closes
-			proxy.cleanWorkspaceCache()
-		}(clientNetConn)
+	var wg sync.WaitGroup
+	if canaryProbe != nil {
+		canaryProbe.serve = func(conn net.Conn) { serveSession(conn, "") }
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			canaryProbe.run(ctx, *canaryInterval, clients.stopped)
+		}()
 	}
 
+	clients.run()
+	clients.wait()
 	wg.Wait()
+	if workspaces != nil {
+		workspaces.closeAll()
+	}
+	// The pool stops refilling once ctx is done, which is not the case yet
+	// when draining.
+	cancel()
+	configs.close()
+	spans.close()
+	rootLogger.infof("CloneProxy: all sessions ended, exiting")
+}
+
+// acceptor accepts the connections of clients on its listeners, and serves
+// each of them in its own goroutine.
+type acceptor struct {
+	listeners []backendListener
+	serve     func(conn net.Conn, backend string)
+
+	stopOnce sync.Once
+	stopped  chan struct{}  // closed once no new connections are accepted
+	accepts  sync.WaitGroup // the accept loops
+	conns    sync.WaitGroup // the connections being served
+}
+
+func newAcceptor(listeners []backendListener, serve func(conn net.Conn, backend string)) *acceptor {
+	return &acceptor{listeners: listeners, serve: serve, stopped: make(chan struct{})}
+}
+
+// run starts accepting connections on every listener.
+func (a *acceptor) run() {
+	for _, lis := range a.listeners {
+		a.accepts.Add(1)
+		go func(lis backendListener) {
+			defer a.accepts.Done()
+			for {
+				conn, err := lis.Accept()
+				if err != nil {
+					if isClosed(a.stopped) { // shutdown or drain
+						return
+					}
+					if ne, ok := err.(net.Error); ok && ne.Temporary() {
+						rootLogger.warnf("error when accepting client connection: %s", err)
+						continue
+					}
+					log.Fatal(err)
+				}
+
+				a.conns.Add(1)
+				go func() {
+					defer a.conns.Done()
+					a.serve(conn, lis.backend)
+				}()
+			}
+		}(lis)
+	}
+}
+
+// stopAccepting closes the listeners.
+func (a *acceptor) stopAccepting() {
+	a.stopOnce.Do(func() {
+		close(a.stopped)
+		for _, lis := range a.listeners {
+			lis.Close()
+		}
+	})
+}
+
+// drain stops accepting connections and lets the sessions being served end
+// by themselves, but calls end to end them once timeout has passed, unless
+// ctx is done by then.
+func (a *acceptor) drain(ctx context.Context, timeout time.Duration, end func()) {
+	rootLogger.infof("Draining: no longer accepting connections, waiting up to %s for active sessions to end", timeout)
+	a.stopAccepting()
+	time.AfterFunc(timeout, func() {
+		if ctx.Err() == nil {
+			rootLogger.warnf("Draining: ending the remaining sessions after %s", timeout)
+			end()
+		}
+	})
+}
+
+// wait waits until the acceptor has stopped accepting connections and has
+// served all the ones it accepted.
+func (a *acceptor) wait() {
+	a.accepts.Wait()
+	a.conns.Wait()
+}
+
+// isClosed reports whether c is closed.
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
 }
 
 func (p *cloneProxy) handleServerRequest(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
@@ -190,44 +674,240 @@ func (p *cloneProxy) handleServerRequest(ctx context.Context, conn *jsonrpc2.Con
 	rTripper := roundTripper{
 		req:             req,
 		globalRequestID: p.lastRequestID,
+		idRewrite:       p.config.jsonrpc2IDRewrite,
 
-		src:  p.server,
+		src:  conn,
 		dest: p.client,
 
 		updateURIFromSrc:  func(uri lsp.DocumentURI) lsp.DocumentURI { return serverToClientURI(uri, p.workspaceCacheDir()) },
 		updateURIFromDest: func(uri lsp.DocumentURI) lsp.DocumentURI { return clientToServerURI(uri, p.workspaceCacheDir()) },
 	}
+	if !req.Notif {
+		// If the client disconnects before replying, another client
+		// sharing the workspace gets to answer.
+		ws := p.workspace()
+		rTripper.retryDest = func(dest *jsonrpc2.Conn) *jsonrpc2.Conn {
+			if other := ws.liveSession(dest); other != nil {
+				return other.client
+			}
+			return nil
+		}
+	}
 
 	if err := rTripper.roundTrip(ctx); err != nil {
-		log.Println("CloneProxy.handleServerRequest(): roundTrip failed", err)
+		p.logger().with("method", req.Method).errorf("CloneProxy.handleServerRequest(): roundTrip failed %s", err)
 	}
 }
 
+// clientConnected reports whether the client of the session is still
+// connected.
+func (p *cloneProxy) clientConnected() bool {
+	select {
+	case <-p.client.DisconnectNotify():
+		return false
+	default:
+		return true
+	}
+}
+
+// handleAsync handles req in its own goroutine like jsonrpc2.AsyncHandler,
+// but keeps track of the goroutine for waitForRequests. Once waitForReplies
+// has been called, requests are answered with an error right away.
+func (p *cloneProxy) handleAsync(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	p.handlersMu.Lock()
+	ending := p.ending
+	if !ending {
+		p.handlers.Add(1)
+	}
+	p.handlersMu.Unlock()
+	if ending {
+		if !req.Notif {
+			conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{Code: jsonrpc2.CodeInternalError, Message: "the session is ending"})
+		}
+		return
+	}
+	go func() {
+		defer p.handlers.Done()
+		p.handleClientRequest(ctx, conn, req)
+	}()
+}
+
+// waitForReplies stops handling new client requests, and waits up to
+// timeout for the ones which are being handled to be answered.
+func (p *cloneProxy) waitForReplies(timeout time.Duration) {
+	p.handlersMu.Lock()
+	p.ending = true
+	p.handlersMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.handlers.Wait()
+		close(done)
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.C:
+	}
+}
+
+// waitForRequests waits for the client requests which are still being
+// handled once the connection to the client has been closed.
+func (p *cloneProxy) waitForRequests() {
+	<-p.client.DisconnectNotify()
+	p.handlers.Wait()
+}
+
 func (p *cloneProxy) handleClientRequest(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	if req.Method == "initialize" {
+		p.addLogFields(repoFields(req.Params)...)
+	}
+	reqLog := p.logger().with("method", req.Method)
+	if !req.Notif {
+		reqLog = reqLog.with("request_id", formatID(req.ID))
+	}
+	ctx = withLogger(ctx, reqLog)
+
+	if p.spans != nil && !req.Notif {
+		span := newRequestSpan(p.sessionID.String(), req)
+		ctx = withRequestSpan(ctx, span)
+		defer span.finish(p.spans)
+	}
+
 	<-p.ready
 
-	if req.Method == "initialize" {
-		globs := strings.FieldsFunc(*glob, func(r rune) bool { return r == ':' })
-		if err := p.cloneWorkspaceToCache(globs); err != nil {
-			log.Println("CloneProxy.handleClientRequest(): cloning workspace failed during initialize", err)
+	atomic.AddInt32(&p.inFlight, 1)
+	defer func() {
+		atomic.AddInt32(&p.inFlight, -1)
+		atomic.StoreInt64(&p.lastActivity, time.Now().UnixNano())
+	}()
+
+	if p.workspaces != nil {
+		switch req.Method {
+		case "initialize":
+			own := p.workspace()
+			if ws := p.workspaces.acquire(workspaceKey(p.config.name, req.Params), own); ws != own {
+				if !p.reuseWorkspace(ws) {
+					// The session already has a language server of its own.
+					if !p.workspaces.release(ws) {
+						ws.close()
+						ws.cleanWorkspaceCache()
+					}
+					break
+				}
+				reqLog.infof("Session %s reuses the workspace at %s", p.sessionID, ws.dir)
+				p.replyWithInitializeResult(ctx, req, ws)
+				return
+			}
+		case "shutdown":
+			// The language server is kept alive for other sessions, so
+			// the client doesn't get to shut it down.
+			if err := p.client.Reply(ctx, req.ID, nil); err != nil {
+				reqLog.errorf("CloneProxy.handleClientRequest(): sending shutdown reply failed %s", err)
+			}
 			return
-		}
-		if *beforeInitHook != "" {
-			if err := p.runHook(ctx, *beforeInitHook); err != nil {
-				log.Println("CloneProxy.handleClientRequest(): running beforeInitializeHook failed", err)
+		case "exit":
+			return
+		case "textDocument/didOpen", "textDocument/didClose":
+			if !p.handleDocumentSync(req) {
+				return
+			}
+		case "$/cancelRequest":
+			if *multiplex && p.config.jsonrpc2IDRewrite == "none" {
+				req = p.namespaceCancelRequest(req)
 			}
 		}
 	}
 
+	if req.Method == "initialize" {
+		ws := p.workspace()
+		result, err := p.initializeWorkspace(ctx, req)
+		ws.finishInitialize(result, err)
+		return
+	}
+
+	if err := p.waitForServer(); err != nil {
+		p.replyWithServerError(ctx, req, err)
+		return
+	}
+
+	ws := p.workspace()
+	if req.Method == "initialized" && !ws.recordInitialized(req.Params) {
+		// Another session has already initialized the language server.
+		return
+	}
+	p.forwardToServer(ctx, req, ws)
+}
+
+// initializeWorkspace clones the workspace, starts the language server if
+// necessary and forwards the 'initialize' request req to it. It returns the
+// result of the language server.
+func (p *cloneProxy) initializeWorkspace(ctx context.Context, req *jsonrpc2.Request) (*json.RawMessage, error) {
+	release, err := p.limiter.acquireClone(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = p.cloneWorkspaceToCache(p.config.glob)
+	release()
+	if err != nil {
+		loggerFrom(ctx).errorf("CloneProxy.handleClientRequest(): cloning workspace failed during initialize %s", err)
+		return nil, err
+	}
+	if p.config.beforeInitHook != "" {
+		if err := p.runHook(ctx, p.config.beforeInitHook); err != nil {
+			loggerFrom(ctx).errorf("CloneProxy.handleClientRequest(): running beforeInitializeHook failed %s", err)
+		}
+	}
+	dir := ""
+	if p.config.lazyStart {
+		dir = p.workspaceCacheDir()
+	}
+	if err := p.startServer(dir); err != nil {
+		loggerFrom(ctx).errorf("CloneProxy.handleClientRequest(): starting language server failed during initialize %s", err)
+		p.replyWithServerError(ctx, req, err)
+		p.endServer()
+		return nil, err
+	}
+
+	if *authTokenFile != "" || *authHMACKeyFile != "" {
+		if req.Params, err = withoutAuthToken(req.Params); err != nil {
+			p.replyWithServerError(ctx, req, err)
+			return nil, err
+		}
+	}
+	if req.Params, err = withInitOptions(req.Params, p.config.initOptions); err != nil {
+		p.replyWithServerError(ctx, req, err)
+		return nil, err
+	}
+
+	ws := p.workspace()
+	ws.recordInitialize(req.Params)
+	return p.forwardToServer(ctx, req, ws)
+}
+
+// forwardToServer passes req on to the language server of ws and its reply
+// back to the client. It returns the result of the language server.
+func (p *cloneProxy) forwardToServer(ctx context.Context, req *jsonrpc2.Request, ws *workspace) (*json.RawMessage, error) {
+	server := ws.serverConn()
+	if server == nil {
+		err := errors.New("the language server of the workspace has not been started")
+		p.replyWithServerError(ctx, req, err)
+		return nil, err
+	}
 	rTripper := roundTripper{
 		req:             req,
-		globalRequestID: p.lastRequestID,
+		globalRequestID: ws.lastRequestID,
+		idRewrite:       ws.config.jsonrpc2IDRewrite,
 
-		src:  p.client,
-		dest: p.server,
+		src:        p.client,
+		dest:       server,
+		retryDest:  ws.waitForRestart,
+		explainErr: ws.explainServerError,
+		span:       requestSpanFrom(ctx),
 
 		updateURIFromSrc: func(uri lsp.DocumentURI) lsp.DocumentURI {
-			uri = clientToServerURI(uri, p.workspaceCacheDir())
+			uri = clientToServerURI(uri, ws.dir)
 
 			// HACK
 			//
@@ -243,41 +923,70 @@ func (p *cloneProxy) handleClientRequest(ctx context.Context, conn *jsonrpc2.Con
 			//
 			// This is not indended to be a robust implementation, so there is no attempt to send
 			// matching 'textDocument/didClose' requests / etc.
-			if *didOpenLanguage != "" {
+			if ws.config.didOpenLanguage != "" {
 				if parsedURI, err := url.Parse(string(uri)); err == nil && probablyFileURI(parsedURI) {
-					p.didOpenMu.Lock()
-					sent := p.didOpen[parsedURI.Path]
+					ws.didOpenMu.Lock()
+					_, sent := ws.didOpen[parsedURI.Path]
 					if !sent {
-						p.didOpen[parsedURI.Path] = true
+						ws.didOpen[parsedURI.Path] = uri
 					}
-					p.didOpenMu.Unlock()
+					ws.didOpenMu.Unlock()
 
 					if !sent {
-						b, err := ioutil.ReadFile(parsedURI.Path)
-						if err == nil {
-							err = p.server.Notify(ctx, "textDocument/didOpen", &lsp.DidOpenTextDocumentParams{
-								TextDocument: lsp.TextDocumentItem{
-									URI:        uri,
-									LanguageID: *didOpenLanguage,
-									Version:    1,
-									Text:       string(b),
-								},
-							})
-							if err != nil {
-								log.Println("error sending didOpen", err)
-							}
-						}
+						ws.sendDidOpen(ctx, server, uri, parsedURI.Path)
 					}
 				}
 			}
 
 			return uri
 		},
-		updateURIFromDest: func(uri lsp.DocumentURI) lsp.DocumentURI { return serverToClientURI(uri, p.workspaceCacheDir()) },
+		updateURIFromDest: func(uri lsp.DocumentURI) lsp.DocumentURI { return serverToClientURI(uri, ws.dir) },
+	}
+
+	if *multiplex {
+		rTripper.idNamespace = p.sessionID.String()
 	}
 
 	if err := rTripper.roundTrip(ctx); err != nil {
-		log.Println("CloneProxy.handleClientRequest(): roundTrip failed", err)
+		loggerFrom(ctx).errorf("CloneProxy.handleClientRequest(): roundTrip failed %s", err)
+		return nil, err
+	}
+	return rTripper.result, nil
+}
+
+// replyWithInitializeResult replies to the 'initialize' request req with the
+// result the language server of ws returned for the first one, once it is
+// available.
+func (p *cloneProxy) replyWithInitializeResult(ctx context.Context, req *jsonrpc2.Request, ws *workspace) {
+	rawResult, err := ws.waitForInitialize(ctx)
+	if err != nil {
+		p.replyWithServerError(ctx, req, errors.Wrap(err, "initializing the shared workspace failed"))
+		return
+	}
+
+	var result interface{}
+	if rawResult != nil {
+		if err := json.Unmarshal(*rawResult, &result); err != nil {
+			p.replyWithServerError(ctx, req, errors.Wrap(err, "unmarshaling recorded initialize result failed"))
+			return
+		}
+	}
+	WalkURIFields(result, func(uri lsp.DocumentURI) lsp.DocumentURI { return serverToClientURI(uri, ws.dir) })
+
+	if err := p.client.Reply(ctx, req.ID, &result); err != nil {
+		loggerFrom(ctx).errorf("CloneProxy.replyWithInitializeResult(): sending reply failed %s", err)
+	}
+}
+
+// replyWithServerError tells the client that req could not be handled
+// because the language server is not available.
+func (p *cloneProxy) replyWithServerError(ctx context.Context, req *jsonrpc2.Request, err error) {
+	requestSpanFrom(ctx).setError(err)
+	if req.Notif {
+		return
+	}
+	if replyErr := p.client.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{Code: jsonrpc2.CodeInternalError, Message: err.Error()}); replyErr != nil {
+		loggerFrom(ctx).errorf("CloneProxy.replyWithServerError(): sending error reply failed %s", replyErr)
 	}
 }
 
@@ -288,12 +997,37 @@ type roundTripper struct {
 	src  *jsonrpc2.Conn
 	dest *jsonrpc2.Conn
 
+	idRewrite string // the -jsonrpc2IDRewrite of the session
+
+	// retryDest is optional. If sending the request to dest fails because
+	// dest disconnected, it is called to get a replacement for dest to
+	// retry the request on once. It returns nil if there is none.
+	retryDest func(dest *jsonrpc2.Conn) *jsonrpc2.Conn
+
+	// explainErr is optional. If sending the request to dest fails for
+	// other reasons than dest replying with an error, it is called to
+	// describe the error to src.
+	explainErr func(err error) error
+
+	result *json.RawMessage // the result received from dest, set by roundTrip
+
+	// idNamespace is optional. If non-empty and -jsonrpc2IDRewrite is
+	// none, it is prepended to the IDs of requests sent to dest, so that
+	// they don't clash with the IDs of other sessions.
+	idNamespace string
+
+	// span is optional. If non-nil, the phases of the round trip are
+	// recorded in it.
+	span *requestSpan
+
 	updateURIFromSrc  func(lsp.DocumentURI) lsp.DocumentURI
 	updateURIFromDest func(lsp.DocumentURI) lsp.DocumentURI
 }
 
 // roundTrip passes requests from one side of the connection to the other.
 func (r *roundTripper) roundTrip(ctx context.Context) error {
+	r.span.startRewrite()
+
 	var params interface{}
 	if r.req.Params != nil {
 		if err := json.Unmarshal(*r.req.Params, &params); err != nil {
@@ -305,6 +1039,9 @@ func (r *roundTripper) roundTrip(ctx context.Context) error {
 
 	if r.req.Notif {
 		err := r.dest.Notify(ctx, r.req.Method, params)
+		if dest := r.replacementDest(err); dest != nil {
+			err = dest.Notify(ctx, r.req.Method, params)
+		}
 		if err != nil {
 			err = errors.Wrap(err, "sending notification to dest failed")
 		}
@@ -312,39 +1049,29 @@ func (r *roundTripper) roundTrip(ctx context.Context) error {
 		return err
 	}
 
-	var id jsonrpc2.ID
-	switch *jsonrpc2IDRewrite {
-	case "none":
-		id = r.req.ID
-	case "string":
-		// Some language servers don't properly support ID's that are ints
-		// (e.x. Clojure), so we provide a string instead. Note that doing this
-		// breaks the `$/cancelRequest` and `$/partialResult` request.
-		id = jsonrpc2.ID{
-			Str:      strconv.FormatUint(r.globalRequestID.getAndInc(), 10),
-			IsString: true,
-		}
-	case "number":
-		// Some language servers don't properly support ID's that are strings
-		// (e.x. Rust), so we provide a number instead. Note that doing this
-		// breaks the `$/cancelRequest` and `$/partialResult` request.
-		id = jsonrpc2.ID{
-			Num: r.globalRequestID.getAndInc(),
-		}
-	default:
-		panic("unexpected jsonrpc2IDRewrite " + *jsonrpc2IDRewrite)
-	}
+	id := r.destID()
 
 	var rawResult *json.RawMessage
+	r.span.sendToServer(id)
 	err := r.dest.Call(ctx, r.req.Method, params, &rawResult, jsonrpc2.PickID(id))
+	if dest := r.replacementDest(err); dest != nil {
+		id = r.destID()
+		r.span.sendToServer(id)
+		err = dest.Call(ctx, r.req.Method, params, &rawResult, jsonrpc2.PickID(id))
+	}
+	r.span.serverReplied()
 
 	if err != nil {
 		var respErr *jsonrpc2.Error
 		if e, ok := err.(*jsonrpc2.Error); ok {
 			respErr = e
 		} else {
+			if r.explainErr != nil {
+				err = r.explainErr(err)
+			}
 			respErr = &jsonrpc2.Error{Message: err.Error()}
 		}
+		r.span.setError(respErr)
 
 		var multiErr error = respErr
 
@@ -362,6 +1089,7 @@ func (r *roundTripper) roundTrip(ctx context.Context) error {
 		}
 	}
 
+	r.result = rawResult
 	WalkURIFields(result, r.updateURIFromDest)
 
 	if err = r.src.Reply(ctx, r.req.ID, &result); err != nil {
@@ -371,16 +1099,70 @@ func (r *roundTripper) roundTrip(ctx context.Context) error {
 	return nil
 }
 
-func trapSignalsForShutdown(shutdown func()) {
+// replacementDest returns the connection to retry the request on if sending
+// it to dest failed with err because dest disconnected, or nil.
+func (r *roundTripper) replacementDest(err error) *jsonrpc2.Conn {
+	if err == nil || r.retryDest == nil {
+		return nil
+	}
+	if _, ok := err.(*jsonrpc2.Error); ok {
+		// dest is alive, it just returned an error.
+		return nil
+	}
+	return r.retryDest(r.dest)
+}
+
+// destID returns the ID to use for the request sent to dest.
+func (r *roundTripper) destID() jsonrpc2.ID {
+	id := rewriteID(r.idRewrite, r.req.ID, r.globalRequestID)
+	if r.idNamespace != "" && r.idRewrite == "none" {
+		id = namespaceID(r.idNamespace, id)
+	}
+	return id
+}
+
+// rewriteID returns the ID to use instead of id according to mode, the
+// value of -jsonrpc2IDRewrite.
+func rewriteID(mode string, id jsonrpc2.ID, globalRequestID *atomicCounter) jsonrpc2.ID {
+	switch mode {
+	case "none":
+		return id
+	case "string":
+		// Some language servers don't properly support ID's that are ints
+		// (e.x. Clojure), so we provide a string instead. Note that doing this
+		// breaks the `$/cancelRequest` and `$/partialResult` request.
+		return jsonrpc2.ID{
+			Str:      strconv.FormatUint(globalRequestID.getAndInc(), 10),
+			IsString: true,
+		}
+	case "number":
+		// Some language servers don't properly support ID's that are strings
+		// (e.x. Rust), so we provide a number instead. Note that doing this
+		// breaks the `$/cancelRequest` and `$/partialResult` request.
+		return jsonrpc2.ID{
+			Num: globalRequestID.getAndInc(),
+		}
+	default:
+		panic("unexpected jsonrpc2IDRewrite " + mode)
+	}
+}
+
+func trapSignalsForShutdown(shutdown, drain func()) {
 	// Listen for shutdown signals. When we receive one attempt to clean up,
-	// but do an insta-shutdown if we receive more than one signal.
+	// but do an insta-shutdown if we receive more than one signal. SIGTERM
+	// (e.x. sent by an orchestrator during a rolling deploy) drains the
+	// active sessions instead of ending them right away.
 	c := make(chan os.Signal, 2)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGHUP)
-	<-c
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-c
 	go func() {
 		<-c
 		os.Exit(0)
 	}()
 
+	if sig == syscall.SIGTERM {
+		drain()
+		return
+	}
 	shutdown()
 }
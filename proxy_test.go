@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/go-langserver/pkg/lsp"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// testSessionConfig returns the configuration of sessions for the flags
+// args.
+func testSessionConfig(t *testing.T, args ...string) *sessionConfig {
+	fs := copyFlagSet(flag.CommandLine)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	config, err := newSessionConfig(fs, profileSettings{command: fs.Args()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// useTempCacheDir makes the workspaces of sessions be created in a temporary
+// directory until the returned function is called.
+func useTempCacheDir(t *testing.T) func() {
+	tmp, err := ioutil.TempDir("", "proxy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCacheDir := cacheDir
+	cacheDir = &tmp
+	return func() {
+		cacheDir = oldCacheDir
+		os.RemoveAll(tmp)
+	}
+}
+
+// serveTestSession serves a session with config in a temporary cache
+// directory. It returns the connection of the client, which passes the
+// requests and notifications of lsp-adapter to handle and replies with its
+// result, a channel which is closed once the session has ended, and a
+// function which ends the session and removes the cache directory.
+func serveTestSession(t *testing.T, config *sessionConfig, handle func(req *jsonrpc2.Request) interface{}) (*jsonrpc2.Conn, <-chan struct{}, func()) {
+	restoreCacheDir := useTempCacheDir(t)
+	s := &sessionServer{limiter: newSessionLimiter(0, 0, 0, 0), sessions: &sessionList{}}
+	client, done := connectTestClient(s, config, handle)
+	return client, done, func() {
+		client.Close()
+		<-done
+		restoreCacheDir()
+	}
+}
+
+// connectTestClient connects a client to s, which serves its session with
+// config. It returns the connection of the client, which passes the requests
+// and notifications of lsp-adapter to handle and replies with its result, and
+// a channel which is closed once the session has ended.
+func connectTestClient(s *sessionServer, config *sessionConfig, handle func(req *jsonrpc2.Request) interface{}) (*jsonrpc2.Conn, <-chan struct{}) {
+	ctx := context.Background()
+	a, b := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.serve(ctx, b, config)
+	}()
+	client := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(a, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2HandlerFunc(func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+		result := handle(req)
+		if !req.Notif {
+			conn.Reply(ctx, req.ID, result)
+		}
+	}))
+	return client, done
+}
+
+// fakeLanguageServer returns the connection to a language server which
+// answers every request with an empty result, and passes the requests and
+// notifications it receives to handle.
+func fakeLanguageServer(handle func(req *jsonrpc2.Request)) io.ReadWriteCloser {
+	a, b := net.Pipe()
+	jsonrpc2.NewConn(context.Background(), jsonrpc2.NewBufferedStream(b, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2HandlerFunc(func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+		handle(req)
+		if req.Notif {
+			return
+		}
+		if req.Method == "initialize" {
+			conn.Reply(ctx, req.ID, map[string]interface{}{"capabilities": map[string]interface{}{}})
+			return
+		}
+		conn.Reply(ctx, req.ID, nil)
+	}))
+	return a
+}
+
+func TestServeForwardsStderrRightAway(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sh")
+	}
+	_, restore := captureLogs("logfmt")
+	defer restore()
+
+	// The language server writes to stderr before the session has
+	// finished setting up, which is passed on to the client.
+	messages := make(chan string, 10)
+	config := testSessionConfig(t, "-forwardStderr", "-shutdownGracePeriod=100ms", "sh", "-c", "echo starting >&2; exec cat >/dev/null")
+	_, _, teardown := serveTestSession(t, config, func(req *jsonrpc2.Request) interface{} {
+		var params lsp.LogMessageParams
+		if req.Method == "window/logMessage" && json.Unmarshal(*req.Params, &params) == nil {
+			messages <- params.Message
+		}
+		return nil
+	})
+	defer teardown()
+	select {
+	case msg := <-messages:
+		if msg != "starting" {
+			t.Errorf("got %q, want the stderr line of the language server", msg)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the stderr line of the language server")
+	}
+}
+
+func TestServeLazyStart(t *testing.T) {
+	_, restore := captureLogs("logfmt")
+	defer restore()
+	ctx := context.Background()
+
+	started := make(chan string, 1)
+	config := testSessionConfig(t, "-lazyStart", "-shutdownGracePeriod=100ms", "fake-language-server")
+	config.connectLS = func(ctx context.Context, data lsTemplateData, dir string) (io.ReadWriteCloser, error) {
+		started <- dir
+		return fakeLanguageServer(func(*jsonrpc2.Request) {}), nil
+	}
+	client, _, teardown := serveTestSession(t, config, func(*jsonrpc2.Request) interface{} { return nil })
+	defer teardown()
+
+	select {
+	case <-started:
+		t.Fatal("expected the language server not to be started before the initialize request")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := client.Call(ctx, "initialize", lsp.InitializeParams{RootURI: "file:///"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case dir := <-started:
+		if filepath.Dir(dir) != *cacheDir {
+			t.Errorf("got the cwd %s, want the workspace in %s", dir, *cacheDir)
+		}
+	default:
+		t.Fatal("expected the language server to be started by the initialize request")
+	}
+
+	// The initialize request fails if the language server can't be
+	// started.
+	config = testSessionConfig(t, "-lazyStart", "fake-language-server")
+	config.connectLS = func(ctx context.Context, data lsTemplateData, dir string) (io.ReadWriteCloser, error) {
+		return nil, errors.New("no language server")
+	}
+	client, done, teardown := serveTestSession(t, config, func(*jsonrpc2.Request) interface{} { return nil })
+	defer teardown()
+	err := client.Call(ctx, "initialize", lsp.InitializeParams{RootURI: "file:///"}, nil)
+	if _, ok := err.(*jsonrpc2.Error); !ok || !strings.Contains(err.Error(), "no language server") {
+		t.Errorf("got %v, want the error starting the language server", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Error("expected the session to end")
+	}
+}
+
+func TestServeRestartsServer(t *testing.T) {
+	_, restore := captureLogs("logfmt")
+	defer restore()
+	ctx := context.Background()
+
+	// Each instance of the fake language server records the methods it
+	// received. The first one exits in the middle of a hover request, and
+	// every one exits on a 'test/crash' request.
+	var (
+		mu       sync.Mutex
+		received [][]string
+	)
+	config := testSessionConfig(t, "-maxServerRestarts=1", "-didOpenLanguage=go", "-shutdownGracePeriod=100ms", "fake-language-server")
+	config.connectLS = func(ctx context.Context, data lsTemplateData, dir string) (io.ReadWriteCloser, error) {
+		mu.Lock()
+		instance := len(received)
+		received = append(received, nil)
+		mu.Unlock()
+
+		a, b := net.Pipe()
+		jsonrpc2.NewConn(context.Background(), jsonrpc2.NewBufferedStream(b, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2HandlerFunc(func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+			mu.Lock()
+			received[instance] = append(received[instance], req.Method)
+			mu.Unlock()
+			switch {
+			case req.Notif:
+			case req.Method == "test/crash" || req.Method == "textDocument/hover" && instance == 0:
+				conn.Close()
+			case req.Method == "initialize":
+				conn.Reply(ctx, req.ID, map[string]interface{}{"capabilities": map[string]interface{}{"hoverProvider": true}})
+			default:
+				conn.Reply(ctx, req.ID, fmt.Sprintf("answered by instance %d", instance))
+			}
+		}))
+		return a, nil
+	}
+	client, done, teardown := serveTestSession(t, config, func(req *jsonrpc2.Request) interface{} {
+		switch req.Method {
+		case "workspace/xfiles":
+			return []lsp.TextDocumentIdentifier{{URI: "file:///a.go"}}
+		case "textDocument/xcontent":
+			return lsp.TextDocumentItem{URI: "file:///a.go", Text: "package a"}
+		}
+		return nil
+	})
+	defer teardown()
+
+	if err := client.Call(ctx, "initialize", lsp.InitializeParams{RootURI: "file:///"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Notify(ctx, "initialized", struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	// Requests and notifications are handled concurrently, so the hover
+	// request is only sent once the language server has been initialized.
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(time.Millisecond) {
+		mu.Lock()
+		n := len(received[0])
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the initialized notification")
+		}
+	}
+
+	// The hover request the first instance didn't answer is answered by the
+	// restarted one, once it has been brought to the same state.
+	var result string
+	params := lsp.TextDocumentPositionParams{TextDocument: lsp.TextDocumentIdentifier{URI: "file:///a.go"}}
+	if err := client.Call(ctx, "textDocument/hover", params, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result != "answered by instance 1" {
+		t.Errorf("got %q, want the result of the restarted language server", result)
+	}
+	mu.Lock()
+	got := append([][]string(nil), received...)
+	mu.Unlock()
+	want := [][]string{
+		{"initialize", "initialized", "textDocument/didOpen", "textDocument/hover"},
+		{"initialize", "initialized", "textDocument/didOpen", "textDocument/hover"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got the methods %q, want %q", got, want)
+	}
+
+	// Once -maxServerRestarts has been used up, the session ends with the
+	// language server.
+	if err := client.Call(ctx, "test/crash", nil, nil); err == nil {
+		t.Error("expected an error for the request the language server didn't answer")
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the session to end once the language server can't be restarted")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 {
+		t.Errorf("expected the language server to be restarted once, got %d instances", len(received))
+	}
+}
+
+func TestAcceptorDrain(t *testing.T) {
+	tests := []struct {
+		name         string
+		timeout      time.Duration
+		clientCloses bool // whether the client ends its session itself
+		wantForceEnd bool
+	}{
+		{"sessions end by themselves", 10 * time.Second, true, false},
+		{"sessions are ended after the timeout", time.Second, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			logs, restore := captureLogs("logfmt")
+			defer restore()
+			defer useTempCacheDir(t)()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			config := testSessionConfig(t, "-shutdownGracePeriod=100ms", "fake-language-server")
+			config.connectLS = func(ctx context.Context, data lsTemplateData, dir string) (io.ReadWriteCloser, error) {
+				return fakeLanguageServer(func(*jsonrpc2.Request) {}), nil
+			}
+			s := &sessionServer{limiter: newSessionLimiter(0, 0, 0, 0), sessions: &sessionList{}}
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			clients := newAcceptor([]backendListener{{Listener: lis}}, func(conn net.Conn, backend string) {
+				s.serve(ctx, conn, config)
+			})
+			clients.run()
+
+			conn, err := net.Dial("tcp", lis.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := jsonrpc2.NewConn(ctx, jsonrpc2.NewBufferedStream(conn, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2HandlerFunc(func(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+				if !req.Notif {
+					conn.Reply(ctx, req.ID, nil)
+				}
+			}))
+			defer client.Close()
+			if err := client.Call(ctx, "initialize", lsp.InitializeParams{RootURI: "file:///"}, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			clients.drain(ctx, test.timeout, cancel)
+			waited := make(chan struct{})
+			go func() {
+				clients.wait()
+				close(waited)
+			}()
+
+			// No new connections are accepted, but the active session goes
+			// on.
+			if conn, err := net.Dial("tcp", lis.Addr().String()); err == nil {
+				conn.Close()
+				t.Error("expected new connections to be refused while draining")
+			}
+			if err := client.Call(ctx, "textDocument/hover", lsp.TextDocumentPositionParams{}, nil); err != nil {
+				t.Errorf("expected the active session to go on while draining, got %v", err)
+			}
+			select {
+			case <-waited:
+				t.Fatal("expected draining to wait for the active session")
+			default:
+			}
+
+			if test.clientCloses {
+				client.Close()
+			}
+			select {
+			case <-waited:
+			case <-time.After(10 * time.Second):
+				t.Fatal("expected the session to end")
+			}
+			if forced := ctx.Err() != nil; forced != test.wantForceEnd {
+				t.Errorf("got sessions ended by draining %t, want %t", forced, test.wantForceEnd)
+			}
+			if test.wantForceEnd {
+				select {
+				case <-client.DisconnectNotify():
+				case <-time.After(10 * time.Second):
+					t.Error("expected the client to be disconnected")
+				}
+				if !strings.Contains(logs.String(), "Draining: ending the remaining sessions after 1s") {
+					t.Errorf("expected the remaining sessions to be ended, got the logs %q", logs.String())
+				}
+			}
+		})
+	}
+}
+
+func TestServeTracesMessages(t *testing.T) {
+	logs, restore := captureLogs("logfmt")
+	defer restore()
+	oldTrace := *trace
+	*trace = true
+	defer func() { *trace = oldTrace }()
+	ctx := context.Background()
+
+	config := testSessionConfig(t, "-shutdownGracePeriod=100ms", "fake-language-server")
+	config.connectLS = func(ctx context.Context, data lsTemplateData, dir string) (io.ReadWriteCloser, error) {
+		return fakeLanguageServer(func(*jsonrpc2.Request) {}), nil
+	}
+	client, _, teardown := serveTestSession(t, config, func(*jsonrpc2.Request) interface{} { return nil })
+	err := client.Call(ctx, "initialize", lsp.InitializeParams{RootURI: "file:///"}, nil)
+	teardown()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The messages are traced on both connections of the session, from its
+	// point of view. The IDs of the initialize request from the client and
+	// the workspace/xfiles request to it overlap.
+	for _, want := range []string{
+		`msg="--> request" session=\S+ component=trace peer=client method=initialize request_id=0 `,
+		`msg="<-- request" session=\S+ component=trace peer=client method=workspace/xfiles request_id=0 `,
+		`msg="--> response" session=\S+ component=trace peer=client method=workspace/xfiles request_id=0 `,
+		`msg="<-- response" session=\S+ component=trace peer=client method=initialize request_id=0 `,
+		`msg="<-- request" session=\S+ component=trace peer=server method=initialize `,
+		`msg="--> response" session=\S+ component=trace peer=server method=initialize `,
+	} {
+		if !regexp.MustCompile(want).MatchString(logs.String()) {
+			t.Errorf("expected the logs to match %q, got %q", want, logs.String())
+		}
+	}
+}
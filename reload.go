@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sessionConfig is the configuration sessions are started with. It can be
+// reloaded (see configReloader), which only affects new sessions: sessions
+// keep using the sessionConfig that was current when they started, and
+// workspaces the one they were created with.
+type sessionConfig struct {
+	name string // the name of the backend (its profile) with -backends
+
+	components []*sessionConfig // the language servers of a composite language server
+
+	command, env  []string
+	modes         []string
+	listenAddress string
+
+	connectLS  lsConnector // takes language servers from the pool with -serverPoolSize
+	connectNew lsConnector // always starts a new language server, used by health checks
+	poolSize   int
+	pool       *serverPool
+	stopPool   context.CancelFunc
+
+	glob               []string
+	didOpenLanguage    string
+	jsonrpc2IDRewrite  string
+	beforeInitHook     string
+	initOptions        map[string]json.RawMessage
+	lazyStart          bool
+	maxServerRestarts  int
+	sessionIdleTimeout time.Duration
+	maxSessionLifetime time.Duration
+	forwardStderr      bool
+	server             serverSettings
+}
+
+// sessionFlags are the flags newSessionConfig reads. All other flags (except
+// for -profile) apply to the whole process: they can't be changed by a
+// reload, and with -backends they must be the same for all backends.
+var sessionFlags = map[string]bool{
+	"lspAddress":            true,
+	"lspPortPattern":        true,
+	"lspDialTimeout":        true,
+	"serverPoolSize":        true,
+	"glob":                  true,
+	"didOpenLanguage":       true,
+	"jsonrpc2IDRewrite":     true,
+	"beforeInitializeHook":  true,
+	"initializationOptions": true,
+	"lazyStart":             true,
+	"maxServerRestarts":     true,
+	"sessionIdleTimeout":    true,
+	"maxSessionLifetime":    true,
+	"shutdownGracePeriod":   true,
+	"stderrLines":           true,
+	"forwardStderr":         true,
+	"rlimitAS":              true,
+	"rlimitCPU":             true,
+	"rlimitNOFILE":          true,
+	"cgroupParent":          true,
+	"cgroupMemoryMax":       true,
+	"cgroupCPUMax":          true,
+}
+
+// processFlags returns the values of the flags of fs which apply to the
+// whole process (see sessionFlags).
+func processFlags(fs *flag.FlagSet) map[string]string {
+	values := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if !sessionFlags[f.Name] && f.Name != "profile" {
+			values[f.Name] = f.Value.String()
+		}
+	})
+	return values
+}
+
+// changedFlags returns the names of the flags whose values differ between
+// old and new (see processFlags), sorted.
+func changedFlags(old, new map[string]string) []string {
+	var changed []string
+	for name, value := range new {
+		if old[name] != value {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// flagValue returns the value of the flag name of fs.
+func flagValue(fs *flag.FlagSet, name string) interface{} {
+	return fs.Lookup(name).Value.(flag.Getter).Get()
+}
+
+// newSessionConfig returns the sessionConfig for the flags of fs and the
+// settings which are not flags (see loadSettings), or an error if they are
+// invalid.
+func newSessionConfig(fs *flag.FlagSet, settings profileSettings) (*sessionConfig, error) {
+	command, env := settings.command, settings.env
+	lspAddr := flagValue(fs, "lspAddress").(string)
+	if len(settings.servers) > 0 && (len(command) > 0 || lspAddr != "") {
+		return nil, errors.New("a profile with servers can't have its own LSP command or -lspAddress")
+	}
+	if len(command) == 0 && lspAddr == "" && len(settings.servers) == 0 {
+		return nil, errors.New("you must specify an LSP command (positional arguments or the command of the -config profile) or -lspAddress")
+	}
+
+	c := &sessionConfig{
+		command:            command,
+		env:                env,
+		modes:              settings.modes,
+		listenAddress:      settings.listenAddress,
+		poolSize:           flagValue(fs, "serverPoolSize").(int),
+		didOpenLanguage:    flagValue(fs, "didOpenLanguage").(string),
+		jsonrpc2IDRewrite:  flagValue(fs, "jsonrpc2IDRewrite").(string),
+		beforeInitHook:     flagValue(fs, "beforeInitializeHook").(string),
+		lazyStart:          flagValue(fs, "lazyStart").(bool),
+		maxServerRestarts:  flagValue(fs, "maxServerRestarts").(int),
+		sessionIdleTimeout: flagValue(fs, "sessionIdleTimeout").(time.Duration),
+		maxSessionLifetime: flagValue(fs, "maxSessionLifetime").(time.Duration),
+		forwardStderr:      flagValue(fs, "forwardStderr").(bool),
+		server: serverSettings{
+			dialTimeout:   flagValue(fs, "lspDialTimeout").(time.Duration),
+			shutdownGrace: flagValue(fs, "shutdownGracePeriod").(time.Duration),
+			stderrLines:   flagValue(fs, "stderrLines").(int),
+			limits: resourceLimits{
+				as:              flagValue(fs, "rlimitAS").(byteSize),
+				cpu:             flagValue(fs, "rlimitCPU").(time.Duration),
+				noFile:          flagValue(fs, "rlimitNOFILE").(int),
+				cgroupParent:    flagValue(fs, "cgroupParent").(string),
+				cgroupMemoryMax: flagValue(fs, "cgroupMemoryMax").(string),
+				cgroupCPUMax:    flagValue(fs, "cgroupCPUMax").(string),
+			},
+		},
+	}
+	c.glob = strings.FieldsFunc(flagValue(fs, "glob").(string), func(r rune) bool { return r == ':' })
+
+	switch c.jsonrpc2IDRewrite {
+	case "none", "string", "number":
+	default:
+		return nil, errors.Errorf("invalid jsonrpc2IDRewrite value %q", c.jsonrpc2IDRewrite)
+	}
+
+	if s := flagValue(fs, "initializationOptions").(string); s != "" {
+		if err := json.Unmarshal([]byte(s), &c.initOptions); err != nil {
+			return nil, errors.Wrap(err, "invalid -initializationOptions, expected a JSON object")
+		}
+	}
+
+	var portPattern *regexp.Regexp
+	if s := flagValue(fs, "lspPortPattern").(string); s != "" {
+		var err error
+		portPattern, err = regexp.Compile(s)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid -lspPortPattern")
+		}
+	}
+
+	if c.poolSize > 0 && c.lazyStart {
+		return nil, errors.New("-serverPoolSize can't be used together with -lazyStart")
+	}
+	if len(settings.servers) > 0 {
+		if err := c.setComponents(settings.servers); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	if c.server.limits.enabled() && len(command) == 0 {
+		return nil, errors.New("resource limits can only be applied to language servers started by lsp-adapter (LSP_COMMAND_ARGS)")
+	}
+	if err := setupResourceLimits(&c.server.limits); err != nil {
+		return nil, err
+	}
+
+	var err error
+	c.connectLS, err = newLSConnector(lspAddr, command, env, portPattern, c.poolSize, &c.server)
+	if err != nil {
+		return nil, err
+	}
+	if len(command) > 0 {
+		// Not connectLS, which takes language servers from the pool.
+		c.connectNew, err = newLSConnector(lspAddr, command, env, portPattern, 0, &c.server)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// startPool starts the pool of idle language servers with -serverPoolSize.
+func (c *sessionConfig) startPool(ctx context.Context) {
+	if c.poolSize == 0 {
+		return
+	}
+	ctx, c.stopPool = context.WithCancel(ctx)
+	if c.name != "" {
+		ctx = withLogger(ctx, loggerFrom(ctx).with("backend", c.name))
+	}
+	connect := c.connectLS
+	c.pool = newServerPool(ctx, c.poolSize, func(ctx context.Context) (io.ReadWriteCloser, error) {
+		return connect(ctx, lsTemplateData{}, "")
+	})
+	c.connectLS = c.pool.get
+}
+
+// close shuts down the pool of idle language servers.
+func (c *sessionConfig) close() {
+	if c.pool != nil {
+		c.stopPool()
+		c.pool.wait()
+	}
+}
+
+// configReloader holds the current backends, and replaces them when the
+// configuration is reloaded.
+type configReloader struct {
+	ctx  context.Context // the context of the pools of idle language servers
+	load func() (*backendSet, error)
+
+	mu       sync.Mutex
+	backends *backendSet
+	reloads  int
+	failures int
+	lastErr  error
+	lastTime time.Time
+}
+
+func newConfigReloader(ctx context.Context, backends *backendSet, load func() (*backendSet, error)) *configReloader {
+	backends.startPools(ctx)
+	return &configReloader{ctx: ctx, backends: backends, load: load}
+}
+
+// current returns the backends new sessions are started with.
+func (r *configReloader) current() *backendSet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.backends
+}
+
+// reload loads the configuration and makes it current. If it is invalid, or
+// it changes flags which apply to the whole process, the current
+// configuration is kept.
+func (r *configReloader) reload() error {
+	backends, err := r.load()
+	if err == nil {
+		if changed := changedFlags(r.current().process, backends.process); len(changed) > 0 {
+			err = errors.Errorf("%s can't be changed by a reload, restart lsp-adapter to apply the change", strings.Join(changed, ", "))
+		}
+	}
+
+	r.mu.Lock()
+	r.lastTime = time.Now()
+	r.lastErr = err
+	if err != nil {
+		r.failures++
+		r.mu.Unlock()
+		rootLogger.errorf("Rejecting the reloaded configuration, keeping the current one: %s", err)
+		return err
+	}
+	backends.startPools(r.ctx)
+	old := r.backends
+	r.backends = backends
+	r.reloads++
+	r.mu.Unlock()
+
+	// The idle language servers of the old pool were started with the old
+	// configuration.
+	go old.close()
+	rootLogger.infof("Reloaded the configuration, it applies to new sessions")
+	return nil
+}
+
+// close shuts down the pools of the current configuration.
+func (r *configReloader) close() {
+	r.current().close()
+}
+
+// ServeHTTP reloads the configuration on POST requests to /debug/reload,
+// and shows the result of the last reload.
+func (r *configReloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if req.Method == "POST" || req.Method == "PUT" {
+		if err := r.reload(); err != nil {
+			http.Error(w, fmt.Sprintf("error: %s", err), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+		return
+	}
+	r.writeStatus(w)
+}
+
+func (r *configReloader) writeStatus(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintf(w, "reloads:          %d\n", r.reloads)
+	fmt.Fprintf(w, "failed reloads:   %d\n", r.failures)
+	if !r.lastTime.IsZero() {
+		fmt.Fprintf(w, "last reload:      %s\n", r.lastTime.Format(time.RFC3339))
+		if r.lastErr != nil {
+			fmt.Fprintf(w, "last error:       %s\n", r.lastErr)
+		}
+	}
+	for _, config := range r.backends.backends {
+		if config.name == "" {
+			fmt.Fprintf(w, "\ncurrent configuration:\n")
+		} else {
+			fmt.Fprintf(w, "\nbackend %s:\n", config.name)
+			fmt.Fprintf(w, "  modes:                %q\n", config.modes)
+			if config.listenAddress != "" {
+				fmt.Fprintf(w, "  listenAddress:        %s\n", config.listenAddress)
+			}
+		}
+		if len(config.components) > 0 {
+			names := make([]string, len(config.components))
+			for i, c := range config.components {
+				names[i] = c.name
+			}
+			fmt.Fprintf(w, "  servers:              %q\n", names)
+		} else {
+			fmt.Fprintf(w, "  command:              %q\n", config.command)
+		}
+		fmt.Fprintf(w, "  glob:                 %q\n", config.glob)
+		fmt.Fprintf(w, "  didOpenLanguage:      %s\n", config.didOpenLanguage)
+		fmt.Fprintf(w, "  jsonrpc2IDRewrite:    %s\n", config.jsonrpc2IDRewrite)
+		fmt.Fprintf(w, "  beforeInitializeHook: %s\n", config.beforeInitHook)
+	}
+}
+
+// trapSignalsForReload reloads the configuration whenever SIGHUP is
+// received.
+func trapSignalsForReload(reload func() error) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		rootLogger.infof("Received SIGHUP, reloading the configuration")
+		reload()
+	}
+}
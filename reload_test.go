@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewSessionConfig(t *testing.T) {
+	fs := copyFlagSet(flag.CommandLine)
+	if err := fs.Parse([]string{"-glob=*.go:*.mod", "-jsonrpc2IDRewrite=string", "-sessionIdleTimeout=1m", "-initializationOptions={\"a\": 1}", "-shutdownGracePeriod=1s", "-forwardStderr", "gopls"}); err != nil {
+		t.Fatal(err)
+	}
+	config, err := newSessionConfig(fs, profileSettings{command: fs.Args()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.glob, []string{"*.go", "*.mod"}) || config.jsonrpc2IDRewrite != "string" || config.sessionIdleTimeout != time.Minute || string(config.initOptions["a"]) != "1" {
+		t.Errorf("unexpected config %+v", config)
+	}
+	if config.server.shutdownGrace != time.Second || !config.forwardStderr {
+		t.Errorf("unexpected language server settings %+v", config.server)
+	}
+	if config.connectLS == nil || config.connectNew == nil {
+		t.Error("expected connectors for the language server command")
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"-jsonrpc2IDRewrite=uuid", "gopls"},
+		{"-initializationOptions=[]", "gopls"},
+		{"-serverPoolSize=2", "-lazyStart", "gopls"},
+		{"-rlimitNOFILE=64", "-lspAddress=tcp://127.0.0.1:7658"},
+	} {
+		fs := copyFlagSet(flag.CommandLine)
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newSessionConfig(fs, profileSettings{command: fs.Args()}); err == nil {
+			t.Errorf("expected an error for %q", args)
+		}
+	}
+}
+
+func TestConfigReloader(t *testing.T) {
+	_, restore := captureLogs("text")
+	defer restore()
+
+	process := map[string]string{"maxSessions": "0", "multiplex": "false"}
+	first := &backendSet{backends: []*sessionConfig{{glob: []string{"*.go"}}}, process: process}
+	second := &backendSet{backends: []*sessionConfig{{glob: []string{"*.py"}}}, process: process}
+	var loadErr error
+	loaded := second
+	r := newConfigReloader(context.Background(), first, func() (*backendSet, error) {
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		return loaded, nil
+	})
+
+	loadErr = errors.New("invalid profile")
+	if err := r.reload(); err == nil {
+		t.Fatal("expected the error of the invalid configuration")
+	}
+	if r.current() != first {
+		t.Fatal("expected the current configuration to be kept after a failed reload")
+	}
+
+	// Flags which apply to the whole process can't be reloaded.
+	loadErr = nil
+	loaded = &backendSet{backends: second.backends, process: map[string]string{"maxSessions": "10", "multiplex": "true"}}
+	if err := r.reload(); err == nil || !strings.Contains(err.Error(), "maxSessions, multiplex can't be changed") {
+		t.Fatalf("expected an error naming the changed flags, got %v", err)
+	}
+	if r.current() != first {
+		t.Fatal("expected the current configuration to be kept after a reload changing maxSessions")
+	}
+
+	loaded = second
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if r.current() != second {
+		t.Fatal("expected the reloaded configuration to be current")
+	}
+
+	var status strings.Builder
+	r.writeStatus(&status)
+	for _, want := range []string{"reloads:          1\n", "failed reloads:   2\n", `"*.py"`} {
+		if !strings.Contains(status.String(), want) {
+			t.Errorf("expected the status %q to contain %q", status.String(), want)
+		}
+	}
+}
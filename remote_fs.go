@@ -20,6 +20,8 @@ import (
 type remoteFS struct {
 	conn    *jsonrpc2.Conn
 	traceID string
+
+	files, bytes int // the number of files and bytes written by Clone
 }
 
 // BatchOpen opens all of the content for the specified paths.
@@ -129,6 +131,7 @@ func (fs *remoteFS) Clone(ctx context.Context, baseDir string, globs []string) (
 		filePaths = filePaths[:i]
 	}
 
+	loggerFrom(ctx).debugf("Fetching %d files (globs: %v) for %s", len(filePaths), globs, baseDir)
 	files, err := fs.BatchOpen(ctx, filePaths)
 	if err != nil {
 		return errors.Wrap(err, "failed to batch open files during clone")
@@ -153,6 +156,8 @@ func (fs *remoteFS) Clone(ctx context.Context, baseDir string, globs []string) (
 		if err := ioutil.WriteFile(newFilePath, []byte(file.content), os.ModePerm); err != nil {
 			return errors.Wrapf(err, "failed to write file content for %s", newFilePath)
 		}
+		fs.files++
+		fs.bytes += len(file.content)
 	}
 	tr.LazyPrintf("cloned %d files", len(files))
 	return nil
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/go-langserver/pkg/lsp"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// watchServer waits for the connection to the language server to go away.
+// Unless the workspace is closing, the language server is restarted up to
+// -maxServerRestarts times. Once it gives up, serverDone is closed.
+func (ws *workspace) watchServer(conn *jsonrpc2.Conn) {
+	for {
+		<-conn.DisconnectNotify()
+		ws.reportResourceLimitExceeded()
+		if !ws.allowRestart() {
+			close(ws.serverDone)
+			return
+		}
+
+		// Closing the connection reaps the process, which also means its
+		// exit status is available below.
+		conn.Close()
+		status := "connection closed"
+		if proc := ws.serverProcess(); proc != nil {
+			<-proc.exited
+			status = proc.describeExit()
+		}
+		ws.logger().warnf("CloneProxy: language server exited unexpectedly (%s), restarting it (%d/%d)", status, ws.restartCount(), ws.config.maxServerRestarts)
+
+		for {
+			newConn, err := ws.restartServer()
+			if err == nil {
+				metricServerRestarts.inc()
+				conn = newConn
+				break
+			}
+			ws.logger().errorf("CloneProxy: restarting language server failed: %s", err)
+
+			// Failed attempts count towards -maxServerRestarts as well, so
+			// this can't loop forever.
+			if !ws.allowRestart() {
+				close(ws.serverDone)
+				return
+			}
+		}
+	}
+}
+
+// allowRestart reports whether the language server may be restarted, and if
+// so counts the restart.
+func (ws *workspace) allowRestart() bool {
+	ws.serverMu.Lock()
+	defer ws.serverMu.Unlock()
+	if ws.closing || ws.restarts >= ws.config.maxServerRestarts {
+		return false
+	}
+	ws.restarts++
+	return true
+}
+
+func (ws *workspace) restartCount() int {
+	ws.serverMu.Lock()
+	defer ws.serverMu.Unlock()
+	return ws.restarts
+}
+
+func (ws *workspace) serverProcess() *lsProcess {
+	ws.serverMu.Lock()
+	defer ws.serverMu.Unlock()
+	return ws.serverProc
+}
+
+// restartServer connects to a new instance of the language server and
+// brings it to the same state as the one it replaces: it replays the
+// 'initialize' request, 'initialized' notification and any 'didOpen'
+// notifications sent by the didOpenLanguage HACK. Once done, the new
+// connection replaces the old one.
+func (ws *workspace) restartServer() (*jsonrpc2.Conn, error) {
+	conn, proc, err := ws.connectServer()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ws.replayInitialization(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ws.serverMu.Lock()
+	if ws.closing {
+		ws.serverMu.Unlock()
+		conn.Close()
+		return nil, errors.New("workspace closed while restarting the language server")
+	}
+	ws.server, ws.serverProc = conn, proc
+	close(ws.serverReplaced)
+	ws.serverReplaced = make(chan struct{})
+	ws.serverMu.Unlock()
+
+	return conn, nil
+}
+
+func (ws *workspace) replayInitialization(conn *jsonrpc2.Conn) error {
+	ws.initMu.Lock()
+	initParams, initialized, initializedParams := ws.initParams, ws.initialized, ws.initializedParams
+	ws.initMu.Unlock()
+
+	// If the client hasn't sent 'initialize' yet, the request will go to
+	// the new language server anyway.
+	if initParams == nil {
+		return nil
+	}
+
+	ctx := ws.ctx
+	updateURI := func(uri lsp.DocumentURI) lsp.DocumentURI { return clientToServerURI(uri, ws.dir) }
+
+	var params interface{}
+	if err := json.Unmarshal(*initParams, &params); err != nil {
+		return errors.Wrap(err, "unmarshaling recorded initialize params failed")
+	}
+	WalkURIFields(params, updateURI)
+	if err := conn.Call(ctx, "initialize", params, nil, jsonrpc2.PickID(rewriteID(ws.config.jsonrpc2IDRewrite, jsonrpc2.ID{Num: ws.lastRequestID.getAndInc()}, ws.lastRequestID))); err != nil {
+		return errors.Wrap(err, "replaying initialize failed")
+	}
+
+	if initialized {
+		var params interface{}
+		if initializedParams != nil {
+			if err := json.Unmarshal(*initializedParams, &params); err != nil {
+				return errors.Wrap(err, "unmarshaling recorded initialized params failed")
+			}
+		}
+		if err := conn.Notify(ctx, "initialized", params); err != nil {
+			return errors.Wrap(err, "replaying initialized failed")
+		}
+	}
+
+	ws.didOpenMu.Lock()
+	didOpen := make(map[string]lsp.DocumentURI, len(ws.didOpen))
+	for path, uri := range ws.didOpen {
+		didOpen[path] = uri
+	}
+	ws.didOpenMu.Unlock()
+	for path, uri := range didOpen {
+		ws.sendDidOpen(ctx, conn, uri, path)
+	}
+
+	return nil
+}
+
+// waitForRestart is used to retry requests which were in flight when the
+// language server behind old went away. It waits until old has been replaced
+// by a restarted language server and returns the replacement. It returns nil
+// if the language server is not going to be restarted.
+func (ws *workspace) waitForRestart(old *jsonrpc2.Conn) *jsonrpc2.Conn {
+	if ws.config.maxServerRestarts == 0 {
+		return nil
+	}
+
+	select {
+	case <-old.DisconnectNotify():
+	case <-ws.ctx.Done():
+		return nil
+	}
+
+	for {
+		ws.serverMu.Lock()
+		current, replaced := ws.server, ws.serverReplaced
+		ws.serverMu.Unlock()
+		if current != old {
+			return current
+		}
+
+		select {
+		case <-replaced:
+		case <-ws.serverDone:
+			return nil
+		case <-ws.ctx.Done():
+			return nil
+		}
+	}
+}
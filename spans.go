@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// requestSpan records how long the phases of handling a client request
+// took:
+//
+//   - queue: from receiving the request until it is passed on to the
+//     language server (waiting for the session to be ready, cloning the
+//     workspace, starting the language server, ...)
+//   - rewrite: decoding the request and rewriting its URIs and ID
+//   - server: waiting for the language server to reply
+//   - reply: rewriting the result and sending it to the client
+//
+// All methods may be called on a nil *requestSpan, which records nothing.
+type requestSpan struct {
+	traceID   [16]byte
+	spanID    [8]byte
+	sessionID string
+	method    string
+	clientID  jsonrpc2.ID
+
+	mu       sync.Mutex
+	serverID *jsonrpc2.ID // the ID of the request sent to the language server
+	received time.Time
+	rewrite  time.Time // start of each phase, zero if it was not reached
+	server   time.Time
+	reply    time.Time
+	end      time.Time
+	err      string
+	spanIDs  [4][8]byte // span IDs of the phases
+}
+
+func newRequestSpan(sessionID string, req *jsonrpc2.Request) *requestSpan {
+	s := &requestSpan{
+		sessionID: sessionID,
+		method:    req.Method,
+		clientID:  req.ID,
+		received:  time.Now(),
+	}
+	rand.Read(s.traceID[:])
+	rand.Read(s.spanID[:])
+	for i := range s.spanIDs {
+		rand.Read(s.spanIDs[i][:])
+	}
+	return s
+}
+
+type spanContextKey struct{}
+
+// withRequestSpan returns a copy of ctx carrying s.
+func withRequestSpan(ctx context.Context, s *requestSpan) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, s)
+}
+
+// requestSpanFrom returns the span carried by ctx, or nil.
+func requestSpanFrom(ctx context.Context) *requestSpan {
+	s, _ := ctx.Value(spanContextKey{}).(*requestSpan)
+	return s
+}
+
+func (s *requestSpan) mark(t *time.Time) {
+	s.mu.Lock()
+	*t = time.Now()
+	s.mu.Unlock()
+}
+
+// startRewrite marks the end of the queue phase.
+func (s *requestSpan) startRewrite() {
+	if s != nil {
+		s.mark(&s.rewrite)
+	}
+}
+
+// sendToServer marks the start of the server phase, in which the request
+// is sent to the language server with id. It may be called again if the
+// request is retried.
+func (s *requestSpan) sendToServer(id jsonrpc2.ID) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.server.IsZero() {
+		s.server = time.Now()
+	}
+	s.serverID = &id
+	s.mu.Unlock()
+}
+
+// serverReplied marks the start of the reply phase.
+func (s *requestSpan) serverReplied() {
+	if s != nil {
+		s.mark(&s.reply)
+	}
+}
+
+func (s *requestSpan) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.err == "" {
+		s.err = err.Error()
+	}
+	s.mu.Unlock()
+}
+
+// finish ends the span and passes it to e.
+func (s *requestSpan) finish(e *spanExporter) {
+	if s == nil {
+		return
+	}
+	s.mark(&s.end)
+	e.export(s)
+}
+
+// phases returns the name, start and end of the phases that were reached.
+func (s *requestSpan) phases() []spanPhase {
+	bounds := []time.Time{s.received, s.rewrite, s.server, s.reply, s.end}
+	names := []string{"queue", "rewrite", "server", "reply"}
+	var phases []spanPhase
+	for i, name := range names {
+		start := bounds[i]
+		if start.IsZero() {
+			break
+		}
+		end := s.end
+		for _, b := range bounds[i+1:] {
+			if !b.IsZero() {
+				end = b
+				break
+			}
+		}
+		phases = append(phases, spanPhase{name: name, spanID: s.spanIDs[i], start: start, end: end})
+	}
+	return phases
+}
+
+type spanPhase struct {
+	name       string
+	spanID     [8]byte
+	start, end time.Time
+}
+
+// spanExporter writes finished spans as OpenTelemetry (OTLP/JSON) trace
+// export requests to a file, one per line, and/or sends them to an OTLP/HTTP
+// collector. Spans are exported in batches in the background.
+type spanExporter struct {
+	file     *os.File
+	endpoint string
+	client   *http.Client
+
+	spans chan *requestSpan
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+const (
+	spanBatchSize     = 100
+	spanBatchInterval = 5 * time.Second
+)
+
+// newSpanExporter returns an exporter for the file and OTLP/HTTP endpoint
+// (either may be empty), or nil if both are empty.
+func newSpanExporter(file, endpoint string) (*spanExporter, error) {
+	if file == "" && endpoint == "" {
+		return nil, nil
+	}
+	e := &spanExporter{
+		client: &http.Client{Timeout: 10 * time.Second},
+		spans:  make(chan *requestSpan, 10*spanBatchSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, errors.Errorf("invalid OTLP endpoint %q, expected e.x. http://localhost:4318", endpoint)
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/traces"
+		}
+		e.endpoint = u.String()
+	}
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, errors.Wrap(err, "opening the span export file failed")
+		}
+		e.file = f
+	}
+	go e.run()
+	return e, nil
+}
+
+// export queues s for export. If the queue is full, s is dropped.
+func (e *spanExporter) export(s *requestSpan) {
+	if e == nil {
+		return
+	}
+	select {
+	case <-e.stop:
+		return
+	default:
+	}
+	select {
+	case e.spans <- s:
+	default:
+		rootLogger.with("session", s.sessionID).warnf("Dropping span of %s request: the export queue is full", s.method)
+	}
+}
+
+func (e *spanExporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(spanBatchInterval)
+	defer ticker.Stop()
+	var batch []*requestSpan
+	for {
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-e.stop:
+			for len(e.spans) > 0 {
+				batch = append(batch, <-e.spans)
+			}
+			e.flush(batch)
+			return
+		}
+		e.flush(batch)
+		batch = nil
+	}
+}
+
+func (e *spanExporter) flush(batch []*requestSpan) {
+	if len(batch) == 0 {
+		return
+	}
+	b, err := json.Marshal(otlpRequest(batch))
+	if err != nil {
+		rootLogger.errorf("spanExporter.flush(): encoding spans failed: %s", err)
+		return
+	}
+	if e.file != nil {
+		if _, err := e.file.Write(append(b, '\n')); err != nil {
+			rootLogger.errorf("spanExporter.flush(): writing spans failed: %s", err)
+		}
+	}
+	if e.endpoint != "" {
+		resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(b))
+		if err != nil {
+			rootLogger.warnf("spanExporter.flush(): sending spans failed: %s", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			rootLogger.warnf("spanExporter.flush(): sending spans failed: %s", resp.Status)
+		}
+	}
+}
+
+// close exports the remaining spans.
+func (e *spanExporter) close() {
+	if e == nil {
+		return
+	}
+	close(e.stop)
+	<-e.done
+	if e.file != nil {
+		e.file.Close()
+	}
+}
+
+// The subset of the OTLP/JSON encoding of ExportTraceServiceRequest used by
+// spanExporter, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+type (
+	otlpAttribute struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"` // e.x. {"stringValue": "foo"}
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+)
+
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpKindClient   = 3
+
+	otlpStatusOK    = 1
+	otlpStatusError = 2
+)
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]interface{}{"stringValue": value}}
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func formatID(id jsonrpc2.ID) string {
+	if id.IsString {
+		return id.Str
+	}
+	return strconv.FormatUint(id.Num, 10)
+}
+
+// otlpSpans returns the OTLP spans for s: one for the request and one for
+// each of its phases.
+func (s *requestSpan) otlpSpans() []otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	traceID := hex.EncodeToString(s.traceID[:])
+	parentID := hex.EncodeToString(s.spanID[:])
+	status := otlpStatus{Code: otlpStatusOK}
+	if s.err != "" {
+		status = otlpStatus{Code: otlpStatusError, Message: s.err}
+	}
+
+	root := otlpSpan{
+		TraceID:           traceID,
+		SpanID:            parentID,
+		Name:              s.method,
+		Kind:              otlpKindServer,
+		StartTimeUnixNano: otlpTime(s.received),
+		EndTimeUnixNano:   otlpTime(s.end),
+		Attributes: []otlpAttribute{
+			otlpString("rpc.system", "jsonrpc"),
+			otlpString("rpc.method", s.method),
+			otlpString("rpc.jsonrpc.request_id", formatID(s.clientID)),
+			otlpString("lsp_adapter.session_id", s.sessionID),
+		},
+		Status: status,
+	}
+	if s.serverID != nil {
+		root.Attributes = append(root.Attributes, otlpString("lsp_adapter.server_request_id", formatID(*s.serverID)))
+	}
+
+	spans := []otlpSpan{root}
+	for _, phase := range s.phases() {
+		d := phase.end.Sub(phase.start)
+		root.Attributes = append(root.Attributes, otlpAttribute{Key: "lsp_adapter." + phase.name + "_seconds", Value: map[string]interface{}{"doubleValue": d.Seconds()}})
+		span := otlpSpan{
+			TraceID:           traceID,
+			SpanID:            hex.EncodeToString(phase.spanID[:]),
+			ParentSpanID:      parentID,
+			Name:              phase.name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: otlpTime(phase.start),
+			EndTimeUnixNano:   otlpTime(phase.end),
+		}
+		if phase.name == "server" {
+			span.Name = "server " + s.method
+			span.Kind = otlpKindClient
+			if s.serverID != nil {
+				span.Attributes = []otlpAttribute{otlpString("rpc.jsonrpc.request_id", formatID(*s.serverID))}
+			}
+		}
+		spans = append(spans, span)
+	}
+	spans[0] = root
+	return spans
+}
+
+// otlpRequest returns the OTLP/JSON ExportTraceServiceRequest for batch.
+func otlpRequest(batch []*requestSpan) interface{} {
+	var spans []otlpSpan
+	for _, s := range batch {
+		spans = append(spans, s.otlpSpans()...)
+	}
+	hostname, _ := os.Hostname()
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{
+					otlpString("service.name", "lsp-adapter"),
+					otlpString("host.name", hostname),
+					{Key: "process.pid", Value: map[string]interface{}{"intValue": strconv.Itoa(os.Getpid())}},
+				},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "lsp-adapter"},
+				"spans": spans,
+			}},
+		}},
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+func TestRequestSpan(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "spans-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	file := filepath.Join(tmp, "spans.json")
+
+	e, err := newSpanExporter(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A request which reached the language server, with a rewritten ID.
+	ok := newRequestSpan("session", &jsonrpc2.Request{Method: "textDocument/hover", ID: jsonrpc2.ID{Num: 1}})
+	ok.startRewrite()
+	ok.sendToServer(jsonrpc2.ID{Str: "7", IsString: true})
+	time.Sleep(10 * time.Millisecond)
+	ok.serverReplied()
+	ok.finish(e)
+
+	// A request which failed before reaching the language server.
+	failed := newRequestSpan("session", &jsonrpc2.Request{Method: "textDocument/definition", ID: jsonrpc2.ID{Num: 2}})
+	failed.setError(errors.New("the language server is not available"))
+	failed.finish(e)
+
+	e.close()
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		t.Fatal(err)
+	}
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+
+	var names []string
+	attrs := map[string]string{}
+	for _, s := range spans {
+		names = append(names, s.Name)
+		if s.Name == "textDocument/hover" {
+			for _, a := range s.Attributes {
+				if v, ok := a.Value["stringValue"].(string); ok {
+					attrs[a.Key] = v
+				}
+			}
+		}
+		if s.Name == "textDocument/definition" && (s.Status.Code != otlpStatusError || s.Status.Message != "the language server is not available") {
+			t.Errorf("unexpected status %+v of the failed request", s.Status)
+		}
+	}
+	want := []string{"textDocument/hover", "queue", "rewrite", "server textDocument/hover", "reply", "textDocument/definition", "queue"}
+	if len(names) != len(want) {
+		t.Fatalf("got spans %q, want %q", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("got spans %q, want %q", names, want)
+		}
+	}
+	if attrs["rpc.jsonrpc.request_id"] != "1" || attrs["lsp_adapter.server_request_id"] != "7" {
+		t.Errorf("expected the client request ID 1 to be linked to the server request ID 7, got %v", attrs)
+	}
+
+	phases := ok.phases()
+	if d := phases[2].end.Sub(phases[2].start); d < 10*time.Millisecond {
+		t.Errorf("expected the server phase to take at least 10ms, got %s", d)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/go-langserver/pkg/lsp"
+)
+
+// maxOutputLineLength bounds the length of the lines of language server
+// output that are kept. Longer lines are truncated.
+const maxOutputLineLength = 4096
+
+// crashStderrLines is the number of lines of stderr included in errors about
+// language servers which exited unexpectedly.
+const crashStderrLines = 20
+
+// lineBuffer is a ring buffer keeping the last lines added to it.
+type lineBuffer struct {
+	size int
+
+	mu    sync.Mutex
+	lines []string
+	next  int // the index of the oldest line once lines is full
+}
+
+func newLineBuffer(size int) *lineBuffer {
+	return &lineBuffer{size: size}
+}
+
+func (b *lineBuffer) add(line string) {
+	if b.size <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.lines) < b.size {
+		b.lines = append(b.lines, line)
+		return
+	}
+	b.lines[b.next] = line
+	b.next = (b.next + 1) % b.size
+}
+
+// last returns the last n lines (all of them if n <= 0), oldest first.
+func (b *lineBuffer) last(n int) []string {
+	b.mu.Lock()
+	lines := append(append([]string(nil), b.lines[b.next:]...), b.lines[:b.next]...)
+	b.mu.Unlock()
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+// lsOutput captures the output of a language server process line by line:
+// its stderr, and for language servers lsp-adapter talks to over a socket
+// also its stdout. The last -stderrLines lines are kept for error messages.
+// Each line is passed on to the sink set by the workspace using the language
+// server, or logged while there is none (e.x. while the language server is
+// idle in the pool).
+type lsOutput struct {
+	lines *lineBuffer
+	watch func(line string) // optional, called for each line
+	r, w  *os.File
+	done  chan struct{} // closed once all output has been read
+
+	mu   sync.Mutex
+	pid  int
+	sink func(line string)
+}
+
+// captureOutput arranges for the stderr of cmd, and its stdout if stdout is
+// true, to be captured, keeping the last keepLines lines. It must be called
+// before cmd is started, and start must be called after.
+func captureOutput(cmd *exec.Cmd, stdout bool, keepLines int, watch func(line string)) (*lsOutput, error) {
+	// Unlike cmd.StderrPipe, this pipe is not closed by cmd.Wait, so that
+	// everything the process wrote before exiting is read.
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create stderr pipe for language server")
+	}
+	cmd.Stderr = w
+	if stdout {
+		cmd.Stdout = w
+	}
+	return &lsOutput{
+		lines: newLineBuffer(keepLines),
+		watch: watch,
+		r:     r,
+		w:     w,
+		done:  make(chan struct{}),
+	}, nil
+}
+
+// start starts reading the output once cmd.Start has been called. pid is 0
+// if the process failed to start.
+func (o *lsOutput) start(pid int) {
+	o.w.Close()
+	o.mu.Lock()
+	o.pid = pid
+	o.mu.Unlock()
+	go o.read()
+}
+
+func (o *lsOutput) read() {
+	defer close(o.done)
+	defer o.r.Close()
+
+	r := bufio.NewReader(o.r)
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			if line != "" {
+				o.add(line)
+			}
+			return
+		}
+		o.add(line)
+	}
+}
+
+// readLine reads a line from r, truncated to maxOutputLineLength bytes.
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return string(line), err
+		}
+		if len(line) < maxOutputLineLength {
+			line = append(line, chunk...)
+		}
+		if !isPrefix {
+			break
+		}
+	}
+	if len(line) > maxOutputLineLength {
+		line = line[:maxOutputLineLength]
+	}
+	return string(line), nil
+}
+
+func (o *lsOutput) add(line string) {
+	o.lines.add(line)
+	if o.watch != nil {
+		o.watch(line)
+	}
+
+	o.mu.Lock()
+	sink, pid := o.sink, o.pid
+	o.mu.Unlock()
+	if sink != nil {
+		sink(line)
+		return
+	}
+	rootLogger.with("pid", pid).infof("Language server: %s", line)
+}
+
+// setSink makes o pass the lines read from now on to sink.
+func (o *lsOutput) setSink(sink func(line string)) {
+	o.mu.Lock()
+	o.sink = sink
+	o.mu.Unlock()
+}
+
+// tail returns the last n lines of output. It is called once the process
+// has exited, so it first gives the remaining output a moment to be read.
+func (o *lsOutput) tail(n int) []string {
+	select {
+	case <-o.done:
+	case <-time.After(time.Second):
+	}
+	return o.lines.last(n)
+}
+
+// stderrTail returns the last lines the process wrote to stderr for
+// appending to an error message, or "" if it wrote nothing. It must only be
+// called once exited is closed.
+func (p *lsProcess) stderrTail() string {
+	lines := p.output.tail(crashStderrLines)
+	if len(lines) == 0 {
+		return ""
+	}
+	return "; last lines of its stderr:\n" + strings.Join(lines, "\n")
+}
+
+// describeExit describes how the process exited (see status), followed by
+// the last lines it wrote to stderr. It must only be called once exited is
+// closed.
+func (p *lsProcess) describeExit() string {
+	return p.status() + p.stderrTail()
+}
+
+// handleStderr passes a line the language server wrote to stderr on to the
+// sessions using the workspace: it is logged once with the IDs of the
+// sessions, kept in the output of each session, and with -forwardStderr
+// sent to their clients as a 'window/logMessage' notification.
+func (ws *workspace) handleStderr(line string) {
+	ws.sessionMu.Lock()
+	sessions := append([]*cloneProxy(nil), ws.sessions...)
+	ws.sessionMu.Unlock()
+
+	ws.logger().infof("Language server: %s", line)
+	for _, p := range sessions {
+		p.stderr.add(line)
+		if p.config.forwardStderr {
+			if err := p.client.Notify(p.ctx, "window/logMessage", &lsp.LogMessageParams{Type: lsp.Log, Message: line}); err != nil {
+				p.logger().warnf("CloneProxy.handleStderr(): sending window/logMessage failed: %s", err)
+			}
+		}
+	}
+}
+
+// sessionList is the list of active sessions, whose language server output
+// is shown on the debug server.
+type sessionList struct {
+	mu       sync.Mutex
+	sessions []*cloneProxy
+}
+
+func (l *sessionList) add(p *cloneProxy) {
+	l.mu.Lock()
+	l.sessions = append(l.sessions, p)
+	l.mu.Unlock()
+}
+
+func (l *sessionList) remove(p *cloneProxy) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, s := range l.sessions {
+		if s == p {
+			l.sessions = append(l.sessions[:i], l.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// writeStderr writes the last lines of language server output of each
+// active session to w.
+func (l *sessionList) writeStderr(w io.Writer) {
+	l.mu.Lock()
+	sessions := append([]*cloneProxy(nil), l.sessions...)
+	l.mu.Unlock()
+
+	if len(sessions) == 0 {
+		fmt.Fprintln(w, "no active sessions")
+		return
+	}
+	for i, p := range sessions {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		lines := p.stderr.last(0)
+		fmt.Fprintf(w, "session %s%s (%d lines):\n", p.sessionID, formatFields(p.logger().fields, "session"), len(lines))
+		for _, line := range lines {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+}
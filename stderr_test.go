@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLineBuffer(t *testing.T) {
+	b := newLineBuffer(3)
+	for _, line := range []string{"a", "b", "c", "d", "e"} {
+		b.add(line)
+	}
+	if got, want := b.last(0), []string{"c", "d", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := b.last(2), []string{"d", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got := newLineBuffer(0); len(got.last(0)) != 0 {
+		t.Errorf("expected a buffer of size 0 to keep nothing")
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	long := strings.Repeat("x", 2*maxOutputLineLength)
+	r := bufio.NewReaderSize(strings.NewReader("short\n"+long+"\nlast"), 16)
+
+	var lines []string
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			break
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 3 || lines[0] != "short" || lines[1] != long[:maxOutputLineLength] || lines[2] != "last" {
+		t.Errorf("unexpected lines %.20q", lines)
+	}
+}
+
+func TestCaptureOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sh")
+	}
+
+	cmd := exec.Command("sh", "-c", "echo starting; echo 'port 1234' >&2; echo crashed >&2; exit 2")
+	watch, ports := watchForPort(regexp.MustCompile(`port (\d+)`))
+	output, err := captureOutput(cmd, true, 100, watch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu   sync.Mutex
+		sunk []string
+	)
+	output.setSink(func(line string) {
+		mu.Lock()
+		sunk = append(sunk, line)
+		mu.Unlock()
+	})
+
+	proc, err := startLSProcess(cmd, output, &serverSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-proc.exited
+
+	want := "exit status 2; last lines of its stderr:\nstarting\nport 1234\ncrashed"
+	if got := proc.describeExit(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sunk) != 3 {
+		t.Errorf("expected the sink to receive 3 lines, got %q", sunk)
+	}
+	if port := <-ports; port != 1234 {
+		t.Errorf("got port %d, want 1234", port)
+	}
+}
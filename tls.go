@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// tlsHandshakeTimeout is how long a client may take to complete the TLS
+// handshake.
+const tlsHandshakeTimeout = 30 * time.Second
+
+// tlsFiles holds the certificate and key of the listeners and the CA bundle
+// client certificates are verified against. They are reloaded whenever the
+// files change, so that certificates can be renewed without a restart.
+type tlsFiles struct {
+	certFile, keyFile, clientCAFile string
+
+	mu        sync.Mutex
+	modTimes  []time.Time // the modification times of the files when they were loaded
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool // nil without a client CA bundle
+}
+
+// newTLSConfig returns the TLS config of the listeners for the certificate
+// and key in certFile and keyFile. Unless clientCAFile is empty, clients
+// must present a certificate signed by one of the CAs in it.
+func newTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("-tlsCert and -tlsKey must be specified together")
+	}
+	f := &tlsFiles{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetConfigForClient: f.configForClient}, nil
+}
+
+func (f *tlsFiles) files() []string {
+	files := []string{f.certFile, f.keyFile}
+	if f.clientCAFile != "" {
+		files = append(files, f.clientCAFile)
+	}
+	return files
+}
+
+// load reads the files.
+func (f *tlsFiles) load() error {
+	modTimes, err := f.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "loading the TLS certificate failed")
+	}
+	var clientCAs *x509.CertPool
+	if f.clientCAFile != "" {
+		pem, err := ioutil.ReadFile(f.clientCAFile)
+		if err != nil {
+			return errors.Wrap(err, "loading the client CA bundle failed")
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return errors.Errorf("no certificates found in the client CA bundle %s", f.clientCAFile)
+		}
+	}
+
+	f.mu.Lock()
+	f.modTimes, f.cert, f.clientCAs = modTimes, &cert, clientCAs
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *tlsFiles) stat() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, name := range f.files() {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, fi.ModTime())
+	}
+	return modTimes, nil
+}
+
+// changed reports whether any of the files changed since they were last
+// loaded, and returns their modification times.
+func (f *tlsFiles) changed() ([]time.Time, bool) {
+	modTimes, err := f.stat()
+	if err != nil {
+		// Probably in the middle of being replaced.
+		return nil, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, t := range modTimes {
+		if !t.Equal(f.modTimes[i]) {
+			return modTimes, true
+		}
+	}
+	return modTimes, false
+}
+
+// configForClient returns the config for a new connection, with the
+// certificates reloaded if the files changed. If they can't be loaded, the
+// previous ones are kept until the files change again.
+func (f *tlsFiles) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	if modTimes, changed := f.changed(); changed {
+		if err := f.load(); err != nil {
+			rootLogger.errorf("CloneProxy: reloading the TLS certificates failed, keeping the current ones: %s", err)
+			f.mu.Lock()
+			f.modTimes = modTimes
+			f.mu.Unlock()
+		} else {
+			rootLogger.infof("CloneProxy: reloaded the TLS certificates")
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*f.cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if f.clientCAs != nil {
+		config.ClientCAs = f.clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// handshake completes the TLS handshake of conn if it is a TLS connection,
+// so that clients which fail it are rejected before a session starts.
+func handshake(conn net.Conn) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	defer tlsConn.SetDeadline(time.Time{})
+	return tlsConn.Handshake()
+}
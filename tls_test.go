@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate signed by a test CA (or self-signed if it is the
+// CA).
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, key
+	if ca == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write writes the certificate and key to dir/name.crt and dir/name.key.
+func (c *testCert) write(t *testing.T, dir, name string, modTime time.Time) (certFile, keyFile string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	for file, block := range map[string]*pem.Block{certFile: {Type: "CERTIFICATE", Bytes: c.der}, keyFile: {Type: "EC PRIVATE KEY", Bytes: keyDER}} {
+		if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestTLSListener(t *testing.T) {
+	_, restore := captureLogs("text")
+	defer restore()
+	tmp, err := ioutil.TempDir("", "tls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ca := newTestCert(t, "ca", nil)
+	caFile, _ := ca.write(t, tmp, "ca", time.Now())
+	server := newTestCert(t, "server", ca)
+	certFile, keyFile := server.write(t, tmp, "server", time.Now().Add(-time.Minute))
+	client := newTestCert(t, "client", ca)
+
+	config, err := newTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis := tls.NewListener(tcp, config)
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			if handshake(conn) == nil {
+				conn.Write([]byte("ok"))
+			}
+			conn.Close()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	// dial returns the serial number of the server's certificate.
+	dial := func(certs ...tls.Certificate) (*big.Int, error) {
+		conn, err := tls.Dial("tcp", lis.Addr().String(), &tls.Config{RootCAs: roots, Certificates: certs})
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		if b, err := ioutil.ReadAll(conn); err != nil || string(b) != "ok" {
+			return nil, err
+		}
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber, nil
+	}
+
+	serial, err := dial(client.tlsCertificate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial.Cmp(server.cert.SerialNumber) != 0 {
+		t.Error("expected the server certificate")
+	}
+	if _, err := dial(); err == nil {
+		t.Error("expected clients without a certificate to be rejected")
+	}
+	if _, err := dial(newTestCert(t, "stranger", newTestCert(t, "other ca", nil)).tlsCertificate()); err == nil {
+		t.Error("expected clients with a certificate of another CA to be rejected")
+	}
+
+	// Renewed certificates are used for new connections.
+	renewed := newTestCert(t, "server", ca)
+	renewed.write(t, tmp, "server", time.Now())
+	if serial, err := dial(client.tlsCertificate()); err != nil || serial.Cmp(renewed.cert.SerialNumber) != 0 {
+		t.Errorf("expected the renewed certificate, got %v", err)
+	}
+
+	// Invalid certificates are not picked up.
+	if err := ioutil.WriteFile(certFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(certFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	for i := 0; i < 2; i++ {
+		if serial, err := dial(client.tlsCertificate()); err != nil || serial.Cmp(renewed.cert.SerialNumber) != 0 {
+			t.Errorf("expected the previous certificate to be kept, got %v", err)
+		}
+	}
+
+	if _, err := newTLSConfig(certFile, "", ""); err == nil {
+		t.Error("expected an error for -tlsCert without -tlsKey")
+	}
+}
@@ -11,7 +11,10 @@ import (
 	nettrace "golang.org/x/net/trace"
 )
 
-func traceRequests(sessionID string) jsonrpc2.ConnOpt {
+// traceRequests traces each request sent on the connection (or received on
+// it if received is true) with its response as a golang.org/x/net/trace
+// trace with the title title.
+func traceRequests(title string, received bool) jsonrpc2.ConnOpt {
 	return func(c *jsonrpc2.Conn) {
 		var (
 			mu     sync.Mutex
@@ -30,7 +33,7 @@ func traceRequests(sessionID string) jsonrpc2.ConnOpt {
 			traces = map[jsonrpc2.ID]nettrace.Trace{}
 		}()
 
-		jsonrpc2.OnSend(func(req *jsonrpc2.Request, resp *jsonrpc2.Response) {
+		start := func(req *jsonrpc2.Request, resp *jsonrpc2.Response) {
 			if req == nil || req.Notif || resp != nil {
 				return
 			}
@@ -42,15 +45,15 @@ func traceRequests(sessionID string) jsonrpc2.ConnOpt {
 				tr.LazyPrintf("error ID repeated")
 				tr.SetError()
 			} else {
-				tr = nettrace.New(req.Method, sessionID)
+				tr = nettrace.New(req.Method, title)
 				traces[req.ID] = tr
 			}
 			mu.Unlock()
 
 			tr.LazyPrintf("id: %s", lazyMarshal{req.ID})
 			tr.LazyPrintf("params: %s", lazyMarshal{req.Params})
-		})(c)
-		jsonrpc2.OnRecv(func(req *jsonrpc2.Request, resp *jsonrpc2.Response) {
+		}
+		finish := func(req *jsonrpc2.Request, resp *jsonrpc2.Response) {
 			if resp == nil {
 				return
 			}
@@ -71,7 +74,14 @@ func traceRequests(sessionID string) jsonrpc2.ConnOpt {
 				tr.SetError()
 			}
 			tr.Finish()
-		})(c)
+		}
+		if received {
+			jsonrpc2.OnRecv(start)(c)
+			jsonrpc2.OnSend(finish)(c)
+		} else {
+			jsonrpc2.OnSend(start)(c)
+			jsonrpc2.OnRecv(finish)(c)
+		}
 	}
 }
 
@@ -128,7 +138,7 @@ func traceEventLog(family, title string) jsonrpc2.ConnOpt {
 	}
 }
 
-func debugServer(addr string) {
+func debugServer(addr string, limiter *sessionLimiter, health *healthChecker, canary *canary, sessions *sessionList, configs *configReloader) {
 	if addr == "" {
 		return
 	}
@@ -143,6 +153,15 @@ func debugServer(addr string) {
 				<a href="/debug/pprof/">PProf</a><br>
 				<a href="/debug/requests">Requests</a><br>
 				<a href="/debug/events">Events</a><br>
+				<a href="/debug/sessions">Sessions</a><br>
+				<a href="/debug/stderr">Language server stderr</a><br>
+				<a href="/metrics">Metrics</a><br>
+				<a href="/debug/canary">Canary</a><br>
+				<a href="/debug/loglevel">Log level</a><br>
+				<a href="/debug/reload">Configuration reloads</a><br>
+				<a href="/healthz/live">Liveness</a><br>
+				<a href="/healthz/ready">Readiness</a><br>
+				<a href="/healthz/deep">Language server health</a><br>
 			`))
 	})
 	pp.Handle("/", index)
@@ -154,6 +173,25 @@ func debugServer(addr string) {
 	pp.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
 	pp.Handle("/debug/requests", http.HandlerFunc(nettrace.Traces))
 	pp.Handle("/debug/events", http.HandlerFunc(nettrace.Events))
+	pp.Handle("/debug/sessions", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		limiter.writeStats(w)
+	}))
+	pp.Handle("/debug/reload", configs)
+	pp.Handle("/debug/stderr", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		sessions.writeStderr(w)
+	}))
+	pp.Handle("/debug/canary", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		canary.writeStatus(w)
+	}))
+	pp.Handle("/debug/loglevel", http.HandlerFunc(serveLogLevel))
+	pp.Handle("/healthz/", health)
+	pp.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w)
+	}))
 	log.Println("warning: could not start debug HTTP server:", http.ListenAndServe(addr, pp))
 }
 
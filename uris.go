@@ -1,14 +1,13 @@
 package main
 
 import (
-	"fmt"
-	"log"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/sourcegraph/go-langserver/pkg/lsp"
 
@@ -17,22 +16,26 @@ import (
 
 func (p *cloneProxy) cloneWorkspaceToCache(globs []string) error {
 	fs := &remoteFS{conn: p.client, traceID: p.sessionID.String()}
-	err := fs.Clone(p.ctx, p.workspaceCacheDir(), globs)
+	start := time.Now()
+	err := fs.Clone(withLogger(p.ctx, p.logger()), p.workspaceCacheDir(), globs)
 	if err != nil {
 		return errors.Wrap(err, "failed to clone workspace to local cache")
 	}
+	metricCloneDuration.observeDuration(start)
+	metricCloneFiles.observe(float64(fs.files))
+	metricCloneBytes.observe(float64(fs.bytes))
 
-	log.Printf("Cloned workspace to %s", p.workspaceCacheDir())
+	p.logger().with("files", fs.files, "bytes", fs.bytes, "duration", time.Since(start)).infof("Cloned workspace to %s", p.workspaceCacheDir())
 	return nil
 }
 
-func (p *cloneProxy) cleanWorkspaceCache() error {
-	log.Printf("Removing workspace cache from %s", p.workspaceCacheDir())
-	return os.RemoveAll(p.workspaceCacheDir())
+func (ws *workspace) cleanWorkspaceCache() error {
+	rootLogger.infof("Removing workspace cache from %s", ws.dir)
+	return os.RemoveAll(ws.dir)
 }
 
 func (p *cloneProxy) workspaceCacheDir() string {
-	return filepath.Join(*cacheDir, p.sessionID.String())
+	return p.workspace().dir
 }
 
 func clientToServerURI(uri lsp.DocumentURI, sysCacheDir string) lsp.DocumentURI {
@@ -42,7 +45,7 @@ func clientToServerURI(uri lsp.DocumentURI, sysCacheDir string) lsp.DocumentURI
 	parsedURI, err := url.Parse(string(uri))
 
 	if err != nil {
-		log.Println(fmt.Sprintf("clientToServerURI: err when trying to parse uri %s", uri), err)
+		rootLogger.warnf("clientToServerURI: err when trying to parse uri %s %s", uri, err)
 		return uri
 	}
 
@@ -63,7 +66,7 @@ func serverToClientURI(uri lsp.DocumentURI, sysCacheDir string) lsp.DocumentURI
 	parsedURI, err := url.Parse(string(uri))
 
 	if err != nil {
-		log.Println(fmt.Sprintf("serverToClientURI: err when trying to parse uri %s", uri), err)
+		rootLogger.warnf("serverToClientURI: err when trying to parse uri %s %s", uri, err)
 		return uri
 	}
 
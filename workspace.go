@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/go-langserver/pkg/lsp"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// workspace is a clone of a repository in the workspace cache together with
+// the language server working on it. A workspace usually lives as long as
+// the session it was created for, but with -keepAlive it can outlive it and
+// be reused by a later session for the same repository, and with -multiplex
+// several sessions for the same repository use it at once.
+type workspace struct {
+	key    string // identifies the repository, protected by the workspaceRegistry
+	users  int    // number of sessions using the workspace, protected by the workspaceRegistry
+	dir    string // the workspace cache directory
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lastRequestID *atomicCounter // counter that is incremented for each new request that is sent to the language server
+
+	config     *sessionConfig     // the configuration of the session the workspace was created for
+	serverDir  string             // the cwd the language server was started in
+	serverDone chan struct{}      // closed once the language server disconnects for good (or failed to connect)
+	serverOpts []jsonrpc2.ConnOpt // options for the connection to the language server
+
+	serverMu       sync.Mutex     // protects the fields below
+	server         *jsonrpc2.Conn // connection to the language server, use serverConn to access it
+	serverProc     *lsProcess     // the language server process, nil if lsp-adapter did not start it
+	serverReplaced chan struct{}  // closed when server is replaced after a restart
+	closing        bool           // set by close, prevents further restarts
+	restarts       int            // number of times the language server has been restarted
+
+	// The params of the 'initialize' request and 'initialized' notification
+	// sent by the client, which are replayed when the language server is
+	// restarted, and the result of the 'initialize' request, which is sent
+	// to sessions that reuse the workspace.
+	initMu            sync.Mutex
+	initParams        *json.RawMessage
+	initialized       bool
+	initializedParams *json.RawMessage
+	initResult        *json.RawMessage
+
+	initOnce sync.Once     // protects initErr and closing initDone
+	initDone chan struct{} // closed once the first 'initialize' request has been handled
+	initErr  error         // set if the first 'initialize' request failed
+
+	// The number of sessions which have opened each document with
+	// 'textDocument/didOpen', so that the language server only receives the
+	// first 'textDocument/didOpen' and last 'textDocument/didClose'.
+	docsMu sync.Mutex
+	docs   map[lsp.DocumentURI]int
+
+	// HACK
+	didOpenMu sync.Mutex
+	didOpen   map[string]lsp.DocumentURI // file path -> URI of the files we sent 'textDocument/didOpen' for
+
+	sessionMu sync.Mutex
+	sessions  []*cloneProxy // the sessions using the workspace, empty while it is idle
+}
+
+func newWorkspace(ctx context.Context, dir string, config *sessionConfig, serverOpts []jsonrpc2.ConnOpt) *workspace {
+	ctx, cancel := context.WithCancel(ctx)
+	return &workspace{
+		dir:           dir,
+		ctx:           ctx,
+		cancel:        cancel,
+		lastRequestID: newAtomicCounter(),
+		config:        config,
+		serverDone:    make(chan struct{}),
+		serverOpts:    serverOpts,
+		initDone:      make(chan struct{}),
+		docs:          map[lsp.DocumentURI]int{},
+		didOpen:       map[string]lsp.DocumentURI{},
+	}
+}
+
+// startServer connects to the language server and starts proxying requests
+// from it to the attached session. It must only be called once.
+func (ws *workspace) startServer(dir string) error {
+	ws.serverDir = dir
+	conn, proc, err := ws.connectServer()
+	if err != nil {
+		close(ws.serverDone)
+		return err
+	}
+
+	ws.serverMu.Lock()
+	ws.server, ws.serverProc = conn, proc
+	ws.serverReplaced = make(chan struct{})
+	ws.serverMu.Unlock()
+
+	go ws.watchServer(conn)
+	return nil
+}
+
+// connectServer connects to a new instance of the language server.
+func (ws *workspace) connectServer() (*jsonrpc2.Conn, *lsProcess, error) {
+	lsConn, err := ws.config.connectLS(ws.ctx, lsTemplateData{WorkspaceDir: ws.dir}, ws.serverDir)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "connecting to language server failed")
+	}
+	proc := lsProcessOf(lsConn)
+	if proc != nil {
+		proc.output.setSink(ws.handleStderr)
+		proc.setLogger(ws.logger)
+	} else if c, ok := lsConn.(*compositeConn); ok {
+		c.setSink(ws.handleStderr)
+		c.setLogger(ws.logger)
+	}
+	conn := jsonrpc2.NewConn(ws.ctx, jsonrpc2.NewBufferedStream(lsConn, jsonrpc2.VSCodeObjectCodec{}), jsonrpc2.AsyncHandler(jsonrpc2HandlerFunc(ws.handleServerRequest)), ws.serverOpts...)
+	return conn, proc, nil
+}
+
+// serverConn returns the current connection to the language server. It must
+// only be called once startServer has returned successfully.
+func (ws *workspace) serverConn() *jsonrpc2.Conn {
+	ws.serverMu.Lock()
+	defer ws.serverMu.Unlock()
+	return ws.server
+}
+
+// serverAlive reports whether the language server is (still) running.
+func (ws *workspace) serverAlive() bool {
+	return !ws.serverExited() && ws.serverConn() != nil
+}
+
+// serverExited reports whether the language server has gone away for good.
+func (ws *workspace) serverExited() bool {
+	select {
+	case <-ws.serverDone:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the language server. It prevents the language server from
+// being restarted.
+func (ws *workspace) close() {
+	ws.serverMu.Lock()
+	ws.closing = true
+	server, proc := ws.server, ws.serverProc
+	ws.serverMu.Unlock()
+
+	if server != nil {
+		if proc != nil {
+			ws.shutdownServer(server, proc)
+		}
+		server.Close()
+	}
+	ws.finishInitialize(nil, errors.New("workspace closed"))
+	ws.cancel()
+}
+
+// shutdownServer asks the language server process proc to exit by sending
+// the 'shutdown' request followed by the 'exit' notification. Closing the
+// connection to the language server afterwards forcibly stops it if it
+// doesn't comply, by the same deadlines (see lsProcess.stopDeadlines).
+func (ws *workspace) shutdownServer(server *jsonrpc2.Conn, proc *lsProcess) {
+	select {
+	case <-server.DisconnectNotify():
+		return
+	default:
+	}
+
+	exitDeadline, _ := proc.stopDeadlines()
+	ctx, cancel := context.WithDeadline(context.Background(), exitDeadline)
+	defer cancel()
+
+	var opts []jsonrpc2.CallOption
+	if ws.config.jsonrpc2IDRewrite != "none" {
+		opts = append(opts, jsonrpc2.PickID(rewriteID(ws.config.jsonrpc2IDRewrite, jsonrpc2.ID{}, ws.lastRequestID)))
+	}
+	if err := server.Call(ctx, "shutdown", nil, nil, opts...); err != nil {
+		ws.logger().warnf("CloneProxy.shutdownServer(): shutdown request failed: %s", err)
+		return
+	}
+	if err := server.Notify(ctx, "exit", nil); err != nil {
+		ws.logger().warnf("CloneProxy.shutdownServer(): exit notification failed: %s", err)
+	}
+}
+
+// attach adds p to the sessions which messages from the language server are
+// sent to. detach undoes it.
+func (ws *workspace) attach(p *cloneProxy) {
+	ws.sessionMu.Lock()
+	ws.sessions = append(ws.sessions, p)
+	ws.sessionMu.Unlock()
+}
+
+func (ws *workspace) detach(p *cloneProxy) {
+	ws.sessionMu.Lock()
+	for i, s := range ws.sessions {
+		if s == p {
+			ws.sessions = append(ws.sessions[:i], ws.sessions[i+1:]...)
+			break
+		}
+	}
+	ws.sessionMu.Unlock()
+}
+
+// logger returns the logger for messages about the workspace. They carry the
+// workspace directory and the IDs of the sessions using it, if any.
+func (ws *workspace) logger() *logger {
+	ws.sessionMu.Lock()
+	sessions := append([]*cloneProxy(nil), ws.sessions...)
+	ws.sessionMu.Unlock()
+
+	switch len(sessions) {
+	case 0:
+		return rootLogger.with("workspace", ws.dir)
+	case 1:
+		return sessions[0].logger().with("workspace", ws.dir)
+	default:
+		ids := make([]string, len(sessions))
+		for i, p := range sessions {
+			ids[i] = p.sessionID.String()
+		}
+		return rootLogger.with("session", strings.Join(ids, ","), "workspace", ws.dir)
+	}
+}
+
+// handleServerRequest passes notifications from the language server on to
+// all sessions using the workspace, and requests to the one that has been
+// using it the longest whose client is still connected. Requests nobody can
+// answer are replied to with an error.
+func (ws *workspace) handleServerRequest(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	if req.Notif {
+		ws.sessionMu.Lock()
+		sessions := append([]*cloneProxy(nil), ws.sessions...)
+		ws.sessionMu.Unlock()
+		for _, p := range sessions {
+			p.handleServerRequest(ctx, conn, req)
+		}
+		return
+	}
+
+	p := ws.liveSession(nil)
+	if p == nil {
+		// The workspace is being kept alive, or all clients have
+		// disconnected: there is nobody to pass this on to.
+		if err := conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{Code: jsonrpc2.CodeInternalError, Message: "no client is connected"}); err != nil {
+			ws.logger().warnf("CloneProxy.handleServerRequest(): sending error reply failed: %s", err)
+		}
+		return
+	}
+	p.handleServerRequest(ctx, conn, req)
+}
+
+// liveSession returns the session that has been using the workspace the
+// longest whose client is still connected, skipping the one connected to
+// the client except, or nil if there is none.
+func (ws *workspace) liveSession(except *jsonrpc2.Conn) *cloneProxy {
+	ws.sessionMu.Lock()
+	defer ws.sessionMu.Unlock()
+	for _, p := range ws.sessions {
+		if p.client != except && p.clientConnected() {
+			return p
+		}
+	}
+	return nil
+}
+
+func (ws *workspace) recordInitialize(params *json.RawMessage) {
+	ws.initMu.Lock()
+	ws.initParams = params
+	ws.initMu.Unlock()
+}
+
+// finishInitialize records the result of the first 'initialize' request, or
+// the error that prevented it from being handled. Only the first call has an
+// effect.
+func (ws *workspace) finishInitialize(result *json.RawMessage, err error) {
+	ws.initOnce.Do(func() {
+		ws.initMu.Lock()
+		ws.initResult = result
+		ws.initMu.Unlock()
+		ws.initErr = err
+		close(ws.initDone)
+	})
+}
+
+// waitForInitialize blocks until finishInitialize has been called, and
+// returns the result of the first 'initialize' request.
+func (ws *workspace) waitForInitialize(ctx context.Context) (*json.RawMessage, error) {
+	select {
+	case <-ws.initDone:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if ws.initErr != nil {
+		return nil, ws.initErr
+	}
+	ws.initMu.Lock()
+	defer ws.initMu.Unlock()
+	return ws.initResult, nil
+}
+
+// recordInitialized records the params of the 'initialized' notification.
+// It returns false if the language server has already received one.
+func (ws *workspace) recordInitialized(params *json.RawMessage) bool {
+	ws.initMu.Lock()
+	defer ws.initMu.Unlock()
+	if ws.initialized {
+		return false
+	}
+	ws.initialized = true
+	ws.initializedParams = params
+	return true
+}
+
+// openDocument records that a session opened the document at uri. It
+// returns true if no other session has it open.
+func (ws *workspace) openDocument(uri lsp.DocumentURI) bool {
+	ws.docsMu.Lock()
+	defer ws.docsMu.Unlock()
+	ws.docs[uri]++
+	return ws.docs[uri] == 1
+}
+
+// closeDocument records that a session closed the document at uri. It
+// returns true if no other session has it open anymore.
+func (ws *workspace) closeDocument(uri lsp.DocumentURI) bool {
+	ws.docsMu.Lock()
+	defer ws.docsMu.Unlock()
+	ws.docs[uri]--
+	if ws.docs[uri] > 0 {
+		return false
+	}
+	delete(ws.docs, uri)
+	return true
+}
+
+// reusable reports whether the workspace can be kept alive for another
+// session once the current one ends.
+func (ws *workspace) reusable() bool {
+	select {
+	case <-ws.initDone:
+	default:
+		return false
+	}
+	return ws.initErr == nil && ws.ctx.Err() == nil && ws.serverAlive()
+}
+
+// exitedProcess returns the language server process once it has exited,
+// or nil if it doesn't exit within a second or the language server is not
+// a process started by lsp-adapter.
+func (ws *workspace) exitedProcess() *lsProcess {
+	proc := ws.serverProcess()
+	if proc == nil {
+		return nil
+	}
+	select {
+	case <-proc.exited:
+		return proc
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+// reportResourceLimitExceeded tells the sessions using the workspace if the
+// language server has been killed for exceeding its resource limits.
+func (ws *workspace) reportResourceLimitExceeded() {
+	ws.serverMu.Lock()
+	closing := ws.closing
+	ws.serverMu.Unlock()
+	if closing {
+		return
+	}
+	proc := ws.exitedProcess()
+	if proc == nil || proc.limitExceeded == "" {
+		return
+	}
+	msg := fmt.Sprintf("The language server (pid %d) %s.", proc.cmd.Process.Pid, proc.limitExceeded)
+	ws.logger().errorf("CloneProxy: %s", msg)
+
+	ws.sessionMu.Lock()
+	sessions := append([]*cloneProxy(nil), ws.sessions...)
+	ws.sessionMu.Unlock()
+	for _, p := range sessions {
+		if err := p.client.Notify(p.ctx, "window/showMessage", &lsp.ShowMessageParams{Type: lsp.MTError, Message: msg}); err != nil {
+			p.logger().warnf("CloneProxy.reportResourceLimitExceeded(): sending window/showMessage failed: %s", err)
+		}
+	}
+}
+
+// explainServerError replaces err, which occurred sending a request to the
+// language server, by a more helpful error if the language server has
+// exited unexpectedly, e.x. because it has been killed for exceeding its
+// resource limits. The error includes the last lines of its stderr.
+func (ws *workspace) explainServerError(err error) error {
+	if err != io.ErrUnexpectedEOF && err != jsonrpc2.ErrClosed {
+		return err
+	}
+	proc := ws.exitedProcess()
+	if proc == nil {
+		return err
+	}
+	if proc.limitExceeded != "" {
+		return errors.Errorf("the language server %s%s", proc.limitExceeded, proc.stderrTail())
+	}
+
+	ws.serverMu.Lock()
+	closing := ws.closing
+	ws.serverMu.Unlock()
+	if closing || atomic.LoadInt32(&proc.killing) != 0 {
+		return err
+	}
+	return errors.Errorf("the language server exited unexpectedly: %s", proc.describeExit())
+}
+
+// sendDidOpen sends a 'textDocument/didOpen' notification for the file at
+// path (which is identified by uri) to server. See the HACK comment in
+// handleClientRequest.
+func (ws *workspace) sendDidOpen(ctx context.Context, server *jsonrpc2.Conn, uri lsp.DocumentURI, path string) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	err = server.Notify(ctx, "textDocument/didOpen", &lsp.DidOpenTextDocumentParams{
+		TextDocument: lsp.TextDocumentItem{
+			URI:        uri,
+			LanguageID: ws.config.didOpenLanguage,
+			Version:    1,
+			Text:       string(b),
+		},
+	})
+	if err != nil {
+		ws.logger().warnf("CloneProxy: sending didOpen failed: %s", err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestWorkspaceLogger(t *testing.T) {
+	logs, restore := captureLogs("logfmt")
+	defer restore()
+
+	ws := newWorkspace(context.Background(), "/tmp/ws", &sessionConfig{}, nil)
+	newSession := func() *cloneProxy {
+		id := uuid.New()
+		return &cloneProxy{sessionID: id, sessionLog: rootLogger.with("session", id.String())}
+	}
+	a, b := newSession(), newSession()
+
+	ws.logger().infof("idle")
+	ws.attach(a)
+	ws.logger().infof("one session")
+	ws.attach(b)
+	ws.logger().infof("two sessions")
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	want := []string{
+		"workspace=/tmp/ws",
+		"session=" + a.sessionID.String() + " workspace=/tmp/ws",
+		"session=" + a.sessionID.String() + "," + b.sessionID.String() + " workspace=/tmp/ws",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %q, want %d lines", lines, len(want))
+	}
+	for i, line := range lines {
+		if !strings.HasSuffix(line, want[i]) {
+			t.Errorf("got %q, want it to end with %q", line, want[i])
+		}
+	}
+}